@@ -0,0 +1,179 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"math/bits"
+)
+
+// Chunker splits a stream of data into chunks. Next returns io.EOF once
+// there is no data left
+type Chunker interface {
+	Next() ([]byte, error)
+}
+
+// fixedChunker splits the data into chunks of the same size, only the last chunk
+// can be smaller
+type fixedChunker struct {
+	r    io.Reader
+	size int64
+}
+
+func newFixedChunker(r io.Reader, size int64) *fixedChunker {
+	return &fixedChunker{r: r, size: size}
+}
+
+func (c *fixedChunker) Next() ([]byte, error) {
+	buf := make([]byte, c.size)
+	n, err := io.ReadFull(c.r, buf)
+	if n > 0 {
+		return buf[:n], nil
+	}
+	if errors.Is(err, io.ErrUnexpectedEOF) {
+		err = io.EOF
+	}
+	return nil, err
+}
+
+// CDCOpts holds the sizes used by the content defined chunker. The chunks are
+// never smaller than MinSize (except the last one) or bigger than MaxSize, and
+// have AvgSize bytes on average
+type CDCOpts struct {
+	MinSize int
+	AvgSize int
+	MaxSize int
+}
+
+// DefaultCDCOpts are the sizes used when no CDCOpts are given
+var DefaultCDCOpts = CDCOpts{
+	MinSize: 16 * 1024,
+	AvgSize: 64 * 1024,
+	MaxSize: 256 * 1024,
+}
+
+// gearTable holds the random values used by the rolling hash. The table is generated
+// from a fixed seed, so every node cuts the same data at the same boundaries
+var gearTable = func() (table [256]uint64) {
+	// splitmix64
+	seed := uint64(0x9e3779b97f4a7c15)
+	for i := range table {
+		seed += 0x9e3779b97f4a7c15
+		z := seed
+		z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+		z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+		table[i] = z ^ (z >> 31)
+	}
+	return
+}()
+
+// FastCDC is a content defined chunker based on the FastCDC algorithm. As the chunk
+// boundaries depend on the content and not on the offsets, inserting or removing bytes
+// in a file only changes the chunks around the modification, so successive versions
+// of a file share most of their chunks
+type FastCDC struct {
+	CDCOpts
+
+	r   io.Reader
+	buf []byte
+	eof bool
+	// maskS is used before reaching AvgSize, it has more bits set so it's harder
+	// to find a boundary. maskL is used after AvgSize, making boundaries easier
+	maskS uint64
+	maskL uint64
+}
+
+// NewFastCDC returns a content defined chunker reading from r
+func NewFastCDC(r io.Reader, opts CDCOpts) *FastCDC {
+	if opts.AvgSize <= 0 {
+		opts = DefaultCDCOpts
+	}
+	if opts.MinSize <= 0 || opts.MinSize > opts.AvgSize {
+		opts.MinSize = opts.AvgSize / 4
+	}
+	if opts.MaxSize < opts.AvgSize {
+		opts.MaxSize = opts.AvgSize * 4
+	}
+
+	n := bits.Len(uint(opts.AvgSize)) - 1
+	return &FastCDC{
+		CDCOpts: opts,
+		r:       r,
+		buf:     make([]byte, 0, opts.MaxSize),
+		maskS:   topBitsMask(n + 1),
+		maskL:   topBitsMask(n - 1),
+	}
+}
+
+// topBitsMask returns a mask with the n most significant bits set. The gear hash is
+// shifted to the left on every byte, so the top bits are the ones that depend on
+// the widest window of data
+func topBitsMask(n int) uint64 {
+	if n <= 0 {
+		return 0
+	}
+	return ^uint64(0) << (64 - n)
+}
+
+func (c *FastCDC) Next() ([]byte, error) {
+	if err := c.fill(); err != nil {
+		return nil, err
+	}
+	if len(c.buf) == 0 {
+		return nil, io.EOF
+	}
+
+	cut := c.cutPoint(c.buf)
+	chunk := make([]byte, cut)
+	copy(chunk, c.buf[:cut])
+	c.buf = c.buf[:copy(c.buf, c.buf[cut:])]
+
+	return chunk, nil
+}
+
+// fill reads from the underlying reader until the buffer holds MaxSize bytes
+func (c *FastCDC) fill() error {
+	for !c.eof && len(c.buf) < c.MaxSize {
+		n, err := c.r.Read(c.buf[len(c.buf):c.MaxSize])
+		c.buf = c.buf[:len(c.buf)+n]
+		if err == io.EOF {
+			c.eof = true
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *FastCDC) cutPoint(data []byte) int {
+	n := len(data)
+	if n <= c.MinSize {
+		return n
+	}
+	if n > c.MaxSize {
+		n = c.MaxSize
+	}
+	normal := c.AvgSize
+	if n < normal {
+		normal = n
+	}
+
+	var (
+		fp uint64
+		i  = c.MinSize
+	)
+	for ; i < normal; i++ {
+		fp = (fp << 1) + gearTable[data[i]]
+		if fp&c.maskS == 0 {
+			return i + 1
+		}
+	}
+	for ; i < n; i++ {
+		fp = (fp << 1) + gearTable[data[i]]
+		if fp&c.maskL == 0 {
+			return i + 1
+		}
+	}
+	return n
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"math/rand"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var testCDCOpts = CDCOpts{MinSize: 1024, AvgSize: 4096, MaxSize: 16384}
+
+func TestFastCDCBoundaries(t *testing.T) {
+	data := randomData(200 * 1024)
+	chunks := splitChunks(t, NewFastCDC(bytes.NewReader(data), testCDCOpts))
+
+	var joined []byte
+	for i, chunk := range chunks {
+		assert.LessOrEqual(t, len(chunk), testCDCOpts.MaxSize)
+		if i < len(chunks)-1 {
+			assert.GreaterOrEqual(t, len(chunk), testCDCOpts.MinSize)
+		}
+		joined = append(joined, chunk...)
+	}
+	assert.Equal(t, data, joined)
+}
+
+func TestFastCDCSharesChunks(t *testing.T) {
+	var (
+		v1 = randomData(200 * 1024)
+		v2 = append([]byte("a new header in the second version"), v1...)
+	)
+
+	hashes := make(map[string]bool)
+	for _, chunk := range splitChunks(t, NewFastCDC(bytes.NewReader(v1), testCDCOpts)) {
+		hashes[hashChunk(chunk)] = true
+	}
+
+	chunks := splitChunks(t, NewFastCDC(bytes.NewReader(v2), testCDCOpts))
+	var shared int
+	for _, chunk := range chunks {
+		if hashes[hashChunk(chunk)] {
+			shared++
+		}
+	}
+
+	// Only the chunk containing the new header should differ
+	assert.GreaterOrEqual(t, shared, len(chunks)-2)
+}
+
+func TestFixedChunker(t *testing.T) {
+	chunks := splitChunks(t, newFixedChunker(bytes.NewReader([]byte("Foo not Bar")), 4))
+
+	assert.Equal(t, [][]byte{[]byte("Foo "), []byte("not "), []byte("Bar")}, chunks)
+}
+
+func splitChunks(t *testing.T, c Chunker) [][]byte {
+	var chunks [][]byte
+	for {
+		chunk, err := c.Next()
+		if err == io.EOF {
+			return chunks
+		}
+		assert.Nil(t, err)
+		chunks = append(chunks, chunk)
+	}
+}
+
+func randomData(size int) []byte {
+	data := make([]byte, size)
+	rand.New(rand.NewSource(1)).Read(data)
+	return data
+}
@@ -0,0 +1,624 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/gob"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/marcosvdn7/go-filestorage/p2p"
+)
+
+// maxChunkAttempts is how many times a chunk is requested before Get gives up on the file
+const maxChunkAttempts = 3
+
+// chunkWindow is how many chunks of a file are held in memory at once, while they are
+// sent to the peers or waiting for the previous chunks to be fetched
+const chunkWindow = 16
+
+// maxManifestSize is the size of the biggest manifest accepted from a peer
+const maxManifestSize = 16 << 20
+
+// ChunkRef identifies a chunk by the hash of its encrypted content
+type ChunkRef struct {
+	Hash string
+	Size int64
+}
+
+// Manifest describes how a chunked file is rebuilt: the plain size of the file
+// and the ordered list of its chunks
+type Manifest struct {
+	Size   int64
+	Chunks []ChunkRef
+}
+
+func (m *Manifest) encode() ([]byte, error) {
+	buf := new(bytes.Buffer)
+	if err := gob.NewEncoder(buf).Encode(m); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func decodeManifest(r io.Reader) (*Manifest, error) {
+	m := new(Manifest)
+	if err := gob.NewDecoder(r).Decode(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// hashChunk returns the hex encoded sha256 of the chunk data
+func hashChunk(data []byte) string {
+	hash := sha256.Sum256(data)
+	return hex.EncodeToString(hash[:])
+}
+
+// chunkKey returns the key used to store the chunk with the given hash
+func chunkKey(hash string) string {
+	return "chunk." + hash
+}
+
+// manifestKey returns the key used to store the manifest of the given key
+func manifestKey(key string) string {
+	return key + ".manifest"
+}
+
+// chunkRefsKey returns the key holding how many manifests of the owner reference
+// the chunk with the given hash
+func chunkRefsKey(hash string) string {
+	return chunkKey(hash) + ".refs"
+}
+
+// isManifestKey reports if the key sent by a peer names a manifest
+func isManifestKey(key string) bool {
+	return strings.HasSuffix(key, ".manifest")
+}
+
+// storeChunks splits the file into chunks and sends them to the peers as they come
+// out of the chunker, chunkWindow chunks at a time. Every peer is asked which chunks of
+// the batch it already holds and only receives the missing ones. The manifest of the
+// file is sent once all the chunks are
+func (fs *FileServer) storeChunks(key string, r io.Reader) error {
+	var (
+		manifest Manifest
+		peers    = fs.sortedPeers()
+		// hashes are the chunks of the batch, in the order they were read
+		hashes  []string
+		chunks  = make(map[string][]byte)
+		sent    = make(map[string]bool)
+		chunker = fs.newChunker(r)
+	)
+	for {
+		data, err := chunker.Next()
+		if err != nil && err != io.EOF {
+			return err
+		}
+		if err == nil {
+			encrypted, err := encryptConvergent(fs.EncryptionKey, data)
+			if err != nil {
+				return err
+			}
+			ref := ChunkRef{Hash: hashChunk(encrypted), Size: int64(len(encrypted))}
+			if _, ok := chunks[ref.Hash]; !ok && !sent[ref.Hash] {
+				chunks[ref.Hash] = encrypted
+				hashes = append(hashes, ref.Hash)
+			}
+			manifest.Chunks = append(manifest.Chunks, ref)
+			manifest.Size += int64(len(data))
+		}
+
+		if len(hashes) == chunkWindow || (err == io.EOF && len(hashes) > 0) {
+			for _, peer := range peers {
+				if err := fs.storeChunksOnPeer(peer, hashes, chunks); err != nil {
+					return err
+				}
+			}
+			for _, hash := range hashes {
+				sent[hash] = true
+			}
+			hashes = hashes[:0]
+			clear(chunks)
+		}
+		if err == io.EOF {
+			break
+		}
+	}
+
+	b, err := manifest.encode()
+	if err != nil {
+		return err
+	}
+	for _, peer := range peers {
+		if err := fs.transfer(peer, manifestKey(hashKey(key)), bytesContent(b)); err != nil {
+			return err
+		}
+	}
+
+	fmt.Printf("[%s] stored (%s) as %d chunks (%d unique)\n", fs.Transport.Addr(), key, len(manifest.Chunks), len(sent))
+
+	return nil
+}
+
+// newChunker returns the content defined chunker when CDC is enabled,
+// otherwise the data is split in chunks of ChunkSize bytes
+func (fs *FileServer) newChunker(r io.Reader) Chunker {
+	if fs.CDC != nil {
+		return NewFastCDC(r, *fs.CDC)
+	}
+	return newFixedChunker(r, fs.ChunkSize)
+}
+
+// storeChunksOnPeer sends to the peer only the chunks it doesn't hold yet
+func (fs *FileServer) storeChunksOnPeer(peer p2p.Peer, hashes []string, chunks map[string][]byte) error {
+	held, err := fs.hasChunks(peer, hashes)
+	if err != nil {
+		return err
+	}
+
+	var sent int
+	for i, hash := range hashes {
+		if held[i] {
+			continue
+		}
+		if err := fs.storeOnPeer(peer, chunkKey(hash), bytesContent(chunks[hash]), 0); err != nil {
+			return err
+		}
+		sent++
+	}
+
+	fmt.Printf("[%s] sent %d of %d chunks to peer (%s)\n", fs.Transport.Addr(), sent, len(hashes), peer.RemoteAddr().String())
+
+	return nil
+}
+
+// hasChunks asks the peer which of the chunks it already holds. The peer answers
+// with one byte per hash, set to 1 when the chunk is on its disk
+func (fs *FileServer) hasChunks(peer p2p.Peer, hashes []string) ([]bool, error) {
+	msg := Message{
+		Payload: MessageHasChunks{
+			ID:     fs.ID,
+			Hashes: hashes,
+		},
+	}
+	stream, err := fs.query(peer, &msg)
+	if err != nil {
+		return nil, err
+	}
+	defer stream.Close()
+
+	flags := make([]byte, len(hashes))
+	if _, err := io.ReadFull(stream, flags); err != nil {
+		return nil, err
+	}
+
+	held := make([]bool, len(hashes))
+	for i, flag := range flags {
+		held[i] = flag == 1
+	}
+	return held, nil
+}
+
+// storeOnPeer stores the content under the given key in a single peer, sending only
+// the bytes after the offset
+func (fs *FileServer) storeOnPeer(peer p2p.Peer, key string, c content, offset int64) error {
+	r, err := c.open(offset)
+	if err != nil {
+		return err
+	}
+	msg := Message{
+		Payload: MessageStoreFile{
+			ID:     fs.ID,
+			Key:    key,
+			Size:   c.size,
+			Hash:   c.hash,
+			Offset: offset,
+		},
+	}
+	stream, err := fs.request(peer, &msg)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(stream, r); err != nil {
+		stream.Close()
+		return err
+	}
+
+	return closeAndWait(stream, codecFor(peer))
+}
+
+func (fs *FileServer) handleMessageHasChunks(stream p2p.Stream, msg MessageHasChunks) error {
+	flags := make([]byte, len(msg.Hashes))
+	for i, hash := range msg.Hashes {
+		if fs.store.Has(msg.ID, chunkKey(hash)) {
+			flags[i] = 1
+		}
+	}
+
+	_, err := stream.Write(flags)
+	return err
+}
+
+type chunkJob struct {
+	index   int
+	attempt int
+}
+
+type chunkResult struct {
+	chunkJob
+	data []byte
+	err  error
+	// fatal is set when the peer connection can no longer be used
+	fatal bool
+}
+
+// getChunks fetches the manifest of the file and then downloads the chunks, which are
+// written to the disk in the order of the manifest as they arrive
+func (fs *FileServer) getChunks(key string) (io.Reader, error) {
+	peers := fs.sortedPeers()
+	if len(peers) == 0 {
+		return nil, fmt.Errorf("[%s] no peers available to fetch (%s)", fs.Transport.Addr(), key)
+	}
+
+	manifest, err := fs.fetchManifest(peers, key)
+	if err != nil {
+		return nil, err
+	}
+
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(fs.downloadChunks(key, peers, manifest, pw))
+	}()
+	if _, err := fs.store.Write(fs.ID, key, pr); err != nil {
+		pr.CloseWithError(err)
+		return nil, err
+	}
+	for _, ref := range manifest.Chunks {
+		if err := fs.store.Remove(fs.ID, chunkKey(ref.Hash)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return nil, err
+		}
+	}
+	_, r, err := fs.store.Read(fs.ID, key)
+
+	return r, err
+}
+
+// downloadChunks writes the decrypted chunks of the manifest to w, in order. The chunks
+// are downloaded in parallel, one worker per peer, but never more than chunkWindow
+// chunks ahead of the one being written. Chunks that fail or don't match their hash
+// are retried on the next available peer
+func (fs *FileServer) downloadChunks(key string, peers []p2p.Peer, manifest *Manifest, w io.Writer) error {
+	var (
+		jobs    = make(chan chunkJob, len(manifest.Chunks))
+		results = make(chan chunkResult)
+		done    = make(chan struct{})
+		// pending holds the chunks received before their turn to be written
+		pending = make(map[int][]byte)
+		local   int
+	)
+	defer close(done)
+
+	for _, peer := range peers {
+		go fs.chunkWorker(peer, manifest, jobs, results, done)
+	}
+
+	alive := len(peers)
+	for next, scheduled := 0, 0; next < len(manifest.Chunks); {
+		for ; scheduled < min(next+chunkWindow, len(manifest.Chunks)); scheduled++ {
+			// Chunks kept on disk by a previous interrupted Get are not downloaded again
+			data, err := fs.readLocalChunk(manifest.Chunks[scheduled].Hash)
+			if err != nil {
+				jobs <- chunkJob{index: scheduled}
+				continue
+			}
+			pending[scheduled] = data
+			local++
+		}
+
+		if data, ok := pending[next]; ok {
+			if _, err := w.Write(data); err != nil {
+				return err
+			}
+			delete(pending, next)
+			next++
+			continue
+		}
+
+		if alive == 0 {
+			return fmt.Errorf("[%s] no peers left to fetch the chunks of (%s)", fs.Transport.Addr(), key)
+		}
+		res := <-results
+		if res.fatal {
+			alive--
+		}
+		if res.err != nil {
+			log.Printf("[%s] chunk %d of (%s) failed: %s", fs.Transport.Addr(), res.index, key, res.err)
+			if res.attempt+1 >= maxChunkAttempts {
+				return fmt.Errorf("[%s] giving up on chunk %d of (%s): %w", fs.Transport.Addr(), res.index, key, res.err)
+			}
+			jobs <- chunkJob{index: res.index, attempt: res.attempt + 1}
+			continue
+		}
+
+		// Keep the chunk on disk until the whole file is rebuilt, so it survives
+		// a failure of the remaining chunks
+		if _, err := fs.store.Write(fs.ID, chunkKey(manifest.Chunks[res.index].Hash), bytes.NewReader(res.data)); err != nil {
+			return err
+		}
+		data, err := fs.decryptChunk(res.data)
+		if err != nil {
+			return err
+		}
+		pending[res.index] = data
+	}
+	if local > 0 {
+		fmt.Printf("[%s] resumed (%s), %d of %d chunks were already on disk\n", fs.Transport.Addr(), key, local, len(manifest.Chunks))
+	}
+
+	return nil
+}
+
+// getChunksRange rebuilds the range of the file out of the chunks it overlaps, so only
+// those chunks are fetched from the peers
+func (fs *FileServer) getChunksRange(key string, offset, length int64) (io.ReadCloser, error) {
+	peers := fs.sortedPeers()
+	manifest, err := fs.fetchManifest(peers, key)
+	if err != nil {
+		return nil, err
+	}
+	if offset < 0 || offset > manifest.Size {
+		return nil, fmt.Errorf("%w: offset %d is out of the %d bytes of %s", ErrOutOfRange, offset, manifest.Size, key)
+	}
+
+	var (
+		buf   = new(bytes.Buffer)
+		start int64
+		end   = min(offset+length, manifest.Size)
+	)
+	for _, ref := range manifest.Chunks {
+		// Every encrypted chunk starts with its IV
+		size := ref.Size - aes.BlockSize
+		if start < end && start+size > offset {
+			data, err := fs.readChunk(peers, ref)
+			if err != nil {
+				return nil, err
+			}
+			buf.Write(data[max(offset-start, 0):min(end-start, size)])
+		}
+		start += size
+	}
+
+	return io.NopCloser(buf), nil
+}
+
+// readChunk returns the decrypted chunk, read from the disk or from the first peer
+// holding it
+func (fs *FileServer) readChunk(peers []p2p.Peer, ref ChunkRef) ([]byte, error) {
+	if data, err := fs.readLocalChunk(ref.Hash); err == nil {
+		return data, nil
+	}
+
+	err := ErrNotFound
+	for _, peer := range peers {
+		var data []byte
+		if data, err = fs.fetch(peer, chunkKey(ref.Hash), ref.Size); err != nil {
+			continue
+		}
+		if hash := hashChunk(data); hash != ref.Hash {
+			err = fmt.Errorf("hash mismatch from peer (%s): expected %s got %s", peer.RemoteAddr().String(), ref.Hash, hash)
+			continue
+		}
+		return fs.decryptChunk(data)
+	}
+
+	return nil, fmt.Errorf("[%s] could not fetch chunk %s: %w", fs.Transport.Addr(), ref.Hash, err)
+}
+
+// readLocalChunk reads and decrypts a chunk saved on disk by an interrupted Get
+func (fs *FileServer) readLocalChunk(hash string) ([]byte, error) {
+	_, r, err := fs.store.Read(fs.ID, chunkKey(hash))
+	if err != nil {
+		return nil, err
+	}
+	defer r.(io.Closer).Close()
+
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	if hashChunk(data) != hash {
+		return nil, fmt.Errorf("chunk %s is corrupted on disk", hash)
+	}
+	return fs.decryptChunk(data)
+}
+
+func (fs *FileServer) decryptChunk(data []byte) ([]byte, error) {
+	plain := new(bytes.Buffer)
+	if _, err := copyDecrypt(fs.EncryptionKey, bytes.NewReader(data), plain); err != nil {
+		return nil, err
+	}
+	return plain.Bytes(), nil
+}
+
+// fetchManifest asks the peers for the manifest of the key, one peer at a time
+func (fs *FileServer) fetchManifest(peers []p2p.Peer, key string) (*Manifest, error) {
+	err := ErrNotFound
+	for _, peer := range peers {
+		var b []byte
+		if b, err = fs.fetch(peer, manifestKey(hashKey(key)), maxManifestSize); err != nil {
+			continue
+		}
+		return decodeManifest(bytes.NewReader(b))
+	}
+
+	return nil, fmt.Errorf("[%s] could not fetch the manifest of (%s): %w", fs.Transport.Addr(), key, err)
+}
+
+func (fs *FileServer) chunkWorker(peer p2p.Peer, manifest *Manifest, jobs chan chunkJob, results chan<- chunkResult, done <-chan struct{}) {
+	for {
+		var job chunkJob
+		select {
+		case job = <-jobs:
+		case <-done:
+			return
+		}
+
+		res := chunkResult{chunkJob: job}
+		ref := manifest.Chunks[job.index]
+		res.data, res.err = fs.fetch(peer, chunkKey(ref.Hash), ref.Size)
+		if res.err != nil {
+			res.fatal = true
+		} else if hash := hashChunk(res.data); hash != ref.Hash {
+			res.err = fmt.Errorf("hash mismatch from peer (%s): expected %s got %s", peer.RemoteAddr().String(), ref.Hash, hash)
+		}
+
+		select {
+		case results <- res:
+		case <-done:
+			return
+		}
+		if res.fatal {
+			return
+		}
+	}
+}
+
+// fetch requests the data stored under the key to a single peer. The peer can't send
+// more than max bytes, the size the requester expects
+func (fs *FileServer) fetch(peer p2p.Peer, key string, max int64) ([]byte, error) {
+	msg := Message{
+		Payload: MessageGetFile{
+			ID:  fs.ID,
+			Key: key,
+		},
+	}
+	stream, err := fs.query(peer, &msg)
+	if err != nil {
+		return nil, err
+	}
+	defer stream.Close()
+
+	var header fileHeader
+	if err := binary.Read(stream, binary.LittleEndian, &header); err != nil {
+		return nil, err
+	}
+	if header.Remaining < 0 || header.Remaining > max {
+		return nil, fmt.Errorf("%w: peer (%s) announced %d bytes of (%s), at most %d expected", ErrInvalid, peer.RemoteAddr().String(), header.Remaining, key, max)
+	}
+	// The bytes are only allocated as they arrive
+	data, err := io.ReadAll(io.LimitReader(stream, header.Remaining))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) < header.Remaining {
+		return nil, fmt.Errorf("received %d of %d bytes: %w", len(data), header.Remaining, io.ErrUnexpectedEOF)
+	}
+
+	return data, nil
+}
+
+// commitManifest commits the manifest received from the owner and counts a reference
+// to each of its chunks. The references of the manifest it replaces are released
+// after, so the chunks both manifests share are kept
+func (fs *FileServer) commitManifest(id, key, tag string) error {
+	fs.refsLock.Lock()
+	defer fs.refsLock.Unlock()
+
+	old, err := fs.readLocalManifest(id, key)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	if err := fs.store.CommitPartial(id, key, tag); err != nil {
+		return err
+	}
+	manifest, err := fs.readLocalManifest(id, key)
+	if err != nil {
+		return err
+	}
+	if err := fs.addChunkRefs(id, manifest, 1); err != nil {
+		return err
+	}
+	if old != nil {
+		return fs.addChunkRefs(id, old, -1)
+	}
+	return nil
+}
+
+// removeManifest deletes the manifest and releases the references to its chunks, so
+// the chunks no other manifest of the owner references are deleted with it
+func (fs *FileServer) removeManifest(id, key string) error {
+	fs.refsLock.Lock()
+	defer fs.refsLock.Unlock()
+
+	manifest, err := fs.readLocalManifest(id, key)
+	if err != nil {
+		return err
+	}
+	if err := fs.store.Remove(id, key); err != nil {
+		return err
+	}
+	return fs.addChunkRefs(id, manifest, -1)
+}
+
+// readLocalManifest decodes the manifest stored on disk under the key
+func (fs *FileServer) readLocalManifest(id, key string) (*Manifest, error) {
+	_, r, err := fs.store.Read(id, key)
+	if err != nil {
+		return nil, err
+	}
+	defer r.(io.Closer).Close()
+
+	return decodeManifest(io.LimitReader(r, maxManifestSize))
+}
+
+// addChunkRefs adds delta to the reference count of every chunk of the manifest, a
+// chunk left without references is deleted from the disk. Must be called with
+// refsLock held
+func (fs *FileServer) addChunkRefs(id string, manifest *Manifest, delta int) error {
+	for _, ref := range manifest.Chunks {
+		refs, err := fs.chunkRefs(id, ref.Hash)
+		if err != nil {
+			return err
+		}
+		if refs += delta; refs > 0 {
+			if _, err := fs.store.Write(id, chunkRefsKey(ref.Hash), strings.NewReader(strconv.Itoa(refs))); err != nil {
+				return err
+			}
+			continue
+		}
+
+		for _, key := range []string{chunkKey(ref.Hash), chunkRefsKey(ref.Hash)} {
+			if err := fs.store.Remove(id, key); err != nil && !errors.Is(err, os.ErrNotExist) {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// chunkRefs returns how many manifests of the owner reference the chunk
+func (fs *FileServer) chunkRefs(id, hash string) (int, error) {
+	_, r, err := fs.store.Read(id, chunkRefsKey(hash))
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	defer r.(io.Closer).Close()
+
+	b, err := io.ReadAll(r)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(string(b))
+}
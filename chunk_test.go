@@ -0,0 +1,25 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestManifest(t *testing.T) {
+	m := Manifest{
+		Size: 12,
+		Chunks: []ChunkRef{
+			{Hash: hashChunk([]byte("foo not")), Size: 23},
+			{Hash: hashChunk([]byte(" bar")), Size: 20},
+		},
+	}
+
+	b, err := m.encode()
+	assert.Nil(t, err)
+
+	decoded, err := decodeManifest(bytes.NewReader(b))
+	assert.Nil(t, err)
+	assert.Equal(t, m, *decoded)
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/marcosvdn7/go-filestorage/client"
+)
+
+// defaultNodes is the gateway used by the client commands when neither the -node flag
+// nor the GOFS_NODES variable are set
+const defaultNodes = "http://localhost:3080"
+
+type clientCommand func(ctx context.Context, c *client.Client, args []string, stdin io.Reader, stdout io.Writer) error
+
+var clientCommands = map[string]clientCommand{
+	"put":     runPut,
+	"get":     runGet,
+	"rm":      runRm,
+	"ls":      runLs,
+	"stat":    runStat,
+	"cluster": runCluster,
+}
+
+// runClient runs one of the client commands against the gateways of the nodes
+func runClient(ctx context.Context, cmd string, args []string, stdin io.Reader, stdout io.Writer) error {
+	run, ok := clientCommands[cmd]
+	if !ok {
+		return fmt.Errorf("unknown command %q, run gofs help for the list of commands", cmd)
+	}
+
+	nodes := os.Getenv("GOFS_NODES")
+	if nodes == "" {
+		nodes = defaultNodes
+	}
+	flags := flag.NewFlagSet(cmd, flag.ExitOnError)
+	flags.StringVar(&nodes, "node", nodes, "comma separated URLs of the HTTP gateways of the nodes")
+	args = parseFlags(flags, args)
+
+	c := client.NewClient(client.ClientOpts{Nodes: splitList(nodes)})
+
+	return run(ctx, c, args, stdin, stdout)
+}
+
+// parseFlags parses the flags wherever they are among the arguments, as the flag
+// package stops at the first argument, and returns the arguments. Everything after
+// -- is an argument, so keys starting with a dash can be given
+func parseFlags(flags *flag.FlagSet, args []string) []string {
+	var positional []string
+	for len(args) > 0 {
+		flags.Parse(args)
+		rest := flags.Args()
+		if n := len(args) - len(rest); n > 0 && args[n-1] == "--" {
+			return append(positional, rest...)
+		}
+		if len(rest) == 0 {
+			break
+		}
+		positional = append(positional, rest[0])
+		args = rest[1:]
+	}
+
+	return positional
+}
+
+func runPut(ctx context.Context, c *client.Client, args []string, stdin io.Reader, stdout io.Writer) error {
+	if err := checkArgs("put <key> [file]", args, 1, 2); err != nil {
+		return err
+	}
+
+	r := stdin
+	if len(args) == 2 {
+		f, err := os.Open(args[1])
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		r = f
+	}
+
+	return c.Store(ctx, args[0], r)
+}
+
+func runGet(ctx context.Context, c *client.Client, args []string, stdin io.Reader, stdout io.Writer) error {
+	if err := checkArgs("get <key> [file]", args, 1, 2); err != nil {
+		return err
+	}
+
+	r, err := c.Get(ctx, args[0])
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	if len(args) == 1 {
+		_, err = io.Copy(stdout, r)
+		return err
+	}
+	f, err := os.Create(args[1])
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, r); err != nil {
+		f.Close()
+		return err
+	}
+
+	return f.Close()
+}
+
+func runRm(ctx context.Context, c *client.Client, args []string, stdin io.Reader, stdout io.Writer) error {
+	if err := checkArgs("rm <key>", args, 1, 1); err != nil {
+		return err
+	}
+
+	return c.Delete(ctx, args[0])
+}
+
+func runLs(ctx context.Context, c *client.Client, args []string, stdin io.Reader, stdout io.Writer) error {
+	if err := checkArgs("ls [prefix]", args, 0, 1); err != nil {
+		return err
+	}
+
+	var prefix string
+	if len(args) == 1 {
+		prefix = args[0]
+	}
+	files, err := c.List(ctx, prefix)
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "SIZE\tMODIFIED\tKEY")
+	for _, info := range files {
+		fmt.Fprintf(w, "%d\t%s\t%s\n", info.Size, info.ModTime.Format(time.RFC3339), info.Key)
+	}
+
+	return w.Flush()
+}
+
+func runStat(ctx context.Context, c *client.Client, args []string, stdin io.Reader, stdout io.Writer) error {
+	if err := checkArgs("stat <key>", args, 1, 1); err != nil {
+		return err
+	}
+
+	info, err := c.Stat(ctx, args[0])
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(stdout, 0, 0, 1, ' ', 0)
+	fmt.Fprintf(w, "Key:\t%s\n", info.Key)
+	fmt.Fprintf(w, "Size:\t%d\n", info.Size)
+	fmt.Fprintf(w, "Modified:\t%s\n", info.ModTime.Format(time.RFC3339))
+	fmt.Fprintf(w, "ETag:\t%s\n", info.ETag)
+
+	return w.Flush()
+}
+
+func runCluster(ctx context.Context, c *client.Client, args []string, stdin io.Reader, stdout io.Writer) error {
+	if len(args) != 1 || args[0] != "status" {
+		return fmt.Errorf("usage: gofs cluster status")
+	}
+
+	status, err := c.ClusterStatus(ctx)
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "\tID\tADDRESS\tVERSION\tFEATURES")
+	printNode := func(role string, node client.NodeStatus) {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%d\t%s\n", role, node.ID, node.Address, node.Version, strings.Join(node.Features, ","))
+	}
+	printNode("node", status.Node)
+	for _, peer := range status.Peers {
+		printNode("peer", peer)
+	}
+
+	return w.Flush()
+}
+
+// checkArgs checks that the command got between minArgs and maxArgs arguments
+func checkArgs(usage string, args []string, minArgs, maxArgs int) error {
+	if len(args) < minArgs || len(args) > maxArgs {
+		return fmt.Errorf("usage: gofs %s", usage)
+	}
+	return nil
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCLI(t *testing.T) {
+	servers := newTestCluster(t, 3, FileServerOpts{}, nil)
+	var nodes []string
+	for _, s := range servers[:2] {
+		srv := httptest.NewServer(NewGateway(s))
+		defer srv.Close()
+		nodes = append(nodes, srv.URL)
+	}
+
+	data := "my big data file here!"
+	var out bytes.Buffer
+	cli := func(stdin string, cmd string, args ...string) (string, error) {
+		out.Reset()
+		args = append([]string{"-node", strings.Join(nodes, ",")}, args...)
+		err := runClient(context.Background(), cmd, args, strings.NewReader(stdin), &out)
+		return out.String(), err
+	}
+
+	_, err := cli(data, "put", "docs/a.txt")
+	assert.Nil(t, err)
+
+	got, err := cli("", "get", "docs/a.txt")
+	assert.Nil(t, err)
+	assert.Equal(t, data, got)
+
+	got, err = cli("", "stat", "docs/a.txt")
+	assert.Nil(t, err)
+	assert.Contains(t, got, "Size:     22")
+
+	got, err = cli("", "ls", "docs/")
+	assert.Nil(t, err)
+	assert.Contains(t, got, "docs/a.txt")
+
+	got, err = cli("", "cluster", "status")
+	assert.Nil(t, err)
+	assert.Contains(t, got, servers[0].ID)
+	assert.Equal(t, 2, strings.Count(got, "peer "))
+
+	_, err = cli("", "rm", "docs/a.txt")
+	assert.Nil(t, err)
+	_, err = cli("", "get", "docs/a.txt")
+	assert.NotNil(t, err)
+
+	// Flags can follow the arguments
+	out.Reset()
+	err = runClient(context.Background(), "cluster", []string{"status", "-node", nodes[1]}, nil, &out)
+	assert.Nil(t, err)
+	assert.Contains(t, out.String(), servers[1].ID)
+
+	_, err = cli("", "stat")
+	assert.NotNil(t, err)
+	_, err = cli("", "foo")
+	assert.NotNil(t, err)
+}
+
+func TestParseFlags(t *testing.T) {
+	flags := flag.NewFlagSet("test", flag.ContinueOnError)
+	node := flags.String("node", "", "")
+
+	args := parseFlags(flags, []string{"a", "-node", "x", "b", "--", "-c", "-node"})
+	assert.Equal(t, []string{"a", "b", "-c", "-node"}, args)
+	assert.Equal(t, "x", *node)
+}
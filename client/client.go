@@ -0,0 +1,362 @@
+// Package client talks to the HTTP gateway of the gofs nodes, so a program can store
+// and fetch files without running a node itself.
+//
+// Every node owns the files stored through it, so the client sees the nodes as a
+// single namespace: Store goes to the first node that answers, while Get, Stat and
+// Delete look for the key on every node and List merges the files of all of them.
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Errors matching the ones returned by the nodes
+var (
+	ErrNotFound      = errors.New("file not found")
+	ErrForbidden     = errors.New("forbidden")
+	ErrQuotaExceeded = errors.New("quota exceeded")
+	ErrNoNodes       = errors.New("no nodes configured")
+)
+
+const (
+	defaultRetries = 3
+	defaultBackoff = 100 * time.Millisecond
+)
+
+type ClientOpts struct {
+	// Nodes are the base URLs of the HTTP gateways of the nodes, like http://localhost:3080
+	Nodes      []string
+	HTTPClient *http.Client
+	// Retries is how many times a request is sent to a node before failing over to
+	// the next one, 3 when zero
+	Retries int
+	// Backoff is the wait before the first retry, doubled after each retry of the
+	// same node. 100ms when zero
+	Backoff time.Duration
+}
+
+type Client struct {
+	ClientOpts
+
+	mu        sync.Mutex
+	preferred int // index of the last node that answered
+}
+
+// FileInfo describes a file stored in a node
+type FileInfo struct {
+	Key     string
+	Size    int64
+	ModTime time.Time
+	// ETag is the quoted hex encoded SHA-256 of the content
+	ETag string
+}
+
+// NodeStatus describes a node of the cluster
+type NodeStatus struct {
+	ID       string
+	Address  string
+	Version  int
+	Features []string
+}
+
+// ClusterStatus is the view of the cluster of a node: the node itself and the peers
+// it's connected to
+type ClusterStatus struct {
+	Node  NodeStatus
+	Peers []NodeStatus
+}
+
+func NewClient(opts ClientOpts) *Client {
+	if opts.HTTPClient == nil {
+		opts.HTTPClient = http.DefaultClient
+	}
+	if opts.Retries <= 0 {
+		opts.Retries = defaultRetries
+	}
+	if opts.Backoff <= 0 {
+		opts.Backoff = defaultBackoff
+	}
+	nodes := make([]string, len(opts.Nodes))
+	for i, node := range opts.Nodes {
+		nodes[i] = strings.TrimSuffix(node, "/")
+	}
+	opts.Nodes = nodes
+
+	return &Client{ClientOpts: opts}
+}
+
+// Store uploads the content of the reader under the key. Readers that can't seek back
+// to their start are read into memory first, so the content can be sent again on a retry
+func (c *Client) Store(ctx context.Context, key string, r io.Reader) error {
+	body, ok := r.(io.ReadSeeker)
+	if ok {
+		offset, err := body.Seek(0, io.SeekCurrent)
+		ok = err == nil && offset == 0
+	}
+	if !ok {
+		b, err := io.ReadAll(r)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(b)
+	}
+
+	resp, err := c.do(ctx, http.MethodPut, filePath(key), body, false)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	return nil
+}
+
+// Get returns the content of the file, which must be closed by the caller
+func (c *Client) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	resp, err := c.do(ctx, http.MethodGet, filePath(key), nil, true)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+func (c *Client) Stat(ctx context.Context, key string) (FileInfo, error) {
+	resp, err := c.do(ctx, http.MethodHead, filePath(key), nil, true)
+	if err != nil {
+		return FileInfo{}, err
+	}
+	resp.Body.Close()
+
+	modTime, _ := http.ParseTime(resp.Header.Get("Last-Modified"))
+	return FileInfo{
+		Key:     key,
+		Size:    resp.ContentLength,
+		ModTime: modTime,
+		ETag:    resp.Header.Get("ETag"),
+	}, nil
+}
+
+func (c *Client) Delete(ctx context.Context, key string) error {
+	resp, err := c.do(ctx, http.MethodDelete, filePath(key), nil, true)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	return nil
+}
+
+// List returns the files whose key starts with the prefix, sorted by key. The nodes
+// that can't be reached are skipped, unless none of them can
+func (c *Client) List(ctx context.Context, prefix string) ([]FileInfo, error) {
+	if len(c.Nodes) == 0 {
+		return nil, ErrNoNodes
+	}
+
+	var (
+		files   = make(map[string]FileInfo)
+		lastErr error
+		ok      bool
+	)
+	for _, node := range c.Nodes {
+		resp, err := c.send(ctx, node, http.MethodGet, "/files?prefix="+url.QueryEscape(prefix), nil)
+		if err == nil {
+			err = statusError(resp)
+		}
+		if err != nil {
+			lastErr = err
+			continue
+		}
+
+		var nodeFiles []FileInfo
+		err = json.NewDecoder(resp.Body).Decode(&nodeFiles)
+		resp.Body.Close()
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		ok = true
+		for _, info := range nodeFiles {
+			if _, found := files[info.Key]; !found {
+				files[info.Key] = info
+			}
+		}
+	}
+	if !ok {
+		return nil, lastErr
+	}
+
+	list := make([]FileInfo, 0, len(files))
+	for _, info := range files {
+		list = append(list, info)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Key < list[j].Key
+	})
+
+	return list, nil
+}
+
+// ClusterStatus returns the status of the cluster as seen by the first node that answers
+func (c *Client) ClusterStatus(ctx context.Context) (ClusterStatus, error) {
+	resp, err := c.do(ctx, http.MethodGet, "/cluster/status", nil, false)
+	if err != nil {
+		return ClusterStatus{}, err
+	}
+	defer resp.Body.Close()
+
+	var status ClusterStatus
+	err = json.NewDecoder(resp.Body).Decode(&status)
+
+	return status, err
+}
+
+// do sends the request to the nodes, starting with the last one that answered, and
+// fails over to the next node when a node can't be reached. When everywhere is set,
+// a node answering that the file doesn't exist is skipped as well, since the file
+// may belong to another node
+func (c *Client) do(ctx context.Context, method, path string, body io.ReadSeeker, everywhere bool) (*http.Response, error) {
+	if len(c.Nodes) == 0 {
+		return nil, ErrNoNodes
+	}
+
+	c.mu.Lock()
+	start := c.preferred
+	c.mu.Unlock()
+
+	var (
+		lastErr  error
+		notFound bool
+	)
+	for i := range c.Nodes {
+		n := (start + i) % len(c.Nodes)
+		resp, err := c.send(ctx, c.Nodes[n], method, path, body)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			lastErr = err
+			continue
+		}
+
+		if err := statusError(resp); err != nil {
+			if everywhere && errors.Is(err, ErrNotFound) {
+				notFound = true
+				continue
+			}
+			return nil, err
+		}
+
+		c.mu.Lock()
+		c.preferred = n
+		c.mu.Unlock()
+		return resp, nil
+	}
+	if notFound && lastErr == nil {
+		return nil, ErrNotFound
+	}
+
+	return nil, fmt.Errorf("no node could handle %s %s: %w", method, path, lastErr)
+}
+
+// send sends the request to the node, retrying with an exponential backoff while the
+// node can't be reached or answers with a temporary failure
+func (c *Client) send(ctx context.Context, node, method, path string, body io.ReadSeeker) (*http.Response, error) {
+	var size int64
+	if body != nil {
+		var err error
+		if size, err = body.Seek(0, io.SeekEnd); err != nil {
+			return nil, err
+		}
+	}
+
+	var (
+		backoff = c.Backoff
+		lastErr error
+	)
+	for attempt := 0; attempt < c.Retries; attempt++ {
+		if attempt > 0 {
+			select {
+			case <-time.After(backoff):
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			}
+			backoff *= 2
+		}
+
+		req, err := http.NewRequestWithContext(ctx, method, node+path, nil)
+		if err != nil {
+			return nil, err
+		}
+		if body != nil {
+			if _, err := body.Seek(0, io.SeekStart); err != nil {
+				return nil, err
+			}
+			req.Body = io.NopCloser(body)
+			req.ContentLength = size
+		}
+
+		resp, err := c.HTTPClient.Do(req)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		if temporary(resp.StatusCode) {
+			resp.Body.Close()
+			lastErr = fmt.Errorf("node %s answered %s", node, resp.Status)
+			continue
+		}
+		return resp, nil
+	}
+
+	return nil, lastErr
+}
+
+// temporary reports if the request may succeed when sent again
+func temporary(status int) bool {
+	switch status {
+	case http.StatusTooManyRequests, http.StatusInternalServerError, http.StatusBadGateway,
+		http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// statusError returns the error matching the status of the response, closing the
+// response on failure
+func statusError(resp *http.Response) error {
+	if resp.StatusCode < http.StatusBadRequest {
+		return nil
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusNotFound:
+		return ErrNotFound
+	case http.StatusForbidden:
+		return ErrForbidden
+	case http.StatusInsufficientStorage:
+		return ErrQuotaExceeded
+	}
+	b, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+	return fmt.Errorf("unexpected status %s: %s", resp.Status, strings.TrimSpace(string(b)))
+}
+
+// filePath returns the path of the file in the gateway, escaping each part of the key
+func filePath(key string) string {
+	parts := strings.Split(key, "/")
+	for i, part := range parts {
+		parts[i] = url.PathEscape(part)
+	}
+	return "/files/" + strings.Join(parts, "/")
+}
@@ -0,0 +1,158 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeNode is a gateway keeping the files in memory, failing the first requests with
+// a 503 when failures is set
+type fakeNode struct {
+	mu       sync.Mutex
+	files    map[string][]byte
+	failures int
+	requests int
+}
+
+func (n *fakeNode) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	n.requests++
+	if n.failures > 0 {
+		n.failures--
+		http.Error(w, "busy", http.StatusServiceUnavailable)
+		return
+	}
+
+	if r.URL.Path == "/files" {
+		files := []FileInfo{}
+		for key, data := range n.files {
+			if strings.HasPrefix(key, r.URL.Query().Get("prefix")) {
+				files = append(files, FileInfo{Key: key, Size: int64(len(data))})
+			}
+		}
+		json.NewEncoder(w).Encode(files)
+		return
+	}
+
+	key := strings.TrimPrefix(r.URL.Path, "/files/")
+	switch r.Method {
+	case http.MethodPut:
+		b, _ := io.ReadAll(r.Body)
+		n.files[key] = b
+		w.WriteHeader(http.StatusCreated)
+	case http.MethodGet, http.MethodHead:
+		data, ok := n.files[key]
+		if !ok {
+			http.Error(w, "not found", http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+		w.Header().Set("ETag", `"tag"`)
+		w.Header().Set("Last-Modified", time.Unix(0, 0).UTC().Format(http.TimeFormat))
+		w.Write(data)
+	case http.MethodDelete:
+		if _, ok := n.files[key]; !ok {
+			http.Error(w, "not found", http.StatusNotFound)
+			return
+		}
+		delete(n.files, key)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func newFakeNode(t *testing.T, files map[string][]byte) (*fakeNode, string) {
+	if files == nil {
+		files = make(map[string][]byte)
+	}
+	node := &fakeNode{files: files}
+	srv := httptest.NewServer(node)
+	t.Cleanup(srv.Close)
+
+	return node, srv.URL
+}
+
+func TestClient(t *testing.T) {
+	var (
+		ctx          = context.Background()
+		_, addrA     = newFakeNode(t, map[string][]byte{"a/1": []byte("one")})
+		nodeB, addrB = newFakeNode(t, map[string][]byte{"a/2": []byte("two"), "b/3": []byte("three")})
+		c            = NewClient(ClientOpts{Nodes: []string{addrA, addrB + "/"}, Backoff: time.Millisecond})
+	)
+
+	// The file is only on the second node
+	r, err := c.Get(ctx, "a/2")
+	assert.Nil(t, err)
+	b, err := io.ReadAll(r)
+	r.Close()
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("two"), b)
+
+	info, err := c.Stat(ctx, "b/3")
+	assert.Nil(t, err)
+	assert.Equal(t, int64(5), info.Size)
+	assert.Equal(t, `"tag"`, info.ETag)
+	assert.True(t, info.ModTime.Equal(time.Unix(0, 0)))
+
+	_, err = c.Get(ctx, "missing")
+	assert.True(t, errors.Is(err, ErrNotFound))
+
+	files, err := c.List(ctx, "a/")
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(files))
+	assert.Equal(t, "a/1", files[0].Key)
+	assert.Equal(t, "a/2", files[1].Key)
+
+	// The second node answered last, so the file is stored there, after it recovers
+	nodeB.failures = 2
+	assert.Nil(t, c.Store(ctx, "c/4", strings.NewReader("four")))
+	assert.Equal(t, []byte("four"), nodeB.files["c/4"])
+
+	assert.Nil(t, c.Delete(ctx, "c/4"))
+	assert.True(t, errors.Is(c.Delete(ctx, "c/4"), ErrNotFound))
+}
+
+func TestClientFailover(t *testing.T) {
+	var (
+		ctx        = context.Background()
+		down       = httptest.NewServer(http.NotFoundHandler())
+		node, addr = newFakeNode(t, nil)
+	)
+	down.Close()
+
+	c := NewClient(ClientOpts{Nodes: []string{down.URL, addr}, Retries: 2, Backoff: time.Millisecond})
+
+	// The body is sent again from its start when failing over
+	data := bytes.Repeat([]byte("data"), 1000)
+	assert.Nil(t, c.Store(ctx, "foo", bytes.NewReader(data)))
+	assert.Equal(t, data, node.files["foo"])
+
+	// A node failing every retry is skipped as well
+	busy, busyAddr := newFakeNode(t, nil)
+	busy.failures = 10
+	c = NewClient(ClientOpts{Nodes: []string{busyAddr, addr}, Retries: 2, Backoff: time.Millisecond})
+	info, err := c.Stat(ctx, "foo")
+	assert.Nil(t, err)
+	assert.Equal(t, int64(len(data)), info.Size)
+	assert.Equal(t, 2, busy.requests)
+
+	c = NewClient(ClientOpts{Nodes: []string{down.URL}, Retries: 1})
+	_, err = c.List(ctx, "")
+	assert.NotNil(t, err)
+
+	_, err = NewClient(ClientOpts{}).Get(ctx, "foo")
+	assert.Equal(t, ErrNoNodes, err)
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/marcosvdn7/go-filestorage/p2p"
+)
+
+// clusterFile is the file in the storage root holding the node ID and its known peers
+const clusterFile = "cluster.json"
+
+// knownPeerTTL is how long a peer is kept in the cluster state after it was last seen,
+// so a node gone for good is neither dialed forever nor kept in the state
+const knownPeerTTL = 24 * time.Hour
+
+// KnownPeer is a node the local node has been connected to
+type KnownPeer struct {
+	ID string
+	// Address is where the node can be dialed
+	Address  string
+	Version  int
+	Features []string
+	// Outbound tells if the local node dialed the connection. Only those peers are
+	// dialed again on start, the others dial the local node themselves
+	Outbound bool
+	LastSeen time.Time
+}
+
+// ClusterState is the view of the cluster saved in the storage root, so a restarted
+// node can check that the root is its own and reconnect to its peers
+type ClusterState struct {
+	path string
+
+	mu    sync.Mutex
+	state clusterState
+}
+
+// clusterState is the content of the cluster file
+type clusterState struct {
+	NodeID    string
+	CreatedAt time.Time
+	Peers     []KnownPeer
+}
+
+// OpenClusterState loads the state saved in the file, creating it when it doesn't
+// exist yet. An error is returned when the file belongs to another node, since the
+// files of the node would not be found under its ID
+func OpenClusterState(path, nodeID string) (*ClusterState, error) {
+	c := &ClusterState{path: path}
+
+	b, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		c.state = clusterState{
+			NodeID:    nodeID,
+			CreatedAt: time.Now().UTC(),
+		}
+		return c, c.save()
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(b, &c.state); err != nil {
+		return nil, err
+	}
+	if c.state.NodeID != nodeID {
+		return nil, fmt.Errorf("%s belongs to node %s, not to node %s", path, c.state.NodeID, nodeID)
+	}
+
+	return c, nil
+}
+
+func (c *ClusterState) CreatedAt() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.state.CreatedAt
+}
+
+// Peers returns the known peers sorted by ID
+func (c *ClusterState) Peers() []KnownPeer {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return append([]KnownPeer(nil), c.state.Peers...)
+}
+
+// Peer returns the known peer with the ID
+func (c *ClusterState) Peer(id string) (KnownPeer, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	i, ok := c.find(id)
+	if !ok {
+		return KnownPeer{}, false
+	}
+	return c.state.Peers[i], true
+}
+
+// PutPeer adds the peer to the known peers, replacing the previous info of its ID
+func (c *ClusterState) PutPeer(peer KnownPeer) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	i, ok := c.find(peer.ID)
+	if ok {
+		c.state.Peers[i] = peer
+	} else {
+		c.state.Peers = slices.Insert(c.state.Peers, i, peer)
+	}
+
+	return c.save()
+}
+
+// RemovePeer removes the peer with the ID from the known peers
+func (c *ClusterState) RemovePeer(id string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	i, ok := c.find(id)
+	if !ok {
+		return nil
+	}
+	c.state.Peers = slices.Delete(c.state.Peers, i, i+1)
+
+	return c.save()
+}
+
+// ExpirePeers removes the peers last seen before the time, returning them
+func (c *ClusterState) ExpirePeers(before time.Time) ([]KnownPeer, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var expired []KnownPeer
+	c.state.Peers = slices.DeleteFunc(c.state.Peers, func(peer KnownPeer) bool {
+		if peer.LastSeen.Before(before) {
+			expired = append(expired, peer)
+			return true
+		}
+		return false
+	})
+	if len(expired) == 0 {
+		return nil, nil
+	}
+
+	return expired, c.save()
+}
+
+// find returns the position of the peer with the ID in the sorted peers, or where it
+// would be inserted
+func (c *ClusterState) find(id string) (int, bool) {
+	i := sort.Search(len(c.state.Peers), func(i int) bool {
+		return c.state.Peers[i].ID >= id
+	})
+	return i, i < len(c.state.Peers) && c.state.Peers[i].ID == id
+}
+
+// save writes the state to a temporary file which is then moved over the cluster
+// file, the same way as the file index
+func (c *ClusterState) save() error {
+	b, err := json.MarshalIndent(c.state, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(c.path), os.ModePerm); err != nil {
+		return err
+	}
+	tmp := c.path + ".tmp"
+	if err := os.WriteFile(tmp, b, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, c.path)
+}
+
+// newKnownPeer returns the info of the connected peer to save in the cluster state
+func newKnownPeer(p p2p.Peer) KnownPeer {
+	info := p.Info()
+	return KnownPeer{
+		ID:       info.ID,
+		Address:  peerAddress(p),
+		Version:  info.Version,
+		Features: info.Features,
+		Outbound: p.Outbound(),
+		LastSeen: time.Now().UTC(),
+	}
+}
+
+// peerAddress returns the address the peer can be dialed at. The address of an
+// inbound connection is an ephemeral port, so the listen address announced by the
+// peer is used instead, with the host of the connection when it's not set
+func peerAddress(p p2p.Peer) string {
+	remote := p.RemoteAddr().String()
+	if p.Outbound() {
+		return remote
+	}
+
+	listen := p.Info().ListenAddress
+	host, port, err := net.SplitHostPort(listen)
+	if err != nil {
+		if listen == "" {
+			return remote
+		}
+		return listen
+	}
+	if ip := net.ParseIP(host); host == "" || ip != nil && ip.IsUnspecified() {
+		if remoteHost, _, err := net.SplitHostPort(remote); err == nil {
+			return net.JoinHostPort(remoteHost, port)
+		}
+	}
+
+	return listen
+}
+
+// sameAddress reports if both addresses lead to the same node, like :3000 and
+// 127.0.0.1:3000. Addresses that are not TCP addresses must be equal
+func sameAddress(a, b string) bool {
+	if a == b {
+		return true
+	}
+	addrA, errA := net.ResolveTCPAddr("tcp", a)
+	addrB, errB := net.ResolveTCPAddr("tcp", b)
+	if errA != nil || errB != nil || addrA.Port != addrB.Port {
+		return false
+	}
+
+	return addrA.IP.Equal(addrB.IP) || isLocal(addrA.IP) && isLocal(addrB.IP)
+}
+
+// isLocal reports if the IP is the local host, which an empty host stands for
+func isLocal(ip net.IP) bool {
+	return ip == nil || ip.IsLoopback() || ip.IsUnspecified()
+}
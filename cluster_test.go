@@ -0,0 +1,78 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestClusterState(t *testing.T) {
+	path := filepath.Join(t.TempDir(), clusterFile)
+	c, err := OpenClusterState(path, "node-a")
+	assert.Nil(t, err)
+
+	for _, id := range []string{"c", "b", "c"} {
+		assert.Nil(t, c.PutPeer(KnownPeer{ID: id, Address: id + ":3000", Outbound: true}))
+	}
+
+	// The state survives a restart
+	created := c.CreatedAt()
+	c, err = OpenClusterState(path, "node-a")
+	assert.Nil(t, err)
+	assert.True(t, created.Equal(c.CreatedAt()))
+	peers := c.Peers()
+	assert.Len(t, peers, 2)
+	assert.Equal(t, "b", peers[0].ID)
+	assert.Equal(t, "c:3000", peers[1].Address)
+
+	_, err = OpenClusterState(path, "node-b")
+	assert.ErrorContains(t, err, "belongs to node node-a")
+}
+
+func TestClusterStateExpirePeers(t *testing.T) {
+	path := filepath.Join(t.TempDir(), clusterFile)
+	c, err := OpenClusterState(path, "node-a")
+	assert.Nil(t, err)
+
+	now := time.Now()
+	for i, id := range []string{"b", "c", "d"} {
+		lastSeen := now.Add(-time.Duration(i) * time.Hour)
+		assert.Nil(t, c.PutPeer(KnownPeer{ID: id, LastSeen: lastSeen}))
+	}
+
+	expired, err := c.ExpirePeers(now.Add(-90 * time.Minute))
+	assert.Nil(t, err)
+	assert.Len(t, expired, 1)
+	assert.Equal(t, "d", expired[0].ID)
+	assert.Nil(t, c.RemovePeer("b"))
+	assert.Nil(t, c.RemovePeer("unknown"))
+
+	// The removals are saved
+	c, err = OpenClusterState(path, "node-a")
+	assert.Nil(t, err)
+	peers := c.Peers()
+	assert.Len(t, peers, 1)
+	assert.Equal(t, "c", peers[0].ID)
+	_, ok := c.Peer("b")
+	assert.False(t, ok)
+}
+
+func TestSameAddress(t *testing.T) {
+	tests := []struct {
+		a, b string
+		same bool
+	}{
+		{":3000", ":3000", true},
+		{":3000", "127.0.0.1:3000", true},
+		{"0.0.0.0:3000", "[::1]:3000", true},
+		{":3000", ":4000", false},
+		{"10.0.0.1:3000", "127.0.0.1:3000", false},
+		{"node-0", "node-0", true},
+		{"node-0", "node-1", false},
+	}
+	for _, test := range tests {
+		assert.Equal(t, test.same, sameAddress(test.a, test.b), "%s %s", test.a, test.b)
+	}
+}
@@ -0,0 +1,348 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+
+	"github.com/marcosvdn7/go-filestorage/p2p"
+)
+
+// Codec encodes the messages exchanged by the nodes. The value is either a *Message,
+// a *SignedMessage or a *Response
+type Codec interface {
+	Name() string
+	Marshal(v any) ([]byte, error)
+	Unmarshal(data []byte, v any) error
+}
+
+// codecs holds the available codecs, from the most to the least preferred. The codec
+// used with a peer is the first one both nodes announced in the handshake
+var codecs = []Codec{BinaryCodec{}, JSONCodec{}, GOBCodec{}}
+
+// messageTypes are the payloads a Message can carry. Their position identifies them
+// in the binary codec, so new types must be appended
+var messageTypes = []any{
+	MessageStoreFile{},
+	MessageGetFile{},
+	MessageGetOffset{},
+	MessageHasChunks{},
+	MessageStoreShard{},
+	MessageGetShards{},
+	MessageDeleteFile{},
+	MessageGetRange{},
+	MessageLeave{},
+}
+
+// ErrUnknownMessage is returned when decoding a message of a type not in messageTypes
+var ErrUnknownMessage = errors.New("unknown message type")
+
+// codecByName returns the codec with the given name
+func codecByName(name string) (Codec, error) {
+	for _, c := range codecs {
+		if c.Name() == name {
+			return c, nil
+		}
+	}
+	return nil, fmt.Errorf("unknown codec %q", name)
+}
+
+// codecFeature is the handshake feature announcing the codec
+func codecFeature(name string) string {
+	return "codec/" + name
+}
+
+// codecFor returns the codec negotiated with the peer. Peers that didn't announce any
+// codec, like the ones connected without handshake, talk gob
+func codecFor(peer p2p.Peer) Codec {
+	for _, c := range codecs {
+		if peer.Info().HasFeature(codecFeature(c.Name())) {
+			return c
+		}
+	}
+	return GOBCodec{}
+}
+
+func messageTypeID(payload any) (int, error) {
+	for i, t := range messageTypes {
+		if reflect.TypeOf(t) == reflect.TypeOf(payload) {
+			return i + 1, nil
+		}
+	}
+	return 0, fmt.Errorf("%w: %T", ErrUnknownMessage, payload)
+}
+
+// GOBCodec encodes the messages with encoding/gob, which is only available in Go
+type GOBCodec struct{}
+
+func (GOBCodec) Name() string {
+	return "gob"
+}
+
+func (GOBCodec) Marshal(v any) ([]byte, error) {
+	buf := new(bytes.Buffer)
+	if err := gob.NewEncoder(buf).Encode(v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (GOBCodec) Unmarshal(data []byte, v any) error {
+	return gob.NewDecoder(bytes.NewReader(data)).Decode(v)
+}
+
+// JSONCodec encodes the messages as JSON. The payload of a Message goes along with the
+// name of its type: {"Type": "MessageGetFile", "Payload": {...}}
+type JSONCodec struct{}
+
+type jsonMessage struct {
+	Type    string
+	Payload json.RawMessage
+}
+
+func (JSONCodec) Name() string {
+	return "json"
+}
+
+func (JSONCodec) Marshal(v any) ([]byte, error) {
+	msg, ok := v.(*Message)
+	if !ok {
+		return json.Marshal(v)
+	}
+
+	if _, err := messageTypeID(msg.Payload); err != nil {
+		return nil, err
+	}
+	payload, err := json.Marshal(msg.Payload)
+	if err != nil {
+		return nil, err
+	}
+
+	return json.Marshal(jsonMessage{
+		Type:    reflect.TypeOf(msg.Payload).Name(),
+		Payload: payload,
+	})
+}
+
+func (JSONCodec) Unmarshal(data []byte, v any) error {
+	msg, ok := v.(*Message)
+	if !ok {
+		return json.Unmarshal(data, v)
+	}
+
+	var jm jsonMessage
+	if err := json.Unmarshal(data, &jm); err != nil {
+		return err
+	}
+	for _, t := range messageTypes {
+		if reflect.TypeOf(t).Name() == jm.Type {
+			payload := reflect.New(reflect.TypeOf(t))
+			if err := json.Unmarshal(jm.Payload, payload.Interface()); err != nil {
+				return err
+			}
+			msg.Payload = payload.Elem().Interface()
+			return nil
+		}
+	}
+
+	return fmt.Errorf("%w: %s", ErrUnknownMessage, jm.Type)
+}
+
+// BinaryCodec is a compact encoding compatible with the protobuf wire format, so other
+// languages can decode the messages with the protobuf runtime. The fields of a message
+// are numbered from 1 in the order they are declared, nested structs being encoded as
+// embedded messages. A Message is encoded as:
+//
+//	message Message {
+//	  uint32 type = 1;   // position of the payload type in messageTypes, from 1
+//	  bytes payload = 2; // the encoded payload
+//	}
+type BinaryCodec struct{}
+
+func (BinaryCodec) Name() string {
+	return "binary"
+}
+
+// Protobuf wire types
+const (
+	wireVarint = 0
+	wireBytes  = 2
+)
+
+func (BinaryCodec) Marshal(v any) ([]byte, error) {
+	msg, ok := v.(*Message)
+	if !ok {
+		return marshalFields(reflect.Indirect(reflect.ValueOf(v)))
+	}
+
+	id, err := messageTypeID(msg.Payload)
+	if err != nil {
+		return nil, err
+	}
+	payload, err := marshalFields(reflect.ValueOf(msg.Payload))
+	if err != nil {
+		return nil, err
+	}
+
+	b := appendVarintField(nil, 1, uint64(id))
+	return appendBytesField(b, 2, payload), nil
+}
+
+func (BinaryCodec) Unmarshal(data []byte, v any) error {
+	msg, ok := v.(*Message)
+	if !ok {
+		return unmarshalFields(data, reflect.ValueOf(v).Elem())
+	}
+
+	var envelope struct {
+		Type    int
+		Payload []byte
+	}
+	if err := unmarshalFields(data, reflect.ValueOf(&envelope).Elem()); err != nil {
+		return err
+	}
+	if envelope.Type < 1 || envelope.Type > len(messageTypes) {
+		return fmt.Errorf("%w: %d", ErrUnknownMessage, envelope.Type)
+	}
+
+	payload := reflect.New(reflect.TypeOf(messageTypes[envelope.Type-1])).Elem()
+	if err := unmarshalFields(envelope.Payload, payload); err != nil {
+		return err
+	}
+	msg.Payload = payload.Interface()
+
+	return nil
+}
+
+// marshalFields encodes the fields of the struct. As in protobuf, the fields holding
+// the zero value are left out
+func marshalFields(v reflect.Value) ([]byte, error) {
+	var b []byte
+	for i := 0; i < v.NumField(); i++ {
+		var (
+			num   = i + 1
+			field = v.Field(i)
+		)
+		switch {
+		case field.Kind() == reflect.String:
+			if field.Len() > 0 {
+				b = appendBytesField(b, num, []byte(field.String()))
+			}
+		case field.CanInt():
+			if field.Int() != 0 {
+				b = appendVarintField(b, num, uint64(field.Int()))
+			}
+		case field.Kind() == reflect.Bool:
+			if field.Bool() {
+				b = appendVarintField(b, num, 1)
+			}
+		case field.Kind() == reflect.Slice && field.Type().Elem().Kind() == reflect.Uint8:
+			if field.Len() > 0 {
+				b = appendBytesField(b, num, field.Bytes())
+			}
+		case field.Kind() == reflect.Slice && field.Type().Elem().Kind() == reflect.String:
+			for j := 0; j < field.Len(); j++ {
+				b = appendBytesField(b, num, []byte(field.Index(j).String()))
+			}
+		case field.Kind() == reflect.Struct:
+			nested, err := marshalFields(field)
+			if err != nil {
+				return nil, err
+			}
+			b = appendBytesField(b, num, nested)
+		case field.Kind() == reflect.Slice && field.Type().Elem().Kind() == reflect.Struct:
+			for j := 0; j < field.Len(); j++ {
+				nested, err := marshalFields(field.Index(j))
+				if err != nil {
+					return nil, err
+				}
+				b = appendBytesField(b, num, nested)
+			}
+		default:
+			return nil, fmt.Errorf("binary codec can't encode field %s of type %s", v.Type().Field(i).Name, field.Type())
+		}
+	}
+
+	return b, nil
+}
+
+// unmarshalFields decodes the fields into the struct. Unknown fields are skipped, so
+// newer nodes can add fields to the messages
+func unmarshalFields(data []byte, v reflect.Value) error {
+	for len(data) > 0 {
+		key, n := binary.Uvarint(data)
+		if n <= 0 {
+			return errors.New("binary codec: malformed field key")
+		}
+		data = data[n:]
+
+		var (
+			num      = int(key >> 3)
+			wireType = key & 0x7
+			value    uint64
+			bytesVal []byte
+		)
+		switch wireType {
+		case wireVarint:
+			if value, n = binary.Uvarint(data); n <= 0 {
+				return errors.New("binary codec: malformed varint")
+			}
+			data = data[n:]
+		case wireBytes:
+			size, n := binary.Uvarint(data)
+			if n <= 0 || uint64(len(data)-n) < size {
+				return errors.New("binary codec: malformed length")
+			}
+			bytesVal = data[n : n+int(size)]
+			data = data[n+int(size):]
+		default:
+			return fmt.Errorf("binary codec: unsupported wire type %d", wireType)
+		}
+
+		if num < 1 || num > v.NumField() {
+			continue
+		}
+		field := v.Field(num - 1)
+		switch {
+		case field.Kind() == reflect.String && wireType == wireBytes:
+			field.SetString(string(bytesVal))
+		case field.CanInt() && wireType == wireVarint:
+			field.SetInt(int64(value))
+		case field.Kind() == reflect.Bool && wireType == wireVarint:
+			field.SetBool(value != 0)
+		case field.Kind() == reflect.Slice && field.Type().Elem().Kind() == reflect.Uint8 && wireType == wireBytes:
+			field.SetBytes(bytes.Clone(bytesVal))
+		case field.Kind() == reflect.Slice && field.Type().Elem().Kind() == reflect.String && wireType == wireBytes:
+			field.Set(reflect.Append(field, reflect.ValueOf(string(bytesVal))))
+		case field.Kind() == reflect.Struct && wireType == wireBytes:
+			if err := unmarshalFields(bytesVal, field); err != nil {
+				return err
+			}
+		case field.Kind() == reflect.Slice && field.Type().Elem().Kind() == reflect.Struct && wireType == wireBytes:
+			elem := reflect.New(field.Type().Elem()).Elem()
+			if err := unmarshalFields(bytesVal, elem); err != nil {
+				return err
+			}
+			field.Set(reflect.Append(field, elem))
+		default:
+			return fmt.Errorf("binary codec: field %s doesn't match wire type %d", v.Type().Field(num-1).Name, wireType)
+		}
+	}
+
+	return nil
+}
+
+func appendVarintField(b []byte, num int, value uint64) []byte {
+	b = binary.AppendUvarint(b, uint64(num)<<3|wireVarint)
+	return binary.AppendUvarint(b, value)
+}
+
+func appendBytesField(b []byte, num int, value []byte) []byte {
+	b = binary.AppendUvarint(b, uint64(num)<<3|wireBytes)
+	b = binary.AppendUvarint(b, uint64(len(value)))
+	return append(b, value...)
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"encoding/gob"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCodecs(t *testing.T) {
+	for _, mt := range messageTypes {
+		gob.Register(mt)
+	}
+	payloads := []any{
+		MessageStoreFile{ID: "foo", Key: "bar", Size: 1 << 40, Hash: "baz", Offset: 10},
+		MessageGetFile{ID: "foo", Key: "bar"},
+		MessageHasChunks{ID: "foo", Hashes: []string{"a", "", "c"}},
+		MessageStoreShard{ID: "foo", Key: "bar", Index: 2, Size: -1},
+	}
+	for _, c := range codecs {
+		for _, payload := range payloads {
+			b, err := c.Marshal(&Message{Payload: payload})
+			assert.Nil(t, err)
+
+			var msg Message
+			assert.Nil(t, c.Unmarshal(b, &msg), c.Name())
+			assert.Equal(t, payload, msg.Payload, c.Name())
+		}
+
+		signed := &SignedMessage{PublicKey: []byte{1, 2}, Payload: []byte("Foo"), Signature: []byte{3}}
+		b, err := c.Marshal(signed)
+		assert.Nil(t, err)
+		var decoded SignedMessage
+		assert.Nil(t, c.Unmarshal(b, &decoded))
+		assert.Equal(t, *signed, decoded)
+	}
+}
+
+func TestBinaryCodecWireFormat(t *testing.T) {
+	b, err := BinaryCodec{}.Marshal(&Message{Payload: MessageGetFile{ID: "a", Offset: 300}})
+	assert.Nil(t, err)
+
+	// type = 2, payload = {ID: "a", Offset: 300} as protobuf would encode them
+	assert.Equal(t, []byte{0x08, 0x02, 0x12, 0x06, 0x0a, 0x01, 'a', 0x18, 0xac, 0x02}, b)
+
+	var msg Message
+	assert.ErrorIs(t, BinaryCodec{}.Unmarshal([]byte{0x08, 0x63}, &msg), ErrUnknownMessage)
+}
+
+func TestBinaryCodecNested(t *testing.T) {
+	type item struct {
+		Name string
+	}
+	type list struct {
+		First item
+		Items []item
+	}
+
+	in := list{First: item{Name: "a"}, Items: []item{{Name: "b"}, {}}}
+	b, err := BinaryCodec{}.Marshal(&in)
+	assert.Nil(t, err)
+	// Nested structs are embedded messages, repeated ones once per element
+	assert.Equal(t, []byte{0x0a, 0x03, 0x0a, 0x01, 'a', 0x12, 0x03, 0x0a, 0x01, 'b', 0x12, 0x00}, b)
+
+	var out list
+	assert.Nil(t, BinaryCodec{}.Unmarshal(b, &out))
+	assert.Equal(t, in, out)
+}
+
+func TestJSONCodecFormat(t *testing.T) {
+	b, err := JSONCodec{}.Marshal(&Message{Payload: MessageGetOffset{ID: "a", Key: "b", Hash: "c"}})
+	assert.Nil(t, err)
+	assert.JSONEq(t, `{"Type": "MessageGetOffset", "Payload": {"ID": "a", "Key": "b", "Hash": "c"}}`, string(b))
+}
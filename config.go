@@ -0,0 +1,297 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// envPrefix is the prefix of the environment variables overriding the config
+const envPrefix = "GOFS"
+
+// Config describes a node. It's read from a JSON file, and every field can be
+// overridden by an environment variable named after its path in the file, like
+// GOFS_REPLICATION_MODE for the mode of the replication. Lists are comma separated
+type Config struct {
+	// ID is the expected ID of the node. The ID is derived from the identity key, so
+	// it only guards against starting the node with the key of another node
+	ID string `json:"id"`
+	// IdentityFile holds the private key of the node, <storage_root>/node.key when empty
+	IdentityFile  string `json:"identity_file"`
+	ListenAddress string `json:"listen_address"`
+	// StorageRoot is the folder of the files, <port>_network when empty
+	StorageRoot string `json:"storage_root"`
+	// PathTransformer is how the files are laid out in the storage root: "cas" to
+	// spread them in folders named after the hash of their key, "default" to use
+	// the key as the path
+	PathTransformer string            `json:"path_transformer"`
+	BootstrapNodes  []string          `json:"bootstrap_nodes"`
+	Replication     ReplicationConfig `json:"replication"`
+	Security        SecurityConfig    `json:"security"`
+	// Codecs are the names of the codecs offered to the peers, all of them when empty
+	Codecs []string `json:"codecs"`
+	// Quota limits how many bytes each node can store on this one, no limit when zero
+	Quota int64 `json:"quota"`
+	// The addresses of the HTTP gateway, the S3 compatible API, the gRPC API and the
+	// Prometheus metrics, served at /metrics. Each one is disabled when empty
+	HTTPAddress    string `json:"http_address"`
+	S3Address      string `json:"s3_address"`
+	GRPCAddress    string `json:"grpc_address"`
+	MetricsAddress string `json:"metrics_address"`
+}
+
+type ReplicationConfig struct {
+	// Mode is how the files are sent to the peers: "full" replicates the whole file,
+	// "erasure" sends Reed-Solomon shards, "chunked" splits the file into chunks of
+	// chunk_size bytes and "cdc" into content defined chunks
+	Mode         string `json:"mode"`
+	DataShards   int    `json:"data_shards"`
+	ParityShards int    `json:"parity_shards"`
+	ChunkSize    int64  `json:"chunk_size"`
+	// The sizes of the content defined chunks, the DefaultCDCOpts ones when zero
+	MinChunkSize int `json:"min_chunk_size"`
+	AvgChunkSize int `json:"avg_chunk_size"`
+	MaxChunkSize int `json:"max_chunk_size"`
+}
+
+type SecurityConfig struct {
+	// EncryptionKeyFile holds the key encrypting the files sent to the peers,
+	// <storage_root>/encryption.key when empty
+	EncryptionKeyFile string `json:"encryption_key_file"`
+	// Channel secures the connections between the nodes: "none", "tls" for mutual
+	// TLS with the cluster CA or "noise" for the Noise channel
+	Channel     string `json:"channel"`
+	TLSCAFile   string `json:"tls_ca_file"`
+	TLSCertFile string `json:"tls_cert_file"`
+	TLSKeyFile  string `json:"tls_key_file"`
+	// NoiseAllowedKeys are the hex encoded Noise static keys of the nodes allowed to
+	// connect. The key of a node is logged when it starts
+	NoiseAllowedKeys []string `json:"noise_allowed_keys"`
+	// RequiredFeatures are the handshake features the peers must support
+	RequiredFeatures []string `json:"required_features"`
+}
+
+// ConfigError is a config field with an invalid value
+type ConfigError struct {
+	Field string
+	Err   error
+}
+
+func (e *ConfigError) Error() string {
+	return fmt.Sprintf("invalid %s: %s", e.Field, e.Err)
+}
+
+func (e *ConfigError) Unwrap() error {
+	return e.Err
+}
+
+func DefaultConfig() Config {
+	return Config{
+		ListenAddress:   ":3000",
+		PathTransformer: "cas",
+		Replication:     ReplicationConfig{Mode: "full"},
+		Security:        SecurityConfig{Channel: "none"},
+		HTTPAddress:     "localhost:3080",
+	}
+}
+
+// LoadConfig returns the default config overridden by the file, when path is not
+// empty, and then by the environment variables. The config is not validated, so
+// the caller can still override it
+func LoadConfig(path string) (Config, error) {
+	cfg := DefaultConfig()
+	if path != "" {
+		f, err := os.Open(path)
+		if err != nil {
+			return cfg, err
+		}
+		defer f.Close()
+
+		dec := json.NewDecoder(f)
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(&cfg); err != nil {
+			var typeErr *json.UnmarshalTypeError
+			if errors.As(err, &typeErr) {
+				err = &ConfigError{Field: typeErr.Field, Err: fmt.Errorf("expected a %s, got a %s", typeErr.Type, typeErr.Value)}
+			}
+			return cfg, fmt.Errorf("%s: %w", path, err)
+		}
+	}
+
+	if err := applyEnv(reflect.ValueOf(&cfg).Elem(), envPrefix); err != nil {
+		return cfg, err
+	}
+
+	return cfg, nil
+}
+
+// applyEnv sets the fields of the struct with the environment variables named after
+// their JSON name, prefixed by the path of the struct
+func applyEnv(v reflect.Value, prefix string) error {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		var (
+			name, _, _ = strings.Cut(t.Field(i).Tag.Get("json"), ",")
+			env        = prefix + "_" + strings.ToUpper(name)
+			field      = v.Field(i)
+		)
+		if field.Kind() == reflect.Struct {
+			if err := applyEnv(field, env); err != nil {
+				return err
+			}
+			continue
+		}
+
+		s, ok := os.LookupEnv(env)
+		if !ok {
+			continue
+		}
+		switch field.Kind() {
+		case reflect.String:
+			field.SetString(s)
+		case reflect.Int, reflect.Int64:
+			n, err := strconv.ParseInt(s, 10, 64)
+			if err != nil {
+				return &ConfigError{Field: env, Err: err}
+			}
+			field.SetInt(n)
+		case reflect.Slice:
+			field.Set(reflect.ValueOf(splitList(s)))
+		}
+	}
+
+	return nil
+}
+
+// Validate checks every field of the config, returning the ConfigError of each
+// invalid one
+func (c *Config) Validate() error {
+	var errs []error
+	invalid := func(field string, format string, args ...any) {
+		errs = append(errs, &ConfigError{Field: field, Err: fmt.Errorf(format, args...)})
+	}
+
+	if c.ID != "" {
+		if b, err := hex.DecodeString(c.ID); err != nil || len(b) != ed25519.PublicKeySize {
+			invalid("id", "must be the %d hex encoded bytes of the node public key", ed25519.PublicKeySize)
+		}
+	}
+	if err := checkAddress(c.ListenAddress); err != nil {
+		invalid("listen_address", "%s", err)
+	}
+	if c.PathTransformer != "cas" && c.PathTransformer != "default" {
+		invalid("path_transformer", "%q is not one of cas, default", c.PathTransformer)
+	}
+	for i, node := range c.BootstrapNodes {
+		if err := checkAddress(node); err != nil {
+			invalid(fmt.Sprintf("bootstrap_nodes[%d]", i), "%s", err)
+		}
+	}
+
+	r := c.Replication
+	switch r.Mode {
+	case "full":
+	case "erasure":
+		if r.DataShards <= 0 {
+			invalid("replication.data_shards", "must be positive, got %d", r.DataShards)
+		}
+		if r.ParityShards < 0 {
+			invalid("replication.parity_shards", "can't be negative, got %d", r.ParityShards)
+		}
+		if total := r.DataShards + r.ParityShards; total > 256 {
+			invalid("replication.parity_shards", "at most 256 shards are supported, got %d", total)
+		}
+	case "chunked":
+		if r.ChunkSize <= 0 {
+			invalid("replication.chunk_size", "must be positive, got %d", r.ChunkSize)
+		}
+	case "cdc":
+		sizes := []struct {
+			field string
+			size  int
+		}{
+			{"replication.min_chunk_size", r.MinChunkSize},
+			{"replication.avg_chunk_size", r.AvgChunkSize},
+			{"replication.max_chunk_size", r.MaxChunkSize},
+		}
+		for i, s := range sizes {
+			if s.size < 0 {
+				invalid(s.field, "can't be negative, got %d", s.size)
+			} else if i > 0 && s.size > 0 && s.size < sizes[i-1].size {
+				invalid(s.field, "must be at least %s (%d), got %d", sizes[i-1].field, sizes[i-1].size, s.size)
+			}
+		}
+	default:
+		invalid("replication.mode", "%q is not one of full, erasure, chunked, cdc", r.Mode)
+	}
+
+	for i, name := range c.Codecs {
+		if _, err := codecByName(name); err != nil {
+			invalid(fmt.Sprintf("codecs[%d]", i), "%s", err)
+		}
+	}
+	if c.Quota < 0 {
+		invalid("quota", "can't be negative, got %d", c.Quota)
+	}
+
+	s := c.Security
+	switch s.Channel {
+	case "none":
+	case "tls":
+		for _, f := range []struct{ field, file string }{
+			{"security.tls_ca_file", s.TLSCAFile},
+			{"security.tls_cert_file", s.TLSCertFile},
+			{"security.tls_key_file", s.TLSKeyFile},
+		} {
+			if f.file == "" {
+				invalid(f.field, "is required by the tls channel")
+			}
+		}
+	case "noise":
+		if len(s.NoiseAllowedKeys) == 0 {
+			invalid("security.noise_allowed_keys", "at least one key is required by the noise channel")
+		}
+		for i, key := range s.NoiseAllowedKeys {
+			if b, err := hex.DecodeString(key); err != nil || len(b) != 32 {
+				invalid(fmt.Sprintf("security.noise_allowed_keys[%d]", i), "must be 32 hex encoded bytes")
+			}
+		}
+	default:
+		invalid("security.channel", "%q is not one of none, tls, noise", s.Channel)
+	}
+
+	for _, a := range []struct{ field, addr string }{
+		{"http_address", c.HTTPAddress},
+		{"s3_address", c.S3Address},
+		{"grpc_address", c.GRPCAddress},
+		{"metrics_address", c.MetricsAddress},
+	} {
+		if a.addr == "" {
+			continue
+		}
+		if err := checkAddress(a.addr); err != nil {
+			invalid(a.field, "%s", err)
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// checkAddress checks that the address is a host and a port, the host being optional
+func checkAddress(addr string) error {
+	_, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	if n, err := strconv.Atoi(port); err != nil || n < 0 || n > 65535 {
+		return fmt.Errorf("invalid port %q", port)
+	}
+	return nil
+}
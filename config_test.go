@@ -0,0 +1,110 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLoadConfig(t *testing.T) {
+	cfg, err := LoadConfig("gofs.example.json")
+	assert.Nil(t, err)
+	assert.Nil(t, cfg.Validate())
+	assert.Equal(t, []string{":4000", ":5000"}, cfg.BootstrapNodes)
+	assert.Equal(t, 2, cfg.Replication.DataShards)
+
+	// Environment variables override the file
+	t.Setenv("GOFS_LISTEN_ADDRESS", ":6000")
+	t.Setenv("GOFS_BOOTSTRAP_NODES", ":7000, :8000")
+	t.Setenv("GOFS_REPLICATION_PARITY_SHARDS", "3")
+	cfg, err = LoadConfig("gofs.example.json")
+	assert.Nil(t, err)
+	assert.Equal(t, ":6000", cfg.ListenAddress)
+	assert.Equal(t, []string{":7000", ":8000"}, cfg.BootstrapNodes)
+	assert.Equal(t, 3, cfg.Replication.ParityShards)
+
+	t.Setenv("GOFS_QUOTA", "lots")
+	_, err = LoadConfig("")
+	var cfgErr *ConfigError
+	assert.True(t, errors.As(err, &cfgErr))
+	assert.Equal(t, "GOFS_QUOTA", cfgErr.Field)
+}
+
+func TestLoadConfigErrors(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "gofs.json")
+
+	assert.Nil(t, os.WriteFile(path, []byte(`{"replication": {"data_shards": "two"}}`), 0o600))
+	_, err := LoadConfig(path)
+	var cfgErr *ConfigError
+	assert.True(t, errors.As(err, &cfgErr))
+	assert.Equal(t, "replication.data_shards", cfgErr.Field)
+
+	assert.Nil(t, os.WriteFile(path, []byte(`{"listen": ":3000"}`), 0o600))
+	_, err = LoadConfig(path)
+	assert.ErrorContains(t, err, `unknown field "listen"`)
+}
+
+func TestConfigValidate(t *testing.T) {
+	cfg := DefaultConfig()
+	assert.Nil(t, cfg.Validate())
+
+	cfg.ID = "not hex"
+	cfg.ListenAddress = "3000"
+	cfg.PathTransformer = "flat"
+	cfg.BootstrapNodes = []string{":4000", "localhost:99999"}
+	cfg.Replication = ReplicationConfig{Mode: "erasure", DataShards: 0, ParityShards: 1}
+	cfg.Codecs = []string{"binary", "xml"}
+	cfg.Security = SecurityConfig{Channel: "tls", TLSCAFile: "ca.pem"}
+	cfg.GRPCAddress = "nowhere"
+	cfg.MetricsAddress = ":http"
+
+	var fields []string
+	for _, err := range cfg.Validate().(interface{ Unwrap() []error }).Unwrap() {
+		var cfgErr *ConfigError
+		assert.True(t, errors.As(err, &cfgErr))
+		fields = append(fields, cfgErr.Field)
+	}
+	assert.Equal(t, []string{
+		"id",
+		"listen_address",
+		"path_transformer",
+		"bootstrap_nodes[1]",
+		"replication.data_shards",
+		"codecs[1]",
+		"security.tls_cert_file",
+		"security.tls_key_file",
+		"grpc_address",
+		"metrics_address",
+	}, fields)
+
+	cfg = DefaultConfig()
+	cfg.Replication = ReplicationConfig{Mode: "cdc", MinChunkSize: 1024, AvgChunkSize: 512}
+	cfg.Security = SecurityConfig{Channel: "noise", NoiseAllowedKeys: []string{"abcd"}}
+	assert.ErrorContains(t, cfg.Validate(), "replication.avg_chunk_size")
+	assert.ErrorContains(t, cfg.Validate(), "security.noise_allowed_keys[0]")
+}
+
+func TestMakeServer(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.StorageRoot = t.TempDir()
+	cfg.Replication = ReplicationConfig{Mode: "chunked", ChunkSize: 1024}
+
+	s, err := makeServer(cfg)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(1024), s.ChunkSize)
+
+	// The node keeps its ID, which the config can pin
+	cfg.ID = s.ID
+	s, err = makeServer(cfg)
+	assert.Nil(t, err)
+	assert.Equal(t, cfg.ID, s.ID)
+
+	cfg.StorageRoot = t.TempDir()
+	_, err = makeServer(cfg)
+	var cfgErr *ConfigError
+	assert.True(t, errors.As(err, &cfgErr))
+	assert.Equal(t, "id", cfgErr.Field)
+}
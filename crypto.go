@@ -1,16 +1,26 @@
 package main
 
 import (
+	"bytes"
 	"crypto/aes"
 	"crypto/cipher"
+	"crypto/hmac"
 	"crypto/md5"
 	"crypto/rand"
+	"crypto/sha256"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
 	"log"
+	"os"
+	"path/filepath"
+	"strings"
 )
 
+// encryptionKeyFile is the default file in the storage root holding the encryption key
+const encryptionKeyFile = "encryption.key"
+
 func generateID() (string, error) {
 	buf := make([]byte, 32)
 	if _, err := io.ReadFull(rand.Reader, buf); err != nil {
@@ -34,6 +44,36 @@ func newEncryptionKey() []byte {
 	return keyBuf
 }
 
+// LoadOrCreateEncryptionKey reads the hex encoded encryption key from the file. If the
+// file doesn't exist, a new key is generated and saved, so the node can still decrypt
+// the files it sent to its peers after a restart
+func LoadOrCreateEncryptionKey(path string) ([]byte, error) {
+	b, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		key := newEncryptionKey()
+		if err := os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
+			return nil, err
+		}
+		if err := os.WriteFile(path, []byte(hex.EncodeToString(key)+"\n"), 0o600); err != nil {
+			return nil, err
+		}
+		return key, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := hex.DecodeString(strings.TrimSpace(string(b)))
+	if err != nil {
+		return nil, fmt.Errorf("invalid encryption key in %s: %w", path, err)
+	}
+	if len(key) != 32 {
+		return nil, fmt.Errorf("encryption key in %s has %d bytes instead of 32", path, len(key))
+	}
+
+	return key, nil
+}
+
 func copyStream(stream cipher.Stream, blockSize int, dst io.Writer, src io.Reader) (int, error) {
 	var (
 		buf          = make([]byte, 32*1024)
@@ -81,12 +121,36 @@ func copyDecrypt(key []byte, src io.Reader, dst io.Writer) (int, error) {
 }
 
 func copyEncrypt(key []byte, src io.Reader, dst io.Writer) (int, error) {
-	block, err := aes.NewCipher(key)
-	if err != nil {
+	iv := make([]byte, aes.BlockSize) // 16 bytes
+	if _, err := io.ReadFull(rand.Reader, iv); err != nil {
 		return 0, err
 	}
-	iv := make([]byte, block.BlockSize()) // 16 bytes
-	if _, err := io.ReadFull(rand.Reader, iv); err != nil {
+
+	return copyEncryptIV(key, iv, src, dst)
+}
+
+// convergentIV derives the IV from the data itself, so the same data encrypted with
+// the same key always results in the same ciphertext
+func convergentIV(key, data []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(data)
+	return mac.Sum(nil)[:aes.BlockSize]
+}
+
+// encryptConvergent encrypts the data with a convergent IV, so the same data always
+// results in the same encrypted data and hash
+func encryptConvergent(key, data []byte) ([]byte, error) {
+	buf := new(bytes.Buffer)
+	if _, err := copyEncryptIV(key, convergentIV(key, data), bytes.NewReader(data), buf); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// copyEncryptIV works as copyEncrypt, but using the given IV instead of a random one
+func copyEncryptIV(key, iv []byte, src io.Reader, dst io.Writer) (int, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
 		return 0, err
 	}
 
@@ -100,3 +164,49 @@ func copyEncrypt(key []byte, src io.Reader, dst io.Writer) (int, error) {
 	)
 	return copyStream(stream, bytesWritten, dst, src)
 }
+
+// encryptReader returns the data of src encrypted with the IV, as written by
+// copyEncryptIV, starting at the offset of the encrypted data
+func encryptReader(key, iv []byte, src io.ReadSeeker, offset int64) (io.Reader, error) {
+	var prefix []byte
+	if offset < aes.BlockSize {
+		prefix = iv[offset:]
+		offset = aes.BlockSize
+	}
+	offset -= aes.BlockSize
+
+	ctr, err := newCTRAt(key, iv, offset)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := src.Seek(offset, io.SeekStart); err != nil {
+		return nil, err
+	}
+
+	return io.MultiReader(bytes.NewReader(prefix), cipher.StreamReader{S: ctr, R: src}), nil
+}
+
+// newCTRAt returns the CTR stream of the IV positioned at the offset of the encrypted
+// data, so a range of the data can be decrypted without reading the bytes before it
+func newCTRAt(key, iv []byte, offset int64) (cipher.Stream, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	// The counter is the IV as a big endian number incremented once per block
+	counter := bytes.Clone(iv)
+	n := uint64(offset / aes.BlockSize)
+	for i := len(counter) - 1; i >= 0 && n > 0; i-- {
+		n += uint64(counter[i])
+		counter[i] = byte(n)
+		n >>= 8
+	}
+	stream := cipher.NewCTR(block, counter)
+
+	// Skip the key stream of the bytes before the offset in its block
+	skip := make([]byte, offset%aes.BlockSize)
+	stream.XORKeyStream(skip, skip)
+
+	return stream, nil
+}
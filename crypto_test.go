@@ -4,6 +4,8 @@ import (
 	"bytes"
 	"fmt"
 	"github.com/stretchr/testify/assert"
+	"os"
+	"path/filepath"
 	"testing"
 )
 
@@ -17,7 +19,7 @@ func TestCopyEncrypt(t *testing.T) {
 
 	n, err := copyEncrypt(key, src, dst)
 	assert.Nil(t, err)
-	assert.Zero(t, n)
+	assert.Equal(t, 16+len(payload), n)
 
 	fmt.Println(len(payload))
 	fmt.Println(len(dst.String()))
@@ -29,3 +31,60 @@ func TestCopyEncrypt(t *testing.T) {
 	assert.Equal(t, nw, 16+len(payload))
 
 }
+
+func TestEncryptConvergent(t *testing.T) {
+	var (
+		key  = newEncryptionKey()
+		data = []byte("some chunk of a big file")
+	)
+
+	a, err := encryptConvergent(key, data)
+	assert.Nil(t, err)
+	b, err := encryptConvergent(key, data)
+	assert.Nil(t, err)
+
+	// The same data must always result in the same hash
+	assert.Equal(t, hashChunk(a), hashChunk(b))
+
+	out := new(bytes.Buffer)
+	_, err = copyDecrypt(key, bytes.NewReader(a), out)
+	assert.Nil(t, err)
+	assert.Equal(t, data, out.Bytes())
+}
+
+func TestNewCTRAt(t *testing.T) {
+	var (
+		key  = newEncryptionKey()
+		data = bytes.Repeat([]byte("some chunk of a big file"), 10)
+		// The counter overflows the last bytes of the IV after the first block
+		iv = bytes.Repeat([]byte{0xff}, 16)
+	)
+	encrypted := new(bytes.Buffer)
+	_, err := copyEncryptIV(key, iv, bytes.NewReader(data), encrypted)
+	assert.Nil(t, err)
+
+	for offset := 0; offset < len(data); offset += 7 {
+		stream, err := newCTRAt(key, iv, int64(offset))
+		assert.Nil(t, err)
+
+		out := make([]byte, len(data)-offset)
+		stream.XORKeyStream(out, encrypted.Bytes()[16+offset:])
+		assert.Equal(t, data[offset:], out)
+	}
+}
+
+func TestLoadOrCreateEncryptionKey(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "keys", encryptionKeyFile)
+
+	key, err := LoadOrCreateEncryptionKey(path)
+	assert.Nil(t, err)
+	assert.Equal(t, 32, len(key))
+
+	loaded, err := LoadOrCreateEncryptionKey(path)
+	assert.Nil(t, err)
+	assert.Equal(t, key, loaded)
+
+	assert.Nil(t, os.WriteFile(path, []byte("not a key"), 0o600))
+	_, err = LoadOrCreateEncryptionKey(path)
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,305 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ErrTooFewShards is returned when there are not enough shards left to
+// reconstruct the original data
+var ErrTooFewShards = errors.New("too few shards to reconstruct the data")
+
+// ErasureOpts holds the Reed-Solomon configuration used to split the objects
+// between the peers of the network
+type ErasureOpts struct {
+	// DataShards is the number of shards the object is split into (k)
+	DataShards int
+	// ParityShards is the number of extra shards used to recover lost data shards (m)
+	ParityShards int
+}
+
+// TotalShards returns the amount of shards (data + parity) generated for each object
+func (o ErasureOpts) TotalShards() int {
+	return o.DataShards + o.ParityShards
+}
+
+// Galois field GF(2^8) tables generated with the polynomial x^8 + x^4 + x^3 + x^2 + 1
+var (
+	gfExp [510]byte
+	gfLog [256]byte
+)
+
+func init() {
+	x := 1
+	for i := 0; i < 255; i++ {
+		gfExp[i] = byte(x)
+		gfLog[x] = byte(i)
+		x <<= 1
+		if x&0x100 != 0 {
+			x ^= 0x11d
+		}
+	}
+	// Duplicate the table so gfMul doesn't need to reduce the sum of the logs
+	for i := 255; i < len(gfExp); i++ {
+		gfExp[i] = gfExp[i-255]
+	}
+}
+
+func gfMul(a, b byte) byte {
+	if a == 0 || b == 0 {
+		return 0
+	}
+	return gfExp[int(gfLog[a])+int(gfLog[b])]
+}
+
+func gfInv(a byte) byte {
+	return gfExp[255-int(gfLog[a])]
+}
+
+func gfPow(a byte, n int) byte {
+	if n == 0 {
+		return 1
+	}
+	if a == 0 {
+		return 0
+	}
+	return gfExp[(int(gfLog[a])*n)%255]
+}
+
+type matrix [][]byte
+
+func newMatrix(rows, cols int) matrix {
+	m := make(matrix, rows)
+	for i := range m {
+		m[i] = make([]byte, cols)
+	}
+	return m
+}
+
+func (m matrix) multiply(o matrix) matrix {
+	res := newMatrix(len(m), len(o[0]))
+	for r := range res {
+		for c := range res[r] {
+			var v byte
+			for i := range o {
+				v ^= gfMul(m[r][i], o[i][c])
+			}
+			res[r][c] = v
+		}
+	}
+	return res
+}
+
+// invert uses the Gauss-Jordan elimination to invert a square matrix
+func (m matrix) invert() (matrix, error) {
+	size := len(m)
+	work := newMatrix(size, size*2)
+	for r := range m {
+		copy(work[r], m[r])
+		work[r][size+r] = 1
+	}
+
+	for c := 0; c < size; c++ {
+		// Find a row with a non zero value in the pivot column and swap it into place
+		pivot := -1
+		for r := c; r < size; r++ {
+			if work[r][c] != 0 {
+				pivot = r
+				break
+			}
+		}
+		if pivot == -1 {
+			return nil, errors.New("matrix is singular")
+		}
+		work[c], work[pivot] = work[pivot], work[c]
+
+		if inv := gfInv(work[c][c]); inv != 1 {
+			for i := range work[c] {
+				work[c][i] = gfMul(work[c][i], inv)
+			}
+		}
+		for r := 0; r < size; r++ {
+			if r == c || work[r][c] == 0 {
+				continue
+			}
+			factor := work[r][c]
+			for i := range work[r] {
+				work[r][i] ^= gfMul(factor, work[c][i])
+			}
+		}
+	}
+
+	res := newMatrix(size, size)
+	for r := range res {
+		copy(res[r], work[r][size:])
+	}
+	return res, nil
+}
+
+// ReedSolomon encodes data shards into parity shards and rebuilds missing
+// shards from any DataShards of the total shards
+type ReedSolomon struct {
+	ErasureOpts
+	// encoding matrix (total x data). The top rows are the identity matrix,
+	// so the data shards are kept untouched (systematic code)
+	enc matrix
+}
+
+// NewReedSolomon builds the encoding matrix for the given options
+func NewReedSolomon(opts ErasureOpts) (*ReedSolomon, error) {
+	if opts.DataShards <= 0 || opts.ParityShards < 0 {
+		return nil, fmt.Errorf("invalid erasure options: %d data shards, %d parity shards", opts.DataShards, opts.ParityShards)
+	}
+	if opts.TotalShards() > 256 {
+		return nil, fmt.Errorf("invalid erasure options: at most 256 shards are supported, got %d", opts.TotalShards())
+	}
+
+	vandermonde := newMatrix(opts.TotalShards(), opts.DataShards)
+	for r := range vandermonde {
+		for c := range vandermonde[r] {
+			vandermonde[r][c] = gfPow(byte(r), c)
+		}
+	}
+	top, err := vandermonde[:opts.DataShards].invert()
+	if err != nil {
+		return nil, err
+	}
+
+	return &ReedSolomon{ErasureOpts: opts, enc: vandermonde.multiply(top)}, nil
+}
+
+// Split pads the data and divides it into DataShards equally sized shards,
+// followed by ParityShards empty shards ready to be encoded
+func (rs *ReedSolomon) Split(data []byte) [][]byte {
+	shardSize := (len(data) + rs.DataShards - 1) / rs.DataShards
+	if shardSize == 0 {
+		shardSize = 1
+	}
+
+	buf := make([]byte, shardSize*rs.TotalShards())
+	copy(buf, data)
+
+	shards := make([][]byte, rs.TotalShards())
+	for i := range shards {
+		shards[i] = buf[i*shardSize : (i+1)*shardSize]
+	}
+	return shards
+}
+
+// Encode calculates the parity shards from the data shards
+func (rs *ReedSolomon) Encode(shards [][]byte) error {
+	if err := rs.checkShards(shards, false); err != nil {
+		return err
+	}
+	rs.codeShards(rs.enc[rs.DataShards:], shards[:rs.DataShards], shards[rs.DataShards:])
+	return nil
+}
+
+// Reconstruct rebuilds the missing (nil) shards as long as at least
+// DataShards of them are present
+func (rs *ReedSolomon) Reconstruct(shards [][]byte) error {
+	if err := rs.checkShards(shards, true); err != nil {
+		return err
+	}
+
+	var (
+		sub       = make(matrix, 0, rs.DataShards)
+		available = make([][]byte, 0, rs.DataShards)
+		shardSize int
+	)
+	for i, shard := range shards {
+		if shard == nil || len(sub) == rs.DataShards {
+			continue
+		}
+		sub = append(sub, rs.enc[i])
+		available = append(available, shard)
+		shardSize = len(shard)
+	}
+	if len(sub) < rs.DataShards {
+		return ErrTooFewShards
+	}
+
+	// Recover the missing data shards by inverting the rows of the available ones
+	decode, err := sub.invert()
+	if err != nil {
+		return err
+	}
+	var (
+		rows    matrix
+		missing [][]byte
+	)
+	for i := 0; i < rs.DataShards; i++ {
+		if shards[i] == nil {
+			shards[i] = make([]byte, shardSize)
+			rows = append(rows, decode[i])
+			missing = append(missing, shards[i])
+		}
+	}
+	rs.codeShards(rows, available, missing)
+
+	// With every data shard in place the missing parity can be encoded again
+	rows, missing = nil, nil
+	for i := rs.DataShards; i < rs.TotalShards(); i++ {
+		if shards[i] == nil {
+			shards[i] = make([]byte, shardSize)
+			rows = append(rows, rs.enc[i])
+			missing = append(missing, shards[i])
+		}
+	}
+	rs.codeShards(rows, shards[:rs.DataShards], missing)
+
+	return nil
+}
+
+// Join concatenates the data shards and trims the padding added by Split
+func (rs *ReedSolomon) Join(shards [][]byte, size int) ([]byte, error) {
+	data := make([]byte, 0, size)
+	for _, shard := range shards[:rs.DataShards] {
+		if shard == nil {
+			return nil, ErrTooFewShards
+		}
+		data = append(data, shard...)
+	}
+	if len(data) < size {
+		return nil, fmt.Errorf("shards hold %d bytes, expected at least %d", len(data), size)
+	}
+	return data[:size], nil
+}
+
+// codeShards multiplies the rows of the matrix by the input shards, writing
+// each result to the respective output shard
+func (rs *ReedSolomon) codeShards(rows matrix, inputs, outputs [][]byte) {
+	for r, out := range outputs {
+		clear(out)
+		for c, in := range inputs {
+			factor := rows[r][c]
+			if factor == 0 {
+				continue
+			}
+			for i := range out {
+				out[i] ^= gfMul(factor, in[i])
+			}
+		}
+	}
+}
+
+func (rs *ReedSolomon) checkShards(shards [][]byte, allowMissing bool) error {
+	if len(shards) != rs.TotalShards() {
+		return fmt.Errorf("expected %d shards, got %d", rs.TotalShards(), len(shards))
+	}
+
+	size := -1
+	for _, shard := range shards {
+		if shard == nil {
+			if !allowMissing {
+				return errors.New("missing shard")
+			}
+			continue
+		}
+		if size != -1 && len(shard) != size {
+			return errors.New("shards must have the same size")
+		}
+		size = len(shard)
+	}
+	return nil
+}
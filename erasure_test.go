@@ -0,0 +1,39 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReedSolomonReconstruct(t *testing.T) {
+	rs, err := NewReedSolomon(ErasureOpts{DataShards: 4, ParityShards: 2})
+	assert.Nil(t, err)
+
+	data := []byte("some big file that is going to be split between the peers")
+	shards := rs.Split(data)
+	assert.Nil(t, rs.Encode(shards))
+
+	// Lose one data shard and one parity shard
+	lost := [][]byte{shards[1], shards[4]}
+	shards[1], shards[4] = nil, nil
+
+	assert.Nil(t, rs.Reconstruct(shards))
+	assert.Equal(t, lost[0], shards[1])
+	assert.Equal(t, lost[1], shards[4])
+
+	out, err := rs.Join(shards, len(data))
+	assert.Nil(t, err)
+	assert.Equal(t, data, out)
+}
+
+func TestReedSolomonTooFewShards(t *testing.T) {
+	rs, err := NewReedSolomon(ErasureOpts{DataShards: 3, ParityShards: 1})
+	assert.Nil(t, err)
+
+	shards := rs.Split([]byte("Foo not Bar"))
+	assert.Nil(t, rs.Encode(shards))
+
+	shards[0], shards[2] = nil, nil
+	assert.ErrorIs(t, rs.Reconstruct(shards), ErrTooFewShards)
+}
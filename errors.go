@@ -0,0 +1,149 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/marcosvdn7/go-filestorage/p2p"
+)
+
+// ErrorCode is the outcome of a request, sent back to the requester in a Response
+type ErrorCode int
+
+const (
+	CodeOK ErrorCode = iota
+	CodeNotFound
+	CodeForbidden
+	CodeQuotaExceeded
+	CodeInternal
+	CodeOutOfRange
+	CodeInvalid
+	CodeServerClosed
+)
+
+// Errors returned by Get and Store, matching the codes of the responses of the peers
+var (
+	ErrNotFound      = errors.New("file not found")
+	ErrForbidden     = errors.New("forbidden")
+	ErrQuotaExceeded = errors.New("quota exceeded")
+	ErrInternal      = errors.New("internal error")
+	// ErrOutOfRange is returned by GetRange when the offset is past the end of the file
+	ErrOutOfRange = errors.New("offset out of range")
+	// ErrInvalid is returned for the requests with malformed fields, like a key that
+	// can't be used as a path
+	ErrInvalid = errors.New("invalid request")
+	// ErrServerClosed is returned by the operations started after Shutdown
+	ErrServerClosed = errors.New("server closed")
+)
+
+var codeErrors = map[ErrorCode]error{
+	CodeNotFound:      ErrNotFound,
+	CodeForbidden:     ErrForbidden,
+	CodeQuotaExceeded: ErrQuotaExceeded,
+	CodeInternal:      ErrInternal,
+	CodeOutOfRange:    ErrOutOfRange,
+	CodeInvalid:       ErrInvalid,
+	CodeServerClosed:  ErrServerClosed,
+}
+
+// Response is the first frame a node writes to the stream of a request. On success,
+// the data requested follows it
+type Response struct {
+	Code    ErrorCode
+	Message string
+}
+
+// newResponse returns the response for the error returned by a handler
+func newResponse(err error) *Response {
+	if err == nil {
+		return &Response{Code: CodeOK}
+	}
+
+	code := CodeInternal
+	if errors.Is(err, os.ErrNotExist) {
+		code = CodeNotFound
+	}
+	for c, codeErr := range codeErrors {
+		if errors.Is(err, codeErr) {
+			code = c
+			break
+		}
+	}
+
+	return &Response{Code: code, Message: err.Error()}
+}
+
+// err returns the error matching the code of the response, nil on success
+func (r *Response) err() error {
+	if r.Code == CodeOK {
+		return nil
+	}
+	codeErr, ok := codeErrors[r.Code]
+	if !ok {
+		codeErr = ErrInternal
+	}
+
+	return fmt.Errorf("%w: %s", codeErr, r.Message)
+}
+
+// readResponse reads the response of the peer from the stream
+func readResponse(stream p2p.Stream, codec Codec) error {
+	var rpc p2p.RPC
+	if err := (p2p.DefaultDecoder{}).Decode(stream, &rpc); err != nil {
+		return err
+	}
+	var resp Response
+	if err := codec.Unmarshal(rpc.Payload, &resp); err != nil {
+		return err
+	}
+
+	return resp.err()
+}
+
+// responseStream is the stream given to the handlers. The success response is sent
+// before the first byte written by the handler, the error response when it fails
+// before writing anything
+type responseStream struct {
+	p2p.Stream
+	codec Codec
+	sent  bool
+}
+
+func newResponseStream(stream p2p.Stream, codec Codec) *responseStream {
+	return &responseStream{Stream: stream, codec: codec}
+}
+
+func (s *responseStream) Write(b []byte) (int, error) {
+	if !s.sent {
+		if err := s.respond(nil); err != nil {
+			return 0, err
+		}
+	}
+	return s.Stream.Write(b)
+}
+
+func (s *responseStream) respond(err error) error {
+	s.sent = true
+
+	b, err := s.codec.Marshal(newResponse(err))
+	if err != nil {
+		return err
+	}
+	_, err = s.Stream.Write(p2p.NewMessageFrame(b))
+
+	return err
+}
+
+// finish sends the outcome of the request and closes the stream. On failure the rest
+// of the request is discarded, so a requester still uploading is not blocked
+func (s *responseStream) finish(err error) {
+	if !s.sent {
+		s.respond(err)
+	}
+	s.Stream.Close()
+	if err != nil {
+		io.Copy(io.Discard, s.Stream)
+	}
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestResponse(t *testing.T) {
+	tests := []struct {
+		err  error
+		code ErrorCode
+		want error
+	}{
+		{nil, CodeOK, nil},
+		{fmt.Errorf("missing key: %w", ErrNotFound), CodeNotFound, ErrNotFound},
+		{os.ErrNotExist, CodeNotFound, ErrNotFound},
+		{fmt.Errorf("bad signer: %w", ErrForbidden), CodeForbidden, ErrForbidden},
+		{fmt.Errorf("full: %w", ErrQuotaExceeded), CodeQuotaExceeded, ErrQuotaExceeded},
+		{fmt.Errorf("disk failure"), CodeInternal, ErrInternal},
+	}
+	for _, tt := range tests {
+		for _, c := range codecs {
+			b, err := c.Marshal(newResponse(tt.err))
+			assert.Nil(t, err)
+
+			var resp Response
+			assert.Nil(t, c.Unmarshal(b, &resp))
+			assert.Equal(t, tt.code, resp.Code)
+			if tt.want == nil {
+				assert.Nil(t, resp.err())
+			} else {
+				assert.ErrorIs(t, resp.err(), tt.want)
+			}
+		}
+	}
+}
@@ -0,0 +1,307 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Gateway exposes the files of a FileServer over HTTP:
+//
+//	PUT    /files/{key}  stores the request body
+//	GET    /files/{key}  returns the file, fetching it from the network if needed
+//	HEAD   /files/{key}  same as GET without the body
+//	DELETE /files/{key}  removes the file from the node and its peers
+//	GET    /files        lists the files stored by the node as JSON, filtered by
+//	                     the prefix query parameter
+//	GET    /cluster/status  returns the node and its connected peers as JSON
+//
+// The ETag of a file is the SHA-256 of its content
+type Gateway struct {
+	server *FileServer
+	mux    *http.ServeMux
+}
+
+func NewGateway(server *FileServer) *Gateway {
+	g := &Gateway{
+		server: server,
+		mux:    http.NewServeMux(),
+	}
+	// GET patterns match HEAD requests as well, and the body of a HEAD response
+	// is discarded by net/http
+	g.mux.HandleFunc("PUT /files/{key...}", g.handlePut)
+	g.mux.HandleFunc("GET /files/{key...}", g.handleGet)
+	g.mux.HandleFunc("DELETE /files/{key...}", g.handleDelete)
+	g.mux.HandleFunc("GET /files", g.handleList)
+	g.mux.HandleFunc("GET /cluster/status", g.handleClusterStatus)
+
+	return g
+}
+
+func (g *Gateway) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	g.mux.ServeHTTP(w, r)
+}
+
+func (g *Gateway) handlePut(w http.ResponseWriter, r *http.Request) {
+	key, ok := fileKey(w, r)
+	if !ok {
+		return
+	}
+
+	hash := sha256.New()
+	if err := g.server.Store(key, io.TeeReader(r.Body, hash)); err != nil {
+		g.error(w, r, err)
+		return
+	}
+
+	w.Header().Set("ETag", etag(hex.EncodeToString(hash.Sum(nil))))
+	w.WriteHeader(http.StatusCreated)
+}
+
+func (g *Gateway) handleGet(w http.ResponseWriter, r *http.Request) {
+	key, ok := fileKey(w, r)
+	if !ok {
+		return
+	}
+
+	// Only the size is known of the files held by the peers, the content is not
+	// fetched until it's sent
+	info, err := g.server.Stat(key)
+	if err != nil {
+		g.error(w, r, err)
+		return
+	}
+	w.Header().Set("Accept-Ranges", "bytes")
+	if info.SHA256 != "" {
+		tag := etag(info.SHA256)
+		w.Header().Set("ETag", tag)
+		w.Header().Set("Last-Modified", info.ModTime.Format(http.TimeFormat))
+		if r.Header.Get("If-None-Match") == tag {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+	}
+
+	offset, length, partial, err := parseRange(r.Header.Get("Range"), info.Size)
+	if err != nil {
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes */%d", info.Size))
+		http.Error(w, err.Error(), http.StatusRequestedRangeNotSatisfiable)
+		return
+	}
+	status := http.StatusOK
+	if partial {
+		status = http.StatusPartialContent
+	}
+	if r.Method == http.MethodHead {
+		setContentHeaders(w, offset, length, info.Size, partial)
+		w.WriteHeader(status)
+		return
+	}
+	f, err := openFile(g.server, key, offset, length, partial)
+	if err != nil {
+		g.error(w, r, err)
+		return
+	}
+	defer f.Close()
+
+	setContentHeaders(w, offset, length, info.Size, partial)
+	w.WriteHeader(status)
+	if _, err := io.CopyN(w, f, length); err != nil {
+		log.Printf("[%s] could not send (%s) to %s: %s", g.server.Transport.Addr(), key, r.RemoteAddr, err)
+	}
+}
+
+// setContentHeaders sets the headers describing the range of the file sent
+func setContentHeaders(w http.ResponseWriter, offset, length, size int64, partial bool) {
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Length", strconv.FormatInt(length, 10))
+	if partial {
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", offset, offset+length-1, size))
+	}
+}
+
+// openFile returns the range of the file, or the whole file when the range is not
+// partial
+func openFile(server *FileServer, key string, offset, length int64, partial bool) (io.ReadCloser, error) {
+	if partial {
+		return server.GetRange(key, offset, length)
+	}
+	f, err := server.Get(key)
+	if err != nil {
+		return nil, err
+	}
+	if rc, ok := f.(io.ReadCloser); ok {
+		return rc, nil
+	}
+	return io.NopCloser(f), nil
+}
+
+func (g *Gateway) handleDelete(w http.ResponseWriter, r *http.Request) {
+	key, ok := fileKey(w, r)
+	if !ok {
+		return
+	}
+
+	if err := g.server.Delete(key); err != nil {
+		g.error(w, r, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// gatewayFile is the info of a file returned by the list of files
+type gatewayFile struct {
+	Key     string
+	Size    int64
+	ModTime time.Time
+	ETag    string
+}
+
+func (g *Gateway) handleList(w http.ResponseWriter, r *http.Request) {
+	files := []gatewayFile{}
+	for _, info := range g.server.index.List(r.URL.Query().Get("prefix")) {
+		files = append(files, gatewayFile{
+			Key:     info.Key,
+			Size:    info.Size,
+			ModTime: info.ModTime,
+			ETag:    etag(info.SHA256),
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(files); err != nil {
+		log.Printf("[%s] could not send the list of files to %s: %s", g.server.Transport.Addr(), r.RemoteAddr, err)
+	}
+}
+
+// gatewayNode is the info of a node returned by the cluster status
+type gatewayNode struct {
+	ID       string
+	Address  string
+	Version  int
+	Features []string
+}
+
+type gatewayClusterStatus struct {
+	Node  gatewayNode
+	Peers []gatewayNode
+}
+
+func (g *Gateway) handleClusterStatus(w http.ResponseWriter, r *http.Request) {
+	info := g.server.NodeInfo()
+	status := gatewayClusterStatus{
+		Node: gatewayNode{
+			ID:       info.ID,
+			Address:  info.ListenAddress,
+			Version:  info.Version,
+			Features: info.Features,
+		},
+		Peers: []gatewayNode{},
+	}
+	for _, peer := range g.server.sortedPeers() {
+		status.Peers = append(status.Peers, gatewayNode{
+			ID:       peer.Info().ID,
+			Address:  peer.RemoteAddr().String(),
+			Version:  peer.Info().Version,
+			Features: peer.Info().Features,
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(status); err != nil {
+		log.Printf("[%s] could not send the cluster status to %s: %s", g.server.Transport.Addr(), r.RemoteAddr, err)
+	}
+}
+
+// error replies with the status code matching the error
+func (g *Gateway) error(w http.ResponseWriter, r *http.Request, err error) {
+	status := http.StatusInternalServerError
+	switch {
+	case errors.Is(err, ErrNotFound):
+		status = http.StatusNotFound
+	case errors.Is(err, ErrForbidden):
+		status = http.StatusForbidden
+	case errors.Is(err, ErrQuotaExceeded):
+		status = http.StatusInsufficientStorage
+	case errors.Is(err, ErrOutOfRange):
+		status = http.StatusRequestedRangeNotSatisfiable
+	case errors.Is(err, ErrInvalid):
+		status = http.StatusBadRequest
+	case errors.Is(err, ErrServerClosed):
+		status = http.StatusServiceUnavailable
+	}
+	log.Printf("[%s] %s %s failed: %s", g.server.Transport.Addr(), r.Method, r.URL.Path, err)
+
+	http.Error(w, http.StatusText(status), status)
+}
+
+// fileKey returns the key of the file in the path, replying with a bad request
+// when it's empty
+func fileKey(w http.ResponseWriter, r *http.Request) (string, bool) {
+	key := r.PathValue("key")
+	if len(key) == 0 {
+		http.Error(w, "missing file key", http.StatusBadRequest)
+		return "", false
+	}
+	return key, true
+}
+
+func etag(hash string) string {
+	return fmt.Sprintf("%q", hash)
+}
+
+// errInvalidRange is returned by parseRange when the range is out of the file
+var errInvalidRange = errors.New("invalid range")
+
+// parseRange returns the offset and length of the byte range of the Range header.
+// Malformed headers and multiple ranges are ignored, so the whole file is served
+// instead, as allowed by RFC 9110
+func parseRange(header string, size int64) (offset, length int64, partial bool, err error) {
+	spec, ok := strings.CutPrefix(header, "bytes=")
+	if !ok || strings.Contains(spec, ",") {
+		return 0, size, false, nil
+	}
+	first, last, ok := strings.Cut(strings.TrimSpace(spec), "-")
+	if !ok {
+		return 0, size, false, nil
+	}
+
+	if first == "" {
+		// bytes=-n is the last n bytes of the file
+		n, err := strconv.ParseInt(last, 10, 64)
+		if err != nil || n < 0 {
+			return 0, size, false, nil
+		}
+		if n == 0 || size == 0 {
+			return 0, 0, false, errInvalidRange
+		}
+		n = min(n, size)
+		return size - n, n, true, nil
+	}
+
+	start, err := strconv.ParseInt(first, 10, 64)
+	if err != nil || start < 0 {
+		return 0, size, false, nil
+	}
+	end := size - 1
+	if last != "" {
+		if end, err = strconv.ParseInt(last, 10, 64); err != nil || end < start {
+			return 0, size, false, nil
+		}
+		end = min(end, size-1)
+	}
+	if start >= size {
+		return 0, 0, false, errInvalidRange
+	}
+
+	return start, end - start + 1, true, nil
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGateway(t *testing.T) {
+	servers := newTestCluster(t, 3, FileServerOpts{}, nil)
+	srv := httptest.NewServer(NewGateway(servers[2]))
+	defer srv.Close()
+
+	var (
+		url  = srv.URL + "/files/pictures/foo.jpg"
+		data = bytes.Repeat([]byte("my big data file here!"), 100)
+		tag  = fmt.Sprintf("%q", fmt.Sprintf("%x", sha256.Sum256(data)))
+	)
+
+	resp := doRequest(t, http.MethodGet, url, nil, nil)
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+	resp = doRequest(t, http.MethodPut, url, bytes.NewReader(data), nil)
+	assert.Equal(t, http.StatusCreated, resp.StatusCode)
+	assert.Equal(t, tag, resp.Header.Get("ETag"))
+
+	// Fetch it from the peers
+	assert.Nil(t, servers[2].store.Delete(servers[2].ID, "pictures/foo.jpg"))
+	resp = doRequest(t, http.MethodGet, url, nil, nil)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, tag, resp.Header.Get("ETag"))
+	assert.Equal(t, int64(len(data)), resp.ContentLength)
+	b, err := io.ReadAll(resp.Body)
+	assert.Nil(t, err)
+	assert.Equal(t, data, b)
+
+	resp = doRequest(t, http.MethodHead, url, nil, nil)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, int64(len(data)), resp.ContentLength)
+
+	resp = doRequest(t, http.MethodGet, url, nil, map[string]string{"Range": "bytes=10-19"})
+	assert.Equal(t, http.StatusPartialContent, resp.StatusCode)
+	assert.Equal(t, fmt.Sprintf("bytes 10-19/%d", len(data)), resp.Header.Get("Content-Range"))
+	b, err = io.ReadAll(resp.Body)
+	assert.Nil(t, err)
+	assert.Equal(t, data[10:20], b)
+
+	resp = doRequest(t, http.MethodGet, url, nil, map[string]string{"Range": fmt.Sprintf("bytes=%d-", len(data))})
+	assert.Equal(t, http.StatusRequestedRangeNotSatisfiable, resp.StatusCode)
+
+	resp = doRequest(t, http.MethodGet, url, nil, map[string]string{"If-None-Match": tag})
+	assert.Equal(t, http.StatusNotModified, resp.StatusCode)
+
+	resp = doRequest(t, http.MethodGet, srv.URL+"/files?prefix=pictures/", nil, nil)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	var files []gatewayFile
+	assert.Nil(t, json.NewDecoder(resp.Body).Decode(&files))
+	assert.Equal(t, 1, len(files))
+	assert.Equal(t, "pictures/foo.jpg", files[0].Key)
+	assert.Equal(t, int64(len(data)), files[0].Size)
+	assert.Equal(t, tag, files[0].ETag)
+
+	// Only the size of the files held by the peers is known, and they are not fetched
+	// before they are sent
+	assert.Nil(t, servers[2].store.Delete(servers[2].ID, "pictures/foo.jpg"))
+	assert.Nil(t, servers[2].index.Remove("pictures/foo.jpg"))
+	resp = doRequest(t, http.MethodHead, url, nil, nil)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, int64(len(data)), resp.ContentLength)
+	assert.Equal(t, "", resp.Header.Get("ETag"))
+	resp = doRequest(t, http.MethodGet, url, nil, map[string]string{"Range": "bytes=10-19"})
+	assert.Equal(t, http.StatusPartialContent, resp.StatusCode)
+	assert.Equal(t, fmt.Sprintf("bytes 10-19/%d", len(data)), resp.Header.Get("Content-Range"))
+	b, err = io.ReadAll(resp.Body)
+	assert.Nil(t, err)
+	assert.Equal(t, data[10:20], b)
+	assert.False(t, servers[2].store.Has(servers[2].ID, "pictures/foo.jpg"))
+
+	resp = doRequest(t, http.MethodDelete, url, nil, nil)
+	assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+	resp = doRequest(t, http.MethodGet, url, nil, nil)
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+	resp = doRequest(t, http.MethodDelete, url, nil, nil)
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+	resp = doRequest(t, http.MethodPut, srv.URL+"/files/", bytes.NewReader(data), nil)
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+}
+
+func TestParseRange(t *testing.T) {
+	tests := []struct {
+		header          string
+		offset, length  int64
+		partial, failed bool
+	}{
+		{"", 0, 100, false, false},
+		{"bytes=0-9", 0, 10, true, false},
+		{"bytes=90-", 90, 10, true, false},
+		{"bytes=90-200", 90, 10, true, false},
+		{"bytes=-20", 80, 20, true, false},
+		{"bytes=-200", 0, 100, true, false},
+		{"bytes=100-", 0, 0, false, true},
+		{"bytes=-0", 0, 0, false, true},
+		{"bytes=--5", 0, 100, false, false},
+		{"bytes=0-1,5-6", 0, 100, false, false},
+		{"bytes=9-0", 0, 100, false, false},
+		{"items=0-9", 0, 100, false, false},
+	}
+	for _, tt := range tests {
+		offset, length, partial, err := parseRange(tt.header, 100)
+		assert.Equal(t, tt.failed, err != nil, tt.header)
+		assert.Equal(t, tt.offset, offset, tt.header)
+		assert.Equal(t, tt.length, length, tt.header)
+		assert.Equal(t, tt.partial, partial, tt.header)
+	}
+}
+
+func doRequest(t *testing.T, method, url string, body io.Reader, header map[string]string) *http.Response {
+	req, err := http.NewRequest(method, url, body)
+	assert.Nil(t, err)
+	for k, v := range header {
+		req.Header.Set(k, v)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	assert.Nil(t, err)
+	t.Cleanup(func() { resp.Body.Close() })
+
+	return resp
+}
@@ -0,0 +1,429 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// gRPC status codes, see https://grpc.github.io/grpc/core/md_doc_statuscodes.html
+const (
+	grpcOK                = 0
+	grpcInvalidArgument   = 3
+	grpcNotFound          = 5
+	grpcPermissionDenied  = 7
+	grpcResourceExhausted = 8
+	grpcOutOfRange        = 11
+	grpcUnimplemented     = 12
+	grpcInternal          = 13
+	grpcUnavailable       = 14
+)
+
+const (
+	grpcService = "/gofs.v1.FileStorage/"
+	// grpcMaxMessage is the largest message accepted, same as the default of the
+	// gRPC libraries
+	grpcMaxMessage = 4 << 20
+	// grpcChunkSize is the size of the data sent in each message of a download
+	grpcChunkSize = 64 << 10
+)
+
+// The messages of the service defined in proto/filestorage.proto. They are encoded
+// with the BinaryCodec, so the fields must follow the order of the proto file
+type (
+	grpcStoreRequest struct {
+		Key  string
+		Data []byte
+	}
+	grpcGetRequest struct {
+		Key    string
+		Offset int64
+		Length int64
+	}
+	grpcGetResponse struct {
+		Data []byte
+	}
+	grpcDeleteRequest struct {
+		Key string
+	}
+	grpcDeleteResponse struct{}
+	grpcStatRequest    struct {
+		Key string
+	}
+	grpcFileInfo struct {
+		Key     string
+		Size    int64
+		ModTime int64
+		SHA256  string
+		MD5     string
+	}
+	grpcListRequest struct {
+		Prefix string
+	}
+	grpcListResponse struct {
+		Files []grpcFileInfo
+	}
+	grpcClusterStatusRequest struct{}
+	grpcNodeStatus           struct {
+		ID       string
+		Address  string
+		Version  int
+		Features []string
+	}
+	grpcClusterStatusResponse struct {
+		Node  grpcNodeStatus
+		Peers []grpcNodeStatus
+	}
+)
+
+// grpcError is an error with its gRPC status code
+type grpcError struct {
+	code int
+	msg  string
+}
+
+func (e *grpcError) Error() string {
+	return e.msg
+}
+
+// GRPCServer serves the gRPC API of proto/filestorage.proto on top of a FileServer.
+// The gRPC protocol is implemented over the HTTP/2 support of net/http, so clients
+// generated from the proto file by any gRPC library can talk to the node
+type GRPCServer struct {
+	server *FileServer
+	srv    *http.Server
+}
+
+func NewGRPCServer(server *FileServer) *GRPCServer {
+	g := &GRPCServer{server: server}
+
+	var protocols http.Protocols
+	protocols.SetUnencryptedHTTP2(true)
+	g.srv = &http.Server{
+		Handler:   g,
+		Protocols: &protocols,
+	}
+
+	return g
+}
+
+// ListenAndServe serves the API on the address with HTTP/2 without TLS, which is
+// what the gRPC clients use on insecure channels
+func (g *GRPCServer) ListenAndServe(addr string) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return g.Serve(l)
+}
+
+func (g *GRPCServer) Serve(l net.Listener) error {
+	return g.srv.Serve(l)
+}
+
+// Shutdown stops the server once the running calls are over, see http.Server.Shutdown
+func (g *GRPCServer) Shutdown(ctx context.Context) error {
+	return g.srv.Shutdown(ctx)
+}
+
+func (g *GRPCServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	contentType := r.Header.Get("Content-Type")
+	if r.Method != http.MethodPost || r.ProtoMajor != 2 ||
+		(contentType != "application/grpc" && contentType != "application/grpc+proto") {
+		http.Error(w, "gRPC requests only", http.StatusUnsupportedMediaType)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/grpc")
+	w.WriteHeader(http.StatusOK)
+
+	var (
+		body = bufio.NewReader(r.Body)
+		err  error
+	)
+	switch strings.TrimPrefix(r.URL.Path, grpcService) {
+	case "Store":
+		err = g.store(w, body)
+	case "Get":
+		err = g.get(w, body)
+	case "Delete":
+		err = g.delete(w, body)
+	case "Stat":
+		err = g.stat(w, body)
+	case "List":
+		err = g.list(w, body)
+	case "ClusterStatus":
+		err = g.clusterStatus(w, body)
+	default:
+		err = &grpcError{code: grpcUnimplemented, msg: "unknown method " + r.URL.Path}
+	}
+	g.finish(w, r, err)
+}
+
+func (g *GRPCServer) store(w http.ResponseWriter, body io.Reader) error {
+	var req grpcStoreRequest
+	if err := readGRPCMessage(body, &req); err != nil {
+		return err
+	}
+	if req.Key == "" {
+		return &grpcError{code: grpcInvalidArgument, msg: "missing file key"}
+	}
+
+	r := &grpcStoreReader{body: body, data: req.Data}
+	if err := g.server.Store(req.Key, r); err != nil {
+		return err
+	}
+	if r.err != nil {
+		return r.err
+	}
+	info, err := g.server.Stat(req.Key)
+	if err != nil {
+		return err
+	}
+
+	return writeGRPCMessage(w, newGRPCFileInfo(info))
+}
+
+func (g *GRPCServer) get(w http.ResponseWriter, body io.Reader) error {
+	var req grpcGetRequest
+	if err := readGRPCMessage(body, &req); err != nil {
+		return err
+	}
+	info, err := g.server.Stat(req.Key)
+	if err != nil {
+		return err
+	}
+	if req.Offset < 0 || req.Offset > info.Size || req.Length < 0 {
+		return &grpcError{code: grpcOutOfRange, msg: fmt.Sprintf("range out of the %d bytes of the file", info.Size)}
+	}
+
+	length := info.Size - req.Offset
+	if req.Length > 0 {
+		length = min(req.Length, length)
+	}
+	f, err := openFile(g.server, req.Key, req.Offset, length, length < info.Size)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	buf := make([]byte, grpcChunkSize)
+	for length > 0 {
+		n, err := io.ReadFull(f, buf[:min(length, grpcChunkSize)])
+		if err != nil {
+			return err
+		}
+		if err := writeGRPCMessage(w, &grpcGetResponse{Data: buf[:n]}); err != nil {
+			return err
+		}
+		length -= int64(n)
+	}
+
+	return nil
+}
+
+func (g *GRPCServer) delete(w http.ResponseWriter, body io.Reader) error {
+	var req grpcDeleteRequest
+	if err := readGRPCMessage(body, &req); err != nil {
+		return err
+	}
+	if err := g.server.Delete(req.Key); err != nil {
+		return err
+	}
+
+	return writeGRPCMessage(w, &grpcDeleteResponse{})
+}
+
+func (g *GRPCServer) stat(w http.ResponseWriter, body io.Reader) error {
+	var req grpcStatRequest
+	if err := readGRPCMessage(body, &req); err != nil {
+		return err
+	}
+	info, err := g.server.Stat(req.Key)
+	if err != nil {
+		return err
+	}
+
+	return writeGRPCMessage(w, newGRPCFileInfo(info))
+}
+
+func (g *GRPCServer) list(w http.ResponseWriter, body io.Reader) error {
+	var req grpcListRequest
+	if err := readGRPCMessage(body, &req); err != nil {
+		return err
+	}
+
+	var res grpcListResponse
+	for _, info := range g.server.index.List(req.Prefix) {
+		res.Files = append(res.Files, *newGRPCFileInfo(info))
+	}
+
+	return writeGRPCMessage(w, &res)
+}
+
+func (g *GRPCServer) clusterStatus(w http.ResponseWriter, body io.Reader) error {
+	var req grpcClusterStatusRequest
+	if err := readGRPCMessage(body, &req); err != nil {
+		return err
+	}
+
+	info := g.server.NodeInfo()
+	res := grpcClusterStatusResponse{
+		Node: grpcNodeStatus{
+			ID:       info.ID,
+			Address:  info.ListenAddress,
+			Version:  info.Version,
+			Features: info.Features,
+		},
+	}
+	for _, peer := range g.server.sortedPeers() {
+		res.Peers = append(res.Peers, grpcNodeStatus{
+			ID:       peer.Info().ID,
+			Address:  peer.RemoteAddr().String(),
+			Version:  peer.Info().Version,
+			Features: peer.Info().Features,
+		})
+	}
+
+	return writeGRPCMessage(w, &res)
+}
+
+// finish ends the call with the status matching the error, sent in the trailers
+func (g *GRPCServer) finish(w http.ResponseWriter, r *http.Request, err error) {
+	code := grpcOK
+	var e *grpcError
+	switch {
+	case err == nil:
+	case errors.As(err, &e):
+		code = e.code
+	case errors.Is(err, ErrNotFound):
+		code = grpcNotFound
+	case errors.Is(err, ErrForbidden):
+		code = grpcPermissionDenied
+	case errors.Is(err, ErrQuotaExceeded):
+		code = grpcResourceExhausted
+	case errors.Is(err, ErrOutOfRange):
+		code = grpcOutOfRange
+	case errors.Is(err, ErrInvalid):
+		code = grpcInvalidArgument
+	case errors.Is(err, ErrServerClosed):
+		code = grpcUnavailable
+	default:
+		code = grpcInternal
+	}
+	if code == grpcInternal {
+		log.Printf("[%s] gRPC call %s failed: %s", g.server.Transport.Addr(), r.URL.Path, err)
+	}
+
+	w.Header().Set(http.TrailerPrefix+"Grpc-Status", strconv.Itoa(code))
+	if err != nil {
+		w.Header().Set(http.TrailerPrefix+"Grpc-Message", grpcPercentEncode(err.Error()))
+	}
+}
+
+// grpcStoreReader reads the data of the messages of a Store call, starting with the
+// data of the first message
+type grpcStoreReader struct {
+	body io.Reader
+	data []byte
+	err  error
+}
+
+func (r *grpcStoreReader) Read(b []byte) (int, error) {
+	for len(r.data) == 0 {
+		var req grpcStoreRequest
+		if err := readGRPCMessage(r.body, &req); err != nil {
+			if err != io.EOF {
+				r.err = err
+			}
+			return 0, err
+		}
+		r.data = req.Data
+	}
+
+	n := copy(b, r.data)
+	r.data = r.data[n:]
+
+	return n, nil
+}
+
+func newGRPCFileInfo(info FileInfo) *grpcFileInfo {
+	res := &grpcFileInfo{
+		Key:    info.Key,
+		Size:   info.Size,
+		SHA256: info.SHA256,
+		MD5:    info.MD5,
+	}
+	// The modification time of the files held by the peers is unknown
+	if !info.ModTime.IsZero() {
+		res.ModTime = info.ModTime.UnixNano()
+	}
+	return res
+}
+
+// readGRPCMessage reads a length prefixed message: a byte telling if the message is
+// compressed, the size of the message as a big endian uint32 and the message itself.
+// io.EOF is returned when there are no more messages
+func readGRPCMessage(r io.Reader, v any) error {
+	var header [5]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			return &grpcError{code: grpcInvalidArgument, msg: "truncated message"}
+		}
+		return err
+	}
+	if header[0] != 0 {
+		return &grpcError{code: grpcUnimplemented, msg: "compressed messages are not supported"}
+	}
+	size := binary.BigEndian.Uint32(header[1:])
+	if size > grpcMaxMessage {
+		return &grpcError{code: grpcResourceExhausted, msg: fmt.Sprintf("message of %d bytes is larger than %d bytes", size, grpcMaxMessage)}
+	}
+
+	b := make([]byte, size)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return &grpcError{code: grpcInvalidArgument, msg: "truncated message"}
+	}
+	if err := (BinaryCodec{}).Unmarshal(b, v); err != nil {
+		return &grpcError{code: grpcInvalidArgument, msg: err.Error()}
+	}
+
+	return nil
+}
+
+func writeGRPCMessage(w http.ResponseWriter, v any) error {
+	b, err := BinaryCodec{}.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	msg := make([]byte, 5, 5+len(b))
+	binary.BigEndian.PutUint32(msg[1:], uint32(len(b)))
+	if _, err := w.Write(append(msg, b...)); err != nil {
+		return err
+	}
+	w.(http.Flusher).Flush()
+
+	return nil
+}
+
+// grpcPercentEncode encodes the status message as the grpc-message trailer requires
+func grpcPercentEncode(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if c := s[i]; c < 0x20 || c > 0x7e || c == '%' {
+			fmt.Fprintf(&b, "%%%02X", c)
+		} else {
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGRPCServer(t *testing.T) {
+	servers := newTestCluster(t, 2, FileServerOpts{}, nil)
+	s := servers[1]
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	go NewGRPCServer(s).Serve(l)
+	defer l.Close()
+	call := func(method string, reqs ...any) ([][]byte, string) {
+		return grpcCall(t, "http://"+l.Addr().String()+grpcService+method, reqs...)
+	}
+
+	data := bytes.Repeat([]byte("my big data file here!"), 5000)
+	msgs, status := call("Store",
+		&grpcStoreRequest{Key: "foo", Data: data[:100]},
+		&grpcStoreRequest{Data: data[100:]},
+	)
+	assert.Equal(t, "0", status)
+	var info grpcFileInfo
+	assert.Nil(t, BinaryCodec{}.Unmarshal(msgs[0], &info))
+	assert.Equal(t, "foo", info.Key)
+	assert.Equal(t, int64(len(data)), info.Size)
+
+	// The download is split into several messages
+	assert.Nil(t, s.store.Delete(s.ID, "foo"))
+	msgs, status = call("Get", &grpcGetRequest{Key: "foo"})
+	assert.Equal(t, "0", status)
+	assert.Greater(t, len(msgs), 1)
+	var b []byte
+	for _, msg := range msgs {
+		var res grpcGetResponse
+		assert.Nil(t, BinaryCodec{}.Unmarshal(msg, &res))
+		b = append(b, res.Data...)
+	}
+	assert.Equal(t, data, b)
+
+	msgs, status = call("Get", &grpcGetRequest{Key: "foo", Offset: 10, Length: 5})
+	assert.Equal(t, "0", status)
+	var res grpcGetResponse
+	assert.Nil(t, BinaryCodec{}.Unmarshal(msgs[0], &res))
+	assert.Equal(t, data[10:15], res.Data)
+
+	msgs, status = call("List", &grpcListRequest{Prefix: "f"})
+	assert.Equal(t, "0", status)
+	var list grpcListResponse
+	assert.Nil(t, BinaryCodec{}.Unmarshal(msgs[0], &list))
+	assert.Equal(t, []grpcFileInfo{info}, list.Files)
+
+	msgs, status = call("ClusterStatus", &grpcClusterStatusRequest{})
+	assert.Equal(t, "0", status)
+	var cluster grpcClusterStatusResponse
+	assert.Nil(t, BinaryCodec{}.Unmarshal(msgs[0], &cluster))
+	assert.Equal(t, s.ID, cluster.Node.ID)
+	assert.Len(t, cluster.Peers, 1)
+	assert.Equal(t, servers[0].ID, cluster.Peers[0].ID)
+
+	_, status = call("Delete", &grpcDeleteRequest{Key: "foo"})
+	assert.Equal(t, "0", status)
+	_, status = call("Stat", &grpcStatRequest{Key: "foo"})
+	assert.Equal(t, "5", status)
+	_, status = call("Unknown", &grpcStatRequest{Key: "foo"})
+	assert.Equal(t, "12", status)
+}
+
+// grpcCall sends the messages to the gRPC method and returns the messages received
+// along with the status of the call
+func grpcCall(t *testing.T, url string, reqs ...any) ([][]byte, string) {
+	var body bytes.Buffer
+	for _, req := range reqs {
+		b, err := BinaryCodec{}.Marshal(req)
+		assert.Nil(t, err)
+		body.WriteByte(0)
+		binary.Write(&body, binary.BigEndian, uint32(len(b)))
+		body.Write(b)
+	}
+
+	var protocols http.Protocols
+	protocols.SetUnencryptedHTTP2(true)
+	client := &http.Client{Transport: &http.Transport{Protocols: &protocols}}
+	req, err := http.NewRequest(http.MethodPost, url, &body)
+	assert.Nil(t, err)
+	req.Header.Set("Content-Type", "application/grpc")
+	resp, err := client.Do(req)
+	assert.Nil(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	var msgs [][]byte
+	for {
+		var header [5]byte
+		if _, err := io.ReadFull(resp.Body, header[:]); err != nil {
+			break
+		}
+		msg := make([]byte, binary.BigEndian.Uint32(header[1:]))
+		_, err := io.ReadFull(resp.Body, msg)
+		assert.Nil(t, err)
+		msgs = append(msgs, msg)
+	}
+
+	return msgs, resp.Trailer.Get("Grpc-Status")
+}
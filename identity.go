@@ -0,0 +1,297 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// identityFile is the file in the storage root holding the node private key
+const identityFile = "node.key"
+
+// maxMessageAge is how far the timestamp of a message can be from the clock of the
+// receiver. Older messages are rejected, so a captured message can't be replayed later
+const maxMessageAge = time.Minute
+
+// nonceSize is the size of the random nonce of every message
+const nonceSize = 16
+
+var (
+	// ErrInvalidSignature is returned when a message is not signed by the key it carries
+	ErrInvalidSignature = errors.New("invalid message signature")
+	// ErrReplayedMessage is returned when a message is stale or was already received
+	ErrReplayedMessage = errors.New("replayed message")
+)
+
+// SignedMessage is what goes over the wire: the encoded Message signed by the sender.
+// The public key identifies the sender, so the receiver can check the message was not
+// forged before touching the Store. The signature covers the timestamp and the nonce
+// as well, so the receiver can reject the messages it already handled
+type SignedMessage struct {
+	PublicKey []byte
+	Payload   []byte
+	Signature []byte
+	// Timestamp is when the message was signed, in Unix nanoseconds
+	Timestamp int64
+	Nonce     []byte
+}
+
+// signedData returns the bytes covered by the signature
+func (m *SignedMessage) signedData() []byte {
+	b := binary.BigEndian.AppendUint64(nil, uint64(m.Timestamp))
+	b = append(b, m.Nonce...)
+	return append(b, m.Payload...)
+}
+
+// nonceCache remembers the nonces of the messages received until they are too old to
+// be accepted anyway
+type nonceCache struct {
+	mu     sync.Mutex
+	expiry map[string]time.Time
+}
+
+func newNonceCache() *nonceCache {
+	return &nonceCache{expiry: make(map[string]time.Time)}
+}
+
+// add records the nonce of the message signed at ts, reporting false if it was
+// already recorded
+func (c *nonceCache) add(nonce []byte, ts, now time.Time) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for n, expiry := range c.expiry {
+		if now.After(expiry) {
+			delete(c.expiry, n)
+		}
+	}
+	if _, ok := c.expiry[string(nonce)]; ok {
+		return false
+	}
+	c.expiry[string(nonce)] = ts.Add(maxMessageAge)
+
+	return true
+}
+
+// LoadOrCreateIdentity reads the PEM encoded Ed25519 private key from the file. If the
+// file doesn't exist, a new key is generated and saved, so the node keeps its identity
+// across restarts
+func LoadOrCreateIdentity(path string) (ed25519.PrivateKey, error) {
+	b, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return createIdentity(path)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(b)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM data found in %s", path)
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	privKey, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("%s holds a %T, not an Ed25519 key", path, key)
+	}
+
+	return privKey, nil
+}
+
+func createIdentity(path string) (ed25519.PrivateKey, error) {
+	_, privKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(privKey)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
+		return nil, err
+	}
+	b := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+	if err := os.WriteFile(path, b, 0o600); err != nil {
+		return nil, err
+	}
+
+	return privKey, nil
+}
+
+// nodeID returns the ID of the node owning the public key
+func nodeID(pubKey ed25519.PublicKey) string {
+	return hex.EncodeToString(pubKey)
+}
+
+// isNodeID reports if s has the format of a node ID
+func isNodeID(s string) bool {
+	b, err := hex.DecodeString(s)
+	return err == nil && len(b) == ed25519.PublicKeySize
+}
+
+// encodeMessage encodes the message with the codec and signs it with the node private key
+func (fs *FileServer) encodeMessage(codec Codec, msg *Message) ([]byte, error) {
+	payload, err := codec.Marshal(msg)
+	if err != nil {
+		return nil, err
+	}
+
+	signed, err := fs.signPayload(payload, time.Now())
+	if err != nil {
+		return nil, err
+	}
+
+	return codec.Marshal(signed)
+}
+
+// signPayload signs the encoded message along with the timestamp and a random nonce
+func (fs *FileServer) signPayload(payload []byte, ts time.Time) (*SignedMessage, error) {
+	nonce := make([]byte, nonceSize)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+
+	signed := &SignedMessage{
+		PublicKey: fs.PrivateKey.Public().(ed25519.PublicKey),
+		Payload:   payload,
+		Timestamp: ts.UnixNano(),
+		Nonce:     nonce,
+	}
+	signed.Signature = ed25519.Sign(fs.PrivateKey, signed.signedData())
+
+	return signed, nil
+}
+
+// decodeMessage verifies the signature of the message, returning it along with the
+// signed envelope holding the public key of the node that signed it
+func decodeMessage(codec Codec, b []byte) (*Message, *SignedMessage, error) {
+	var signed SignedMessage
+	if err := codec.Unmarshal(b, &signed); err != nil {
+		return nil, nil, err
+	}
+	if len(signed.PublicKey) != ed25519.PublicKeySize {
+		return nil, nil, ErrInvalidSignature
+	}
+	if !ed25519.Verify(signed.PublicKey, signed.signedData(), signed.Signature) {
+		return nil, nil, ErrInvalidSignature
+	}
+
+	var msg Message
+	if err := codec.Unmarshal(signed.Payload, &msg); err != nil {
+		return nil, nil, err
+	}
+
+	return &msg, &signed, nil
+}
+
+// verifySender checks the message was signed by the node it claims to come from: the
+// owner ID in the message must be the ID of the signer, and the signer must be the node
+// that identified itself during the handshake with the peer. It also rejects the
+// messages signed too long ago and the ones already received
+func (fs *FileServer) verifySender(from string, signed *SignedMessage, msg *Message) error {
+	id := nodeID(signed.PublicKey)
+
+	fs.peerLock.Lock()
+	peer, ok := fs.peers[from]
+	fs.peerLock.Unlock()
+	if ok && peer.Info().ID != "" && peer.Info().ID != id {
+		return fmt.Errorf("%w: message from peer %s signed by node %s, not %s", ErrForbidden, from, id, peer.Info().ID)
+	}
+
+	if owner := messageOwner(msg.Payload); owner != id {
+		return fmt.Errorf("%w: message %T for owner %s signed by node %s", ErrForbidden, msg.Payload, owner, id)
+	}
+
+	var (
+		now = time.Now()
+		ts  = time.Unix(0, signed.Timestamp)
+	)
+	if now.Sub(ts).Abs() > maxMessageAge {
+		return fmt.Errorf("%w: %w: message %T signed at %s", ErrForbidden, ErrReplayedMessage, msg.Payload, ts.Format(time.RFC3339))
+	}
+	if len(signed.Nonce) != nonceSize || !fs.nonces.add(signed.Nonce, ts, now) {
+		return fmt.Errorf("%w: %w: message %T with a reused nonce", ErrForbidden, ErrReplayedMessage, msg.Payload)
+	}
+
+	return nil
+}
+
+// checkMessage fails for the messages whose keys can't be used as a path, or whose
+// hashes are not SHA-256 hashes, before they reach the Store. The hashes name the
+// partial files, so they must not hold any path either
+func checkMessage(payload any) error {
+	switch v := payload.(type) {
+	case MessageStoreFile:
+		return errors.Join(checkKey(v.Key), checkHash(v.Hash))
+	case MessageGetFile:
+		if v.Hash == "" {
+			return checkKey(v.Key)
+		}
+		return errors.Join(checkKey(v.Key), checkHash(v.Hash))
+	case MessageGetOffset:
+		return errors.Join(checkKey(v.Key), checkHash(v.Hash))
+	case MessageHasChunks:
+		for _, hash := range v.Hashes {
+			if err := checkHash(hash); err != nil {
+				return err
+			}
+		}
+	case MessageStoreShard:
+		return checkKey(v.Key)
+	case MessageGetShards:
+		return checkKey(v.Key)
+	case MessageDeleteFile:
+		return checkKey(v.Key)
+	case MessageGetRange:
+		return checkKey(v.Key)
+	}
+	return nil
+}
+
+// checkHash fails when the hash is not a hex encoded SHA-256 hash, as hashChunk returns
+func checkHash(hash string) error {
+	if len(hash) != 2*sha256.Size || strings.Trim(hash, "0123456789abcdef") != "" {
+		return fmt.Errorf("%w: %q is not a SHA-256 hash", ErrInvalid, hash)
+	}
+	return nil
+}
+
+// messageOwner returns the ID of the node owning the data the message refers to
+func messageOwner(payload any) string {
+	switch v := payload.(type) {
+	case MessageStoreFile:
+		return v.ID
+	case MessageGetFile:
+		return v.ID
+	case MessageGetOffset:
+		return v.ID
+	case MessageHasChunks:
+		return v.ID
+	case MessageStoreShard:
+		return v.ID
+	case MessageGetShards:
+		return v.ID
+	case MessageDeleteFile:
+		return v.ID
+	case MessageGetRange:
+		return v.ID
+	case MessageLeave:
+		return v.ID
+	}
+	return ""
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"encoding/gob"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLoadOrCreateIdentity(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "keys", identityFile)
+
+	key, err := LoadOrCreateIdentity(path)
+	assert.Nil(t, err)
+
+	// The same key is loaded on the next start
+	loaded, err := LoadOrCreateIdentity(path)
+	assert.Nil(t, err)
+	assert.Equal(t, key, loaded)
+
+	info, err := os.Stat(path)
+	assert.Nil(t, err)
+	assert.Equal(t, os.FileMode(0o600), info.Mode().Perm())
+}
+
+func TestSignedMessage(t *testing.T) {
+	gob.Register(MessageGetFile{})
+	fs, err := NewFileServer(FileServerOpts{StorageRoot: t.TempDir()})
+	assert.Nil(t, err)
+
+	msg := &Message{Payload: MessageGetFile{ID: fs.ID, Key: "foo"}}
+	b, err := fs.encodeMessage(GOBCodec{}, msg)
+	assert.Nil(t, err)
+
+	decoded, signed, err := decodeMessage(GOBCodec{}, b)
+	assert.Nil(t, err)
+	assert.Equal(t, fs.ID, nodeID(signed.PublicKey))
+	assert.Equal(t, msg.Payload, decoded.Payload)
+	assert.Nil(t, fs.verifySender("", signed, decoded))
+
+	// The same message can't be handled twice
+	decoded, signed, err = decodeMessage(GOBCodec{}, b)
+	assert.Nil(t, err)
+	assert.ErrorIs(t, fs.verifySender("", signed, decoded), ErrReplayedMessage)
+
+	// Nor long after it was signed
+	payload, err := GOBCodec{}.Marshal(msg)
+	assert.Nil(t, err)
+	signed, err = fs.signPayload(payload, time.Now().Add(-2*maxMessageAge))
+	assert.Nil(t, err)
+	b, err = GOBCodec{}.Marshal(signed)
+	assert.Nil(t, err)
+	decoded, signed, err = decodeMessage(GOBCodec{}, b)
+	assert.Nil(t, err)
+	assert.ErrorIs(t, fs.verifySender("", signed, decoded), ErrReplayedMessage)
+
+	// The timestamp is signed, so it can't be refreshed
+	signed.Timestamp = time.Now().UnixNano()
+	b, err = GOBCodec{}.Marshal(signed)
+	assert.Nil(t, err)
+	_, _, err = decodeMessage(GOBCodec{}, b)
+	assert.ErrorIs(t, err, ErrInvalidSignature)
+
+	// A node can't send messages on behalf of another one
+	forged := &Message{Payload: MessageGetFile{ID: "another node", Key: "foo"}}
+	b, err = fs.encodeMessage(GOBCodec{}, forged)
+	assert.Nil(t, err)
+	decoded, signed, err = decodeMessage(GOBCodec{}, b)
+	assert.Nil(t, err)
+	assert.NotNil(t, fs.verifySender("", signed, decoded))
+
+	// Tampering with the message breaks the signature
+	b[len(b)/2] ^= 0xff
+	_, _, err = decodeMessage(GOBCodec{}, b)
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"hash"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// indexFile is the file in the storage root listing the files stored by the node
+const indexFile = "index.json"
+
+// FileInfo describes a file stored by the node
+type FileInfo struct {
+	Key     string
+	Size    int64
+	ModTime time.Time
+	// SHA256 is the hex encoded SHA-256 of the content
+	SHA256 string
+	// MD5 is the hex encoded MD5 of the content, which S3 clients expect as the ETag
+	MD5 string
+	// ETag replaces MD5 as the S3 ETag of the files uploaded in multiple parts
+	ETag string `json:",omitempty"`
+}
+
+func newFileInfo(key string, data []byte) FileInfo {
+	h := newFileHasher()
+	h.Write(data)
+	return h.info(key, int64(len(data)))
+}
+
+// fileHasher computes the hashes of a FileInfo from the content written to it, so
+// the content can be streamed instead of held in memory
+type fileHasher struct {
+	sha hash.Hash
+	md5 hash.Hash
+}
+
+func newFileHasher() *fileHasher {
+	return &fileHasher{sha: sha256.New(), md5: md5.New()}
+}
+
+func (h *fileHasher) Write(b []byte) (int, error) {
+	h.sha.Write(b)
+	return h.md5.Write(b)
+}
+
+// info returns the info of the content written so far
+func (h *fileHasher) info(key string, size int64) FileInfo {
+	return FileInfo{
+		Key:     key,
+		Size:    size,
+		ModTime: time.Now().UTC(),
+		SHA256:  hex.EncodeToString(h.sha.Sum(nil)),
+		MD5:     hex.EncodeToString(h.md5.Sum(nil)),
+	}
+}
+
+// FileIndex keeps the keys of the files stored by the node. The store only knows the
+// transformed paths, so the index is the only way to list the keys
+type FileIndex struct {
+	path string
+
+	mu    sync.Mutex
+	files map[string]FileInfo
+}
+
+// OpenFileIndex loads the index saved in the file, an empty index is returned when
+// the file doesn't exist yet
+func OpenFileIndex(path string) (*FileIndex, error) {
+	idx := &FileIndex{
+		path:  path,
+		files: make(map[string]FileInfo),
+	}
+
+	b, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return idx, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var files []FileInfo
+	if err := json.Unmarshal(b, &files); err != nil {
+		return nil, err
+	}
+	for _, info := range files {
+		idx.files[info.Key] = info
+	}
+
+	return idx, nil
+}
+
+func (idx *FileIndex) Get(key string) (FileInfo, bool) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	info, ok := idx.files[key]
+	return info, ok
+}
+
+// Put adds the file to the index, replacing the previous info of the key
+func (idx *FileIndex) Put(info FileInfo) error {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	idx.files[info.Key] = info
+	return idx.save()
+}
+
+func (idx *FileIndex) Remove(key string) error {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	if _, ok := idx.files[key]; !ok {
+		return nil
+	}
+	delete(idx.files, key)
+	return idx.save()
+}
+
+// List returns the files whose key starts with the prefix, sorted by key
+func (idx *FileIndex) List(prefix string) []FileInfo {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	var files []FileInfo
+	for key, info := range idx.files {
+		if strings.HasPrefix(key, prefix) {
+			files = append(files, info)
+		}
+	}
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].Key < files[j].Key
+	})
+
+	return files
+}
+
+// save writes the whole index to a temporary file which is then moved over the
+// index file, so a crash never leaves a truncated index behind
+func (idx *FileIndex) save() error {
+	files := make([]FileInfo, 0, len(idx.files))
+	for _, info := range idx.files {
+		files = append(files, info)
+	}
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].Key < files[j].Key
+	})
+	b, err := json.MarshalIndent(files, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(idx.path), os.ModePerm); err != nil {
+		return err
+	}
+	tmp := idx.path + ".tmp"
+	if err := os.WriteFile(tmp, b, 0o644); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, idx.path)
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFileIndex(t *testing.T) {
+	path := filepath.Join(t.TempDir(), indexFile)
+	idx, err := OpenFileIndex(path)
+	assert.Nil(t, err)
+
+	for _, key := range []string{"b", "a/2", "a/1"} {
+		assert.Nil(t, idx.Put(newFileInfo(key, []byte(key))))
+	}
+	assert.Nil(t, idx.Remove("b"))
+
+	// The index survives a restart
+	idx, err = OpenFileIndex(path)
+	assert.Nil(t, err)
+	files := idx.List("a/")
+	assert.Len(t, files, 2)
+	assert.Equal(t, "a/1", files[0].Key)
+	assert.Equal(t, int64(3), files[0].Size)
+	assert.Equal(t, "32a390517fcc6e43df5fc5f2c94699e1", files[0].MD5)
+
+	_, ok := idx.Get("b")
+	assert.False(t, ok)
+}
@@ -1,74 +1,262 @@
 package main
 
 import (
-	"bytes"
+	"context"
+	"crypto/ed25519"
+	"encoding/hex"
+	"flag"
 	"fmt"
-	"github.com/marcosvdn7/go-filestorage/p2p"
-	"io"
 	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
 	"strings"
+	"syscall"
 	"time"
+
+	"github.com/marcosvdn7/go-filestorage/p2p"
 )
 
+const usage = `Usage: gofs <command> [flags] [arguments]
+
+Commands:
+  serve            run a node
+  put <key> [file] store the file, or the standard input, under the key
+  get <key> [file] write the file to the standard output, or to a file
+  rm <key>         delete the file from the cluster
+  ls [prefix]      list the files whose key starts with the prefix
+  stat <key>       show the size, modification time and ETag of a file
+  cluster status   show the node and the peers it's connected to
+
+The client commands talk to the HTTP gateway of the nodes listed by the -node flag
+or the GOFS_NODES variable. Run gofs <command> -h for the flags of a command.
+`
+
 func main() {
-	s1 := makeServer(":3000", "")
-	s2 := makeServer(":4000", ":3000")
-	s3 := makeServer(":5000", ":3000", ":4000")
+	if len(os.Args) < 2 {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
 
-	go func() {
-		log.Fatal(s1.Start())
-	}()
-	time.Sleep(2 * time.Second)
+	var err error
+	switch cmd, args := os.Args[1], os.Args[2:]; cmd {
+	case "help", "-h", "-help", "--help":
+		fmt.Print(usage)
+		return
+	case "serve":
+		err = serve(args)
+	default:
+		err = runClient(context.Background(), cmd, args, os.Stdin, os.Stdout)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "gofs: %s\n", err)
+		os.Exit(1)
+	}
+}
 
-	go func() {
-		log.Fatal(s2.Start())
-	}()
-	time.Sleep(2 * time.Second)
+// serve runs a node until it receives an interrupt or a termination signal. The
+// flags override the config file and the environment variables
+func serve(args []string) error {
+	defaults := DefaultConfig()
+	flags := flag.NewFlagSet("serve", flag.ExitOnError)
+	var (
+		configFile = flags.String("config", os.Getenv(envPrefix+"_CONFIG"), "JSON config file, see gofs.example.json")
+		listenAddr = flags.String("listen", defaults.ListenAddress, "address of the peer to peer transport")
+		bootstrap  = flags.String("bootstrap", "", "comma separated addresses of the nodes to connect to")
+		root       = flags.String("root", "", "storage root, <port>_network when empty")
+		keyFile    = flags.String("key-file", "", "file of the encryption key, created when missing. <root>/"+encryptionKeyFile+" when empty")
+		httpAddr   = flags.String("http", defaults.HTTPAddress, "address of the HTTP gateway, disabled when empty")
+		s3Addr     = flags.String("s3", "", "address of the S3 compatible API, disabled when empty")
+		grpcAddr   = flags.String("grpc", "", "address of the gRPC API, disabled when empty")
+		metrics    = flags.String("metrics", "", "address of the Prometheus metrics, served at /metrics, disabled when empty")
+		timeout    = flags.Duration("shutdown-timeout", 30*time.Second, "how long the running operations are waited for on shutdown")
+	)
+	flags.Parse(args)
+	if flags.NArg() != 0 {
+		return fmt.Errorf("unexpected arguments: %s", strings.Join(flags.Args(), " "))
+	}
 
-	go func() {
-		log.Fatal(s3.Start())
-	}()
-	time.Sleep(2 * time.Second)
+	cfg, err := LoadConfig(*configFile)
+	if err != nil {
+		return err
+	}
+	flags.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "listen":
+			cfg.ListenAddress = *listenAddr
+		case "bootstrap":
+			cfg.BootstrapNodes = splitList(*bootstrap)
+		case "root":
+			cfg.StorageRoot = *root
+		case "key-file":
+			cfg.Security.EncryptionKeyFile = *keyFile
+		case "http":
+			cfg.HTTPAddress = *httpAddr
+		case "s3":
+			cfg.S3Address = *s3Addr
+		case "grpc":
+			cfg.GRPCAddress = *grpcAddr
+		case "metrics":
+			cfg.MetricsAddress = *metrics
+		}
+	})
 
-	for i := 0; i <= 20; i++ {
-		key := fmt.Sprintf("picture_%d.jpg", i)
-		data := bytes.NewReader([]byte("my big data file here!"))
-		s3.Store(key, data)
+	s, err := makeServer(cfg)
+	if err != nil {
+		return err
+	}
 
-		if err := s3.store.Delete(s3.ID, key); err != nil {
-			log.Fatal(err)
+	// The APIs are shut down before the node, so they stop taking requests first
+	var apis []interface{ Shutdown(context.Context) error }
+	for _, api := range []struct {
+		addr    string
+		handler http.Handler
+	}{
+		{cfg.HTTPAddress, NewGateway(s)},
+		{cfg.S3Address, NewS3Gateway(s)},
+		{cfg.MetricsAddress, NewMetricsHandler(s)},
+	} {
+		if api.addr == "" {
+			continue
 		}
+		srv := &http.Server{Addr: api.addr, Handler: api.handler}
+		apis = append(apis, srv)
+		go func() {
+			if err := srv.ListenAndServe(); err != http.ErrServerClosed {
+				log.Fatal(err)
+			}
+		}()
+	}
+	if cfg.GRPCAddress != "" {
+		g := NewGRPCServer(s)
+		apis = append(apis, g)
+		go func() {
+			if err := g.ListenAndServe(cfg.GRPCAddress); err != http.ErrServerClosed {
+				log.Fatal(err)
+			}
+		}()
+	}
 
-		r, err := s3.Get(key)
-		if err != nil {
-			log.Fatal(err)
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	shutdown := make(chan error, 1)
+	go func() {
+		<-ctx.Done()
+		log.Printf("[%s] shutting down, waiting up to %s for the running operations", cfg.ListenAddress, *timeout)
+		ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+		defer cancel()
+
+		for _, api := range apis {
+			api.Shutdown(ctx)
 		}
-		b, err := io.ReadAll(r)
+		shutdown <- s.Shutdown(ctx)
+	}()
 
-		fmt.Println(string(b))
+	if err := s.Start(); err != nil {
+		return err
 	}
+	return <-shutdown
 }
 
-func makeServer(listenAddr string, nodes ...string) *FileServer {
+// makeServer validates the config and creates the node it describes
+func makeServer(cfg Config) (*FileServer, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+
+	root := cfg.StorageRoot
+	if root == "" {
+		port := cfg.ListenAddress[strings.LastIndex(cfg.ListenAddress, ":")+1:]
+		root = port + "_network"
+	}
+	identityPath := cfg.IdentityFile
+	if identityPath == "" {
+		identityPath = filepath.Join(root, identityFile)
+	}
+	privKey, err := LoadOrCreateIdentity(identityPath)
+	if err != nil {
+		return nil, err
+	}
+	if id := nodeID(privKey.Public().(ed25519.PublicKey)); cfg.ID != "" && cfg.ID != id {
+		return nil, &ConfigError{Field: "id", Err: fmt.Errorf("the key in %s belongs to node %s", identityPath, id)}
+	}
+	keyPath := cfg.Security.EncryptionKeyFile
+	if keyPath == "" {
+		keyPath = filepath.Join(root, encryptionKeyFile)
+	}
+	encKey, err := LoadOrCreateEncryptionKey(keyPath)
+	if err != nil {
+		return nil, err
+	}
+
 	tcpOpts := p2p.TCPTransportOpts{
-		ListenAddress: listenAddr,
+		ListenAddress: cfg.ListenAddress,
 		HandshakeFunc: p2p.NOPHandshakeFunc,
 		Decoder:       p2p.DefaultDecoder{},
 	}
+	switch sec := cfg.Security; sec.Channel {
+	case "tls":
+		if tcpOpts.TLSConfig, err = p2p.LoadClusterTLSConfig(sec.TLSCAFile, sec.TLSCertFile, sec.TLSKeyFile); err != nil {
+			return nil, err
+		}
+	case "noise":
+		staticKey, err := p2p.NoiseKeyFromEd25519(privKey)
+		if err != nil {
+			return nil, err
+		}
+		noiseConfig := &p2p.NoiseConfig{StaticKey: staticKey}
+		for i, key := range sec.NoiseAllowedKeys {
+			b, err := hex.DecodeString(key)
+			if err != nil {
+				return nil, fmt.Errorf("security.noise_allowed_keys[%d]: %w", i, err)
+			}
+			noiseConfig.Allowed = append(noiseConfig.Allowed, b)
+		}
+		tcpOpts.NoiseConfig = noiseConfig
+		log.Printf("[%s] noise static key: %x", cfg.ListenAddress, staticKey.PublicKey().Bytes())
+	}
 	tcpTransport := p2p.NewTCPTransport(tcpOpts)
 
-	fListenAddr, _ := strings.CutPrefix(listenAddr, ":")
-
 	fileServerOpts := FileServerOpts{
-		EncryptionKey:       newEncryptionKey(),
-		StorageRoot:         fListenAddr + "_network",
+		PrivateKey:          privKey,
+		EncryptionKey:       encKey,
+		StorageRoot:         root,
 		PathTransformerFunc: CASPathTransformerFunc,
 		Transport:           tcpTransport,
-		BootstrapNodes:      nodes,
+		BootstrapNodes:      cfg.BootstrapNodes,
+		Codecs:              cfg.Codecs,
+		Quota:               cfg.Quota,
+	}
+	if cfg.PathTransformer == "default" {
+		fileServerOpts.PathTransformerFunc = DefaultPathTransformFunc
+	}
+	switch r := cfg.Replication; r.Mode {
+	case "erasure":
+		fileServerOpts.Erasure = &ErasureOpts{DataShards: r.DataShards, ParityShards: r.ParityShards}
+	case "chunked":
+		fileServerOpts.ChunkSize = r.ChunkSize
+	case "cdc":
+		fileServerOpts.CDC = &CDCOpts{MinSize: r.MinChunkSize, AvgSize: r.AvgChunkSize, MaxSize: r.MaxChunkSize}
 	}
 
-	s := NewFileServer(fileServerOpts)
+	s, err := NewFileServer(fileServerOpts)
+	if err != nil {
+		return nil, err
+	}
+	tcpTransport.HandshakeFunc = p2p.NewHandshakeFunc(s.NodeInfo(), cfg.Security.RequiredFeatures...)
 	tcpTransport.OnPeer = s.OnPeer
 
-	return s
+	return s, nil
+}
+
+// splitList splits the comma separated list, skipping the empty items
+func splitList(s string) []string {
+	var list []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
 }
@@ -0,0 +1,331 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"os"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// durationBuckets are the upper bounds, in seconds, of the buckets of the duration
+// histograms. They are the default buckets of the Prometheus client libraries
+var durationBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// labelSep joins the label values into the key of a sample. It can't be part of a
+// label value written by the server
+const labelSep = "\xff"
+
+// Metrics are the counters and histograms of a FileServer, exposed in the Prometheus
+// text format by the MetricsHandler. The gauges, like the connected peers, are read
+// from the server when the metrics are scraped
+type Metrics struct {
+	// bytesStored counts the bytes written to disk, by origin: "client" for the files
+	// stored on the node, "peer" for the files replicated by the peers
+	bytesStored *metricVec
+	// bytesServed counts the bytes read from disk, by destination: "client" for the
+	// files read from the node, "peer" for the files sent to the peers
+	bytesServed *metricVec
+	operations  *histogram
+	opErrors    *metricVec
+	// peerRequests times the requests received from the peers, by message type
+	peerRequests  *histogram
+	peerErrors    *metricVec
+	streams       *metricVec
+	activeStreams atomic.Int64
+	decodeErrors  *metricVec
+	// replication times how long the peers take to receive a file once it's written
+	// to the local disk, by replication mode
+	replication *histogram
+}
+
+func NewMetrics() *Metrics {
+	return &Metrics{
+		bytesStored:  newMetricVec("gofs_stored_bytes_total", "counter", "Bytes of the files written to disk.", "origin"),
+		bytesServed:  newMetricVec("gofs_served_bytes_total", "counter", "Bytes of the files read from disk.", "destination"),
+		operations:   newHistogram("gofs_operation_duration_seconds", "Duration of the operations of the node.", durationBuckets, "operation"),
+		opErrors:     newMetricVec("gofs_operation_errors_total", "counter", "Operations of the node which failed.", "operation"),
+		peerRequests: newHistogram("gofs_peer_request_duration_seconds", "Duration of the requests received from the peers.", durationBuckets, "message"),
+		peerErrors:   newMetricVec("gofs_peer_request_errors_total", "counter", "Requests received from the peers which failed.", "message"),
+		streams:      newMetricVec("gofs_streams_opened_total", "counter", "Streams opened with the peers.", "direction"),
+		decodeErrors: newMetricVec("gofs_decode_errors_total", "counter", "Messages from the peers which could not be decoded."),
+		replication:  newHistogram("gofs_replication_lag_seconds", "Time for a stored file to reach the peers.", durationBuckets, "mode"),
+	}
+}
+
+// observeOperation records the duration of the operation started at start and, when
+// *err is set, its failure. It's meant to be deferred, with err the named result of
+// the operation
+func (m *Metrics) observeOperation(operation string, start time.Time, err *error) {
+	m.operations.observe(time.Since(start).Seconds(), operation)
+	if *err != nil {
+		m.opErrors.add(1, operation)
+	}
+}
+
+// observePeerRequest records the duration and the outcome of the request of a peer
+func (m *Metrics) observePeerRequest(msg *Message, start time.Time, err error) {
+	name := reflect.TypeOf(msg.Payload).Name()
+	m.peerRequests.observe(time.Since(start).Seconds(), name)
+	if err != nil {
+		m.peerErrors.add(1, name)
+	}
+}
+
+// countingReader counts the bytes read from a file served to a client
+type countingReader struct {
+	io.Reader
+	counter *metricVec
+	label   string
+}
+
+func (r *countingReader) Read(b []byte) (int, error) {
+	n, err := r.Reader.Read(b)
+	r.counter.add(float64(n), r.label)
+	return n, err
+}
+
+// countServed wraps the reader of a file served to a client, so its bytes are counted
+// as they are read. The reader is still closable when r is
+func (m *Metrics) countServed(r io.Reader) io.ReadCloser {
+	counting := &countingReader{Reader: r, counter: m.bytesServed, label: "client"}
+	if c, ok := r.(io.Closer); ok {
+		return readCloser{Reader: counting, Closer: c}
+	}
+	return io.NopCloser(counting)
+}
+
+// metricVec is a counter or a gauge with a value for each combination of its labels
+type metricVec struct {
+	name, kind, help string
+	labels           []string
+
+	mu     sync.Mutex
+	values map[string]float64
+}
+
+func newMetricVec(name, kind, help string, labels ...string) *metricVec {
+	v := &metricVec{name: name, kind: kind, help: help, labels: labels, values: make(map[string]float64)}
+	// A metric without labels is exposed even before it's set
+	if len(labels) == 0 {
+		v.values[""] = 0
+	}
+	return v
+}
+
+func (v *metricVec) add(n float64, labelValues ...string) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	v.values[strings.Join(labelValues, labelSep)] += n
+}
+
+func (v *metricVec) set(n float64, labelValues ...string) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	v.values[strings.Join(labelValues, labelSep)] = n
+}
+
+func (v *metricVec) write(w io.Writer) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	writeHeader(w, v.name, v.kind, v.help)
+	for _, key := range sortedKeys(v.values) {
+		fmt.Fprintf(w, "%s%s %s\n", v.name, formatLabels(v.labels, key), formatValue(v.values[key]))
+	}
+}
+
+// histogram counts the observed values in cumulative buckets, for each combination of
+// its labels
+type histogram struct {
+	name, help string
+	buckets    []float64
+	labels     []string
+
+	mu     sync.Mutex
+	values map[string]*histogramValue
+}
+
+type histogramValue struct {
+	// counts holds the count of each bucket, the last one being the +Inf bucket
+	counts []uint64
+	sum    float64
+}
+
+func newHistogram(name, help string, buckets []float64, labels ...string) *histogram {
+	return &histogram{name: name, help: help, buckets: buckets, labels: labels, values: make(map[string]*histogramValue)}
+}
+
+func (h *histogram) observe(x float64, labelValues ...string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	key := strings.Join(labelValues, labelSep)
+	v, ok := h.values[key]
+	if !ok {
+		v = &histogramValue{counts: make([]uint64, len(h.buckets)+1)}
+		h.values[key] = v
+	}
+	v.counts[sort.SearchFloat64s(h.buckets, x)]++
+	v.sum += x
+}
+
+func (h *histogram) write(w io.Writer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	writeHeader(w, h.name, "histogram", h.help)
+	labels := append(append([]string(nil), h.labels...), "le")
+	for _, key := range sortedKeys(h.values) {
+		v := h.values[key]
+		var count uint64
+		for i, n := range v.counts {
+			count += n
+			le := math.Inf(1)
+			if i < len(h.buckets) {
+				le = h.buckets[i]
+			}
+			bucketKey := formatValue(le)
+			if len(h.labels) > 0 {
+				bucketKey = key + labelSep + bucketKey
+			}
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, formatLabels(labels, bucketKey), count)
+		}
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.name, formatLabels(h.labels, key), formatValue(v.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, formatLabels(h.labels, key), count)
+	}
+}
+
+func writeHeader(w io.Writer, name, kind, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n", name, help)
+	fmt.Fprintf(w, "# TYPE %s %s\n", name, kind)
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// formatLabels returns the labels of a sample, like {origin="peer"}, from the names of
+// the labels and the key of the sample
+func formatLabels(names []string, key string) string {
+	if len(names) == 0 {
+		return ""
+	}
+
+	values := strings.Split(key, labelSep)
+	pairs := make([]string, len(names))
+	for i, name := range names {
+		var value string
+		if i < len(values) {
+			value = values[i]
+		}
+		pairs[i] = fmt.Sprintf(`%s="%s"`, name, labelEscaper.Replace(value))
+	}
+
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func formatValue(x float64) string {
+	switch {
+	case math.IsInf(x, 1):
+		return "+Inf"
+	case math.IsInf(x, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(x, 'g', -1, 64)
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// MetricsHandler serves the metrics of the node in the Prometheus text format
+type MetricsHandler struct {
+	server *FileServer
+}
+
+func NewMetricsHandler(server *FileServer) *MetricsHandler {
+	return &MetricsHandler{server: server}
+}
+
+func (h *MetricsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/metrics" {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	buf := new(bytes.Buffer)
+	if err := h.server.writeMetrics(buf); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	w.Write(buf.Bytes())
+}
+
+// writeMetrics writes the metrics of the server along with the gauges read from its
+// current state
+func (fs *FileServer) writeMetrics(w io.Writer) error {
+	m := fs.metrics
+
+	peers := newMetricVec("gofs_peers", "gauge", "Peers connected to the node.")
+	peers.set(float64(len(fs.sortedPeers())))
+	knownPeers := newMetricVec("gofs_known_peers", "gauge", "Peers saved in the cluster state of the node.")
+	knownPeers.set(float64(len(fs.cluster.Peers())))
+	activeStreams := newMetricVec("gofs_active_streams", "gauge", "Streams of the peers being handled.")
+	activeStreams.set(float64(m.activeStreams.Load()))
+	files := newMetricVec("gofs_files", "gauge", "Files in the index of the node.")
+	files.set(float64(len(fs.index.List(""))))
+
+	storeBytes := newMetricVec("gofs_store_bytes", "gauge", "Bytes on disk of the files of each node.", "owner")
+	entries, err := os.ReadDir(fs.store.Root)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	for _, entry := range entries {
+		if !entry.IsDir() || !isNodeID(entry.Name()) {
+			continue
+		}
+		usage, err := fs.store.Usage(entry.Name())
+		if err != nil {
+			return err
+		}
+		storeBytes.set(float64(usage), entry.Name())
+	}
+
+	m.bytesStored.write(w)
+	m.bytesServed.write(w)
+	m.operations.write(w)
+	m.opErrors.write(w)
+	m.peerRequests.write(w)
+	m.peerErrors.write(w)
+	m.streams.write(w)
+	m.decodeErrors.write(w)
+	m.replication.write(w)
+	peers.write(w)
+	knownPeers.write(w)
+	activeStreams.write(w)
+	files.write(w)
+	storeBytes.write(w)
+
+	return nil
+}
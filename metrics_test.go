@@ -0,0 +1,97 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMetricsFormat(t *testing.T) {
+	buf := new(bytes.Buffer)
+
+	counter := newMetricVec("test_total", "counter", "A counter.", "name")
+	counter.add(2, `a"b`)
+	counter.add(1.5, "a")
+	counter.write(buf)
+
+	newMetricVec("test_unset", "gauge", "A gauge never set.").write(buf)
+
+	h := newHistogram("test_seconds", "A histogram.", []float64{.1, 1}, "op")
+	h.observe(.05, "get")
+	h.observe(.1, "get")
+	h.observe(3, "get")
+	h.write(buf)
+
+	assert.Equal(t, `# HELP test_total A counter.
+# TYPE test_total counter
+test_total{name="a"} 1.5
+test_total{name="a\"b"} 2
+# HELP test_unset A gauge never set.
+# TYPE test_unset gauge
+test_unset 0
+# HELP test_seconds A histogram.
+# TYPE test_seconds histogram
+test_seconds_bucket{op="get",le="0.1"} 2
+test_seconds_bucket{op="get",le="1"} 2
+test_seconds_bucket{op="get",le="+Inf"} 3
+test_seconds_sum{op="get"} 3.15
+test_seconds_count{op="get"} 3
+`, buf.String())
+}
+
+func TestMetricsHandler(t *testing.T) {
+	servers := newTestCluster(t, 2, FileServerOpts{}, nil)
+	s := servers[1]
+
+	data := bytes.Repeat([]byte("data"), 1000)
+	assert.Nil(t, s.Store("foo", bytes.NewReader(data)))
+	r, err := s.Get("foo")
+	assert.Nil(t, err)
+	_, err = io.ReadAll(r)
+	assert.Nil(t, err)
+	_, err = s.Get("missing")
+	assert.NotNil(t, err)
+
+	srv := httptest.NewServer(NewMetricsHandler(s))
+	defer srv.Close()
+	resp := doRequest(t, http.MethodGet, srv.URL+"/metrics", nil, nil)
+	b, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.True(t, strings.HasPrefix(resp.Header.Get("Content-Type"), "text/plain; version=0.0.4"))
+
+	metrics := string(b)
+	for _, line := range []string{
+		`gofs_stored_bytes_total{origin="client"} 4000`,
+		`gofs_served_bytes_total{destination="client"} 4000`,
+		`gofs_operation_duration_seconds_count{operation="get"} 2`,
+		`gofs_operation_errors_total{operation="get"} 1`,
+		`gofs_operation_duration_seconds_count{operation="store"} 1`,
+		`gofs_streams_opened_total{direction="outbound"} 3`,
+		`gofs_replication_lag_seconds_count{mode="full"} 1`,
+		`gofs_peers 1`,
+		`gofs_files 1`,
+		`gofs_store_bytes{owner="` + s.ID + `"} 4000`,
+	} {
+		assert.Contains(t, metrics, line+"\n")
+	}
+
+	// The peer was asked for the offset to resume from, then received the file and
+	// the request for the missing file
+	buf := new(bytes.Buffer)
+	assert.Nil(t, servers[0].writeMetrics(buf))
+	peerMetrics := buf.String()
+	assert.Contains(t, peerMetrics, `gofs_streams_opened_total{direction="inbound"} 3`)
+	assert.Contains(t, peerMetrics, `gofs_peer_request_duration_seconds_count{message="MessageStoreFile"} 1`)
+	assert.Contains(t, peerMetrics, `gofs_decode_errors_total 0`)
+
+	resp = doRequest(t, http.MethodGet, srv.URL+"/other", nil, nil)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+}
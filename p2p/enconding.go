@@ -1,7 +1,9 @@
 package p2p
 
 import (
+	"encoding/binary"
 	"encoding/gob"
+	"fmt"
 	"io"
 )
 
@@ -23,21 +25,26 @@ func (dec DefaultDecoder) Decode(r io.Reader, m *RPC) error {
 		return err
 	}
 
-	// In case of a stream we are not decoding what is being sent over the network
-	// We are just setting Stream true so we can handle it in the server
-	stream := peekBuf[0] == IncomingStream
-	if stream {
-		m.Stream = true
-		return nil
+	if peekBuf[0] != IncomingMessage {
+		return fmt.Errorf("unexpected message type %d", peekBuf[0])
 	}
 
-	buff := make([]byte, 1028)
-	n, err := r.Read(buff)
-	if err != nil {
+	// Messages are prefixed with their length, so we never read into the bytes
+	// of whatever is sent right after the message
+	var size uint32
+	if err := binary.Read(r, binary.LittleEndian, &size); err != nil {
+		return err
+	}
+	if size > MaxMessageSize {
+		return fmt.Errorf("message of %d bytes exceeds the limit of %d bytes", size, MaxMessageSize)
+	}
+
+	buff := make([]byte, size)
+	if _, err := io.ReadFull(r, buff); err != nil {
 		return err
 	}
 
-	m.Payload = buff[:n]
+	m.Payload = buff
 
 	return nil
 }
@@ -0,0 +1,345 @@
+package p2p
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ErrPartitioned is returned when sending to a node on the other side of a partition
+var ErrPartitioned = errors.New("node is partitioned")
+
+// FaultOpts configures the failures injected by the FaultInjector. The rates are
+// probabilities between 0 and 1
+type FaultOpts struct {
+	// Seed of the random source deciding which failures happen, so they are reproducible
+	Seed int64
+	// Latency is added before every message and new stream, plus up to Jitter
+	Latency time.Duration
+	Jitter  time.Duration
+	// DropRate is the probability of a message, or of a read or a write of a stream,
+	// being lost. A stream can't lose data, so it's reset on both sides instead, as it
+	// would be over a broken link
+	DropRate float64
+	// DuplicateRate is the probability of a message being delivered twice. For a stream,
+	// its header, the first write, is sent again on a new stream, so the remote handles
+	// the request twice
+	DuplicateRate float64
+	// CutRate is the probability of the connection being cut on each write to a stream
+	CutRate float64
+	// Bandwidth limits the bytes per second written to the streams of each node
+	Bandwidth int64
+}
+
+// FaultInjector decides the failures of the FaultTransports sharing it. Partitions
+// are set on the injector, so they apply to all the nodes at once
+type FaultInjector struct {
+	FaultOpts
+
+	lock sync.Mutex
+	rng  *rand.Rand
+	// groups maps the address of the nodes to their side of the partition, nodes not
+	// in the map are in the group 0
+	groups    map[string]int
+	lastGroup int
+	// cutAfter is how many bytes can still be written to the streams before the cut
+	// armed by CutAfter
+	cutAfter int64
+	cutArmed bool
+}
+
+// NewFaultInjector returns an injector with the random source seeded by opts.Seed
+func NewFaultInjector(opts FaultOpts) *FaultInjector {
+	return &FaultInjector{
+		FaultOpts: opts,
+		rng:       rand.New(rand.NewSource(opts.Seed)),
+		groups:    make(map[string]int),
+	}
+}
+
+// Partition isolates the given nodes from the rest. They can still talk to each other
+func (f *FaultInjector) Partition(addrs ...string) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	f.lastGroup++
+	for _, addr := range addrs {
+		f.groups[addr] = f.lastGroup
+	}
+}
+
+// Heal removes all the partitions
+func (f *FaultInjector) Heal() {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	clear(f.groups)
+}
+
+// CutAfter cuts the connection once, after n more bytes are written to the streams.
+// Unlike CutRate, the cut happens at a known point of the transfer
+func (f *FaultInjector) CutAfter(n int64) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	f.cutAfter = n
+	f.cutArmed = true
+}
+
+// cutPoint returns how many of the n bytes of a write go through before the cut armed
+// by CutAfter, or -1 when the write doesn't reach the cut
+func (f *FaultInjector) cutPoint(n int) int {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	if !f.cutArmed {
+		return -1
+	}
+	if int64(n) <= f.cutAfter {
+		f.cutAfter -= int64(n)
+		return -1
+	}
+	f.cutArmed = false
+	return int(f.cutAfter)
+}
+
+func (f *FaultInjector) partitioned(a, b string) bool {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	return f.groups[a] != f.groups[b]
+}
+
+// happens draws if a failure with the given rate happens
+func (f *FaultInjector) happens(rate float64) bool {
+	if rate <= 0 {
+		return false
+	}
+
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	return f.rng.Float64() < rate
+}
+
+func (f *FaultInjector) delay() {
+	d := f.Latency
+	if f.Jitter > 0 {
+		f.lock.Lock()
+		d += time.Duration(f.rng.Int63n(int64(f.Jitter)))
+		f.lock.Unlock()
+	}
+	if d > 0 {
+		time.Sleep(d)
+	}
+}
+
+// FaultTransport is a Transport decorator injecting the failures decided by the
+// FaultInjector. The peers must be wrapped as well, which is done by setting the
+// OnPeer of the decorated transport to the function returned by WrapOnPeer
+type FaultTransport struct {
+	Transport
+	faults *FaultInjector
+
+	lock sync.Mutex
+	// addrs maps the remote address of the peers to the address they listen on
+	addrs map[string]string
+	// free is when the bandwidth of the node is available again
+	free time.Time
+
+	consumeOnce sync.Once
+	rpcChan     chan RPC
+}
+
+// NewFaultTransport decorates the transport with the failures of the injector
+func NewFaultTransport(transport Transport, faults *FaultInjector) *FaultTransport {
+	return &FaultTransport{
+		Transport: transport,
+		faults:    faults,
+		addrs:     make(map[string]string),
+		rpcChan:   make(chan RPC, 1024),
+	}
+}
+
+// WrapOnPeer returns an OnPeer function wrapping the peers before calling onPeer
+func (t *FaultTransport) WrapOnPeer(onPeer func(Peer) error) func(Peer) error {
+	return func(p Peer) error {
+		addr := p.RemoteAddr().String()
+		if p.Info().ListenAddress != "" {
+			addr = p.Info().ListenAddress
+		}
+		t.lock.Lock()
+		t.addrs[p.RemoteAddr().String()] = addr
+		t.lock.Unlock()
+
+		if onPeer == nil {
+			return nil
+		}
+		return onPeer(&faultPeer{Peer: p, transport: t, addr: addr})
+	}
+}
+
+// Consume implements the Transport interface, dropping the messages coming from
+// the other side of a partition
+func (t *FaultTransport) Consume() <-chan RPC {
+	t.consumeOnce.Do(func() {
+		go func() {
+			for rpc := range t.Transport.Consume() {
+				if t.faults.partitioned(t.Addr(), t.listenAddr(rpc.From)) {
+					if rpc.Stream != nil {
+						rpc.Stream.Close()
+					}
+					continue
+				}
+				t.rpcChan <- rpc
+			}
+		}()
+	})
+
+	return t.rpcChan
+}
+
+func (t *FaultTransport) listenAddr(remoteAddr string) string {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if addr, ok := t.addrs[remoteAddr]; ok {
+		return addr
+	}
+	return remoteAddr
+}
+
+// throttle waits until the node has the bandwidth to write n bytes
+func (t *FaultTransport) throttle(n int) {
+	if t.faults.Bandwidth <= 0 {
+		return
+	}
+
+	t.lock.Lock()
+	start := t.free
+	if now := time.Now(); now.After(start) {
+		start = now
+	}
+	t.free = start.Add(time.Duration(int64(n) * int64(time.Second) / t.faults.Bandwidth))
+	free := t.free
+	t.lock.Unlock()
+
+	time.Sleep(time.Until(free))
+}
+
+// faultPeer injects the failures in the messages and streams sent to the peer
+type faultPeer struct {
+	Peer
+	transport *FaultTransport
+	// addr is the address the remote node listens on
+	addr string
+}
+
+func (p *faultPeer) checkPartition() error {
+	if p.transport.faults.partitioned(p.transport.Addr(), p.addr) {
+		return fmt.Errorf("%s: %w", p.addr, ErrPartitioned)
+	}
+	return nil
+}
+
+// Send implements the Peer interface
+func (p *faultPeer) Send(b []byte) error {
+	if err := p.checkPartition(); err != nil {
+		return err
+	}
+	faults := p.transport.faults
+	faults.delay()
+	if faults.happens(faults.DropRate) {
+		return nil
+	}
+	if faults.happens(faults.DuplicateRate) {
+		if err := p.Peer.Send(b); err != nil {
+			return err
+		}
+	}
+
+	return p.Peer.Send(b)
+}
+
+// OpenStream implements the Peer interface
+func (p *faultPeer) OpenStream() (Stream, error) {
+	if err := p.checkPartition(); err != nil {
+		return nil, err
+	}
+	faults := p.transport.faults
+	faults.delay()
+
+	st, err := p.Peer.OpenStream()
+	if err != nil {
+		return nil, err
+	}
+
+	return &faultStream{Stream: st, peer: p}, nil
+}
+
+// faultStream injects the failures in the reads and writes of a stream, limits the
+// bandwidth and cuts the connection in the middle of the writes
+type faultStream struct {
+	Stream
+	peer *faultPeer
+	// wrote tells if the header of the stream, its first write, was sent
+	wrote atomic.Bool
+}
+
+func (s *faultStream) Read(b []byte) (int, error) {
+	faults := s.peer.transport.faults
+	if faults.happens(faults.DropRate) {
+		return 0, s.drop()
+	}
+
+	return s.Stream.Read(b)
+}
+
+func (s *faultStream) Write(b []byte) (int, error) {
+	faults := s.peer.transport.faults
+	if faults.happens(faults.CutRate) {
+		return 0, s.cut()
+	}
+	if at := faults.cutPoint(len(b)); at >= 0 {
+		s.peer.transport.throttle(at)
+		n, _ := s.Stream.Write(b[:at])
+		return n, s.cut()
+	}
+	if faults.happens(faults.DropRate) {
+		return 0, s.drop()
+	}
+	if s.wrote.CompareAndSwap(false, true) && faults.happens(faults.DuplicateRate) {
+		s.duplicate(b)
+	}
+	s.peer.transport.throttle(len(b))
+
+	return s.Stream.Write(b)
+}
+
+// cut closes the connection of the peer, failing all its streams
+func (s *faultStream) cut() error {
+	s.peer.Close()
+	return fmt.Errorf("connection to %s cut: %w", s.peer.addr, ErrStreamClosed)
+}
+
+// drop resets the stream on both sides, as the data lost can't be recovered
+func (s *faultStream) drop() error {
+	s.Stream.Reset()
+	return fmt.Errorf("stream to %s dropped: %w", s.peer.addr, ErrStreamReset)
+}
+
+// duplicate sends the header again on a new stream. The response to the duplicate is
+// discarded, so the remote never blocks on it
+func (s *faultStream) duplicate(header []byte) {
+	st, err := s.peer.Peer.OpenStream()
+	if err != nil {
+		return
+	}
+	st.Write(header)
+	st.Close()
+	go io.Copy(io.Discard, st)
+}
@@ -0,0 +1,171 @@
+package p2p
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFaultTransportDropAndDuplicate(t *testing.T) {
+	var (
+		drop      = NewFaultInjector(FaultOpts{Seed: 1, DropRate: 1})
+		peer, srv = newFaultPair(t, drop)
+	)
+	assert.Nil(t, peer.Send(NewMessageFrame([]byte("lost"))))
+	assertNoMessage(t, srv)
+
+	var (
+		dup         = NewFaultInjector(FaultOpts{Seed: 1, DuplicateRate: 1})
+		peer2, srv2 = newFaultPair(t, dup)
+	)
+	assert.Nil(t, peer2.Send(NewMessageFrame([]byte("twice"))))
+	for i := 0; i < 2; i++ {
+		select {
+		case rpc := <-srv2.Consume():
+			assert.Equal(t, []byte("twice"), rpc.Payload)
+		case <-time.After(time.Second):
+			t.Fatal("duplicated message not received")
+		}
+	}
+}
+
+func TestFaultTransportStreamDropAndDuplicate(t *testing.T) {
+	var (
+		faults    = NewFaultInjector(FaultOpts{Seed: 1})
+		peer, srv = newFaultPair(t, faults)
+	)
+
+	// The stream is opened with its header, which is sent twice
+	faults.DuplicateRate = 1
+	st, err := peer.OpenStream()
+	assert.Nil(t, err)
+	_, err = st.Write(NewMessageFrame([]byte("request")))
+	assert.Nil(t, err)
+	var remotes []Stream
+	for i := 0; i < 2; i++ {
+		select {
+		case rpc := <-srv.Consume():
+			assert.Equal(t, []byte("request"), rpc.Payload)
+			remotes = append(remotes, rpc.Stream)
+		case <-time.After(time.Second):
+			t.Fatal("duplicated stream not received")
+		}
+	}
+
+	// A dropped write resets both sides of the stream
+	faults.DuplicateRate = 0
+	faults.DropRate = 1
+	_, err = st.Write([]byte("data"))
+	assert.ErrorIs(t, err, ErrStreamReset)
+	_, err = st.Read(make([]byte, 1))
+	assert.ErrorIs(t, err, ErrStreamReset)
+	remote := remotes[0]
+	if remotes[1].ID() == st.ID() {
+		remote = remotes[1]
+	}
+	assert.Eventually(t, func() bool {
+		_, err := remote.Write([]byte("response"))
+		return errors.Is(err, ErrStreamReset)
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestFaultTransportPartition(t *testing.T) {
+	var (
+		faults    = NewFaultInjector(FaultOpts{})
+		peer, srv = newFaultPair(t, faults)
+	)
+	faults.Partition(srv.Addr())
+	assert.ErrorIs(t, peer.Send(NewMessageFrame([]byte("Foo"))), ErrPartitioned)
+	_, err := peer.OpenStream()
+	assert.ErrorIs(t, err, ErrPartitioned)
+
+	faults.Heal()
+	assert.Nil(t, peer.Send(NewMessageFrame([]byte("Foo"))))
+	select {
+	case rpc := <-srv.Consume():
+		assert.Equal(t, []byte("Foo"), rpc.Payload)
+	case <-time.After(time.Second):
+		t.Fatal("message not received after healing the partition")
+	}
+}
+
+func TestFaultTransportBandwidthAndCut(t *testing.T) {
+	var (
+		faults  = NewFaultInjector(FaultOpts{Bandwidth: 100_000})
+		peer, _ = newFaultPair(t, faults)
+	)
+	st, err := peer.OpenStream()
+	assert.Nil(t, err)
+
+	start := time.Now()
+	_, err = st.Write(bytes.Repeat([]byte{1}, 20_000))
+	assert.Nil(t, err)
+	assert.GreaterOrEqual(t, time.Since(start), 150*time.Millisecond)
+
+	faults.CutRate = 1
+	_, err = st.Write([]byte{1})
+	assert.ErrorIs(t, err, ErrStreamClosed)
+}
+
+// newFaultPair connects a client to a server in a virtual network, both decorated by
+// the injector, returning the wrapped peer of the client and the server transport
+func newFaultPair(t *testing.T, faults *FaultInjector) (Peer, *FaultTransport) {
+	var (
+		network = NewMemoryNetwork()
+		server  = newMemoryTransport(network, "server")
+		client  = newMemoryTransport(network, "client")
+		fserver = NewFaultTransport(server, faults)
+		fclient = NewFaultTransport(client, faults)
+		peers   = make(chan Peer, 1)
+	)
+	server.OnPeer = fserver.WrapOnPeer(func(Peer) error { return nil })
+	client.OnPeer = fclient.WrapOnPeer(func(p Peer) error {
+		peers <- p
+		return nil
+	})
+	assert.Nil(t, fserver.ListenAndAccept())
+	assert.Nil(t, fclient.ListenAndAccept())
+	assert.Nil(t, fclient.Dial("server"))
+
+	select {
+	case p := <-peers:
+		return p, fserver
+	case <-time.After(time.Second):
+		t.Fatal("connection was not established")
+		return nil, nil
+	}
+}
+
+func assertNoMessage(t *testing.T, tr Transport) {
+	select {
+	case <-tr.Consume():
+		t.Fatal("dropped message was received")
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestFaultTransportCutAfter(t *testing.T) {
+	var (
+		faults  = NewFaultInjector(FaultOpts{})
+		peer, _ = newFaultPair(t, faults)
+	)
+	st, err := peer.OpenStream()
+	assert.Nil(t, err)
+
+	// The bytes before the cut are still written
+	faults.CutAfter(10)
+	_, err = st.Write(bytes.Repeat([]byte{1}, 6))
+	assert.Nil(t, err)
+	n, err := st.Write(bytes.Repeat([]byte{1}, 6))
+	assert.ErrorIs(t, err, ErrStreamClosed)
+	assert.Equal(t, 4, n)
+
+	select {
+	case <-peer.Done():
+	case <-time.After(time.Second):
+		t.Fatal("the peer is not done after the cut")
+	}
+}
@@ -1,11 +1,156 @@
 package p2p
 
-//// ErrInvalidHandshake is returned if the handshake between
-//// the remote and local node could not be established
-//var ErrInvalidHandshake = errors.New("invalid handshake")
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"slices"
+	"time"
+)
 
-type HandshakeFunc func(peer Peer) error
+// ProtocolVersion is the version of the protocol spoken by this node. Nodes only
+// connect to peers speaking the same version
+const ProtocolVersion = 1
 
-func NOPHandshakeFunc(peer Peer) error {
-	return nil
+// Features a node can announce during the handshake
+const (
+	FeatureChunking = "chunking"
+	FeatureErasure  = "erasure"
+	FeatureResume   = "resume"
+)
+
+// handshakeTimeout is how long the handshake can take before the connection is dropped
+const handshakeTimeout = 10 * time.Second
+
+// ErrIncompatiblePeer is returned (wrapped in a HandshakeError) when the handshake
+// between the remote and local node could not be established
+var ErrIncompatiblePeer = errors.New("incompatible peer")
+
+// HandshakeError holds the reason why a peer was rejected during the handshake
+type HandshakeError struct {
+	// Remote is the info announced by the rejected peer
+	Remote NodeInfo
+	Reason string
+}
+
+func (e *HandshakeError) Error() string {
+	return fmt.Sprintf("handshake with node %q failed: %s", e.Remote.ID, e.Reason)
+}
+
+func (e *HandshakeError) Unwrap() error {
+	return ErrIncompatiblePeer
+}
+
+// NodeInfo describes a node, it's exchanged by both sides during the handshake
+type NodeInfo struct {
+	ID            string
+	ListenAddress string
+	Version       int
+	Features      []string
+}
+
+// HasFeature reports if the feature is in the feature list
+func (n NodeInfo) HasFeature(feature string) bool {
+	return slices.Contains(n.Features, feature)
+}
+
+// HandshakeFunc runs over the connection before anything else is sent. It returns the
+// info of the remote node, with Features holding only the features supported by both
+// nodes. The info is available afterward through Peer.Info
+type HandshakeFunc func(conn net.Conn) (NodeInfo, error)
+
+// NOPHandshakeFunc accepts every connection without exchanging anything
+func NOPHandshakeFunc(conn net.Conn) (NodeInfo, error) {
+	return NodeInfo{}, nil
+}
+
+// NewHandshakeFunc returns a handshake that exchanges the local info with the remote
+// node. A peer is rejected with a HandshakeError when it speaks another protocol version,
+// has the same ID as the local node or doesn't support one of the required features.
+// Both sides send their verdict, so the rejected side also knows the reason
+func NewHandshakeFunc(local NodeInfo, required ...string) HandshakeFunc {
+	local.Version = ProtocolVersion
+
+	return func(conn net.Conn) (NodeInfo, error) {
+		conn.SetDeadline(time.Now().Add(handshakeTimeout))
+		defer conn.SetDeadline(time.Time{})
+
+		var remote NodeInfo
+		if err := exchange(conn, local, &remote); err != nil {
+			return remote, err
+		}
+
+		var reason string
+		switch {
+		case remote.Version != local.Version:
+			reason = fmt.Sprintf("protocol version %d, expected %d", remote.Version, local.Version)
+		case remote.ID != "" && remote.ID == local.ID:
+			reason = "connected to itself"
+		default:
+			for _, feature := range required {
+				if !remote.HasFeature(feature) {
+					reason = fmt.Sprintf("missing required feature %q", feature)
+					break
+				}
+			}
+		}
+
+		var remoteReason string
+		if err := exchange(conn, reason, &remoteReason); err != nil {
+			return remote, err
+		}
+		if reason != "" {
+			return remote, &HandshakeError{Remote: remote, Reason: reason}
+		}
+		if remoteReason != "" {
+			return remote, &HandshakeError{Remote: remote, Reason: "rejected by remote: " + remoteReason}
+		}
+
+		var negotiated []string
+		for _, feature := range local.Features {
+			if remote.HasFeature(feature) {
+				negotiated = append(negotiated, feature)
+			}
+		}
+		remote.Features = negotiated
+
+		return remote, nil
+	}
+}
+
+// exchange sends the local value while reading the remote one. Both values are JSON
+// encoded and prefixed with their length, so nodes not written in Go can handshake too
+func exchange(conn net.Conn, local any, remote any) error {
+	b, err := json.Marshal(local)
+	if err != nil {
+		return err
+	}
+
+	// Write in the background, as both sides send before reading
+	errCh := make(chan error, 1)
+	go func() {
+		frame := binary.LittleEndian.AppendUint32(nil, uint32(len(b)))
+		_, err := conn.Write(append(frame, b...))
+		errCh <- err
+	}()
+
+	var size uint32
+	if err := binary.Read(conn, binary.LittleEndian, &size); err != nil {
+		return err
+	}
+	if size > MaxMessageSize {
+		return fmt.Errorf("handshake of %d bytes exceeds the limit of %d bytes", size, MaxMessageSize)
+	}
+	buf := make([]byte, size)
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		return err
+	}
+	if err := json.Unmarshal(buf, remote); err != nil {
+		return err
+	}
+
+	return <-errCh
 }
@@ -0,0 +1,66 @@
+package p2p
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHandshakeNegotiatesFeatures(t *testing.T) {
+	var (
+		a = NewHandshakeFunc(NodeInfo{ID: "a", ListenAddress: ":3000", Features: []string{FeatureChunking, FeatureErasure}})
+		b = NewHandshakeFunc(NodeInfo{ID: "b", ListenAddress: ":4000", Features: []string{FeatureErasure, FeatureResume}})
+	)
+	infoA, infoB, errA, errB := runHandshake(a, b)
+	assert.Nil(t, errA)
+	assert.Nil(t, errB)
+
+	assert.Equal(t, "b", infoA.ID)
+	assert.Equal(t, ":4000", infoA.ListenAddress)
+	assert.Equal(t, ProtocolVersion, infoA.Version)
+	assert.Equal(t, []string{FeatureErasure}, infoA.Features)
+	assert.Equal(t, "a", infoB.ID)
+	assert.Equal(t, []string{FeatureErasure}, infoB.Features)
+}
+
+func TestHandshakeRejectsIncompatiblePeer(t *testing.T) {
+	var (
+		a = NewHandshakeFunc(NodeInfo{ID: "a"}, FeatureResume)
+		b = NewHandshakeFunc(NodeInfo{ID: "b", Features: []string{FeatureChunking}})
+	)
+	_, _, errA, errB := runHandshake(a, b)
+
+	// Both sides fail, the rejected one knowing why
+	var hsErr *HandshakeError
+	assert.ErrorAs(t, errA, &hsErr)
+	assert.Equal(t, "b", hsErr.Remote.ID)
+	assert.ErrorIs(t, errA, ErrIncompatiblePeer)
+	assert.ErrorIs(t, errB, ErrIncompatiblePeer)
+	assert.ErrorContains(t, errB, "rejected by remote")
+
+	// Connecting to itself is rejected as well
+	_, _, errA, errB = runHandshake(a, NewHandshakeFunc(NodeInfo{ID: "a", Features: []string{FeatureResume}}))
+	assert.ErrorIs(t, errA, ErrIncompatiblePeer)
+	assert.ErrorIs(t, errB, ErrIncompatiblePeer)
+}
+
+func runHandshake(a, b HandshakeFunc) (NodeInfo, NodeInfo, error, error) {
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+
+	type result struct {
+		info NodeInfo
+		err  error
+	}
+	done := make(chan result, 1)
+	go func() {
+		info, err := b(c2)
+		done <- result{info, err}
+	}()
+	infoA, errA := a(c1)
+	r := <-done
+
+	return infoA, r.info, errA, r.err
+}
@@ -0,0 +1,177 @@
+package p2p
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+)
+
+// MemoryNetwork is a virtual network shared by the memory transports of a process.
+// Nodes are reachable by the address they listen on, without opening any port
+type MemoryNetwork struct {
+	lock      sync.Mutex
+	listeners map[string]*MemoryTransport
+}
+
+// NewMemoryNetwork returns an empty virtual network
+func NewMemoryNetwork() *MemoryNetwork {
+	return &MemoryNetwork{
+		listeners: make(map[string]*MemoryTransport),
+	}
+}
+
+// Addrs returns the sorted addresses of the transports listening in the network
+func (n *MemoryNetwork) Addrs() []string {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	addrs := make([]string, 0, len(n.listeners))
+	for addr := range n.listeners {
+		addrs = append(addrs, addr)
+	}
+	sort.Strings(addrs)
+
+	return addrs
+}
+
+func (n *MemoryNetwork) listen(t *MemoryTransport) error {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	if _, ok := n.listeners[t.ListenAddress]; ok {
+		return fmt.Errorf("address %s already in use", t.ListenAddress)
+	}
+	n.listeners[t.ListenAddress] = t
+
+	return nil
+}
+
+func (n *MemoryNetwork) lookup(addr string) (*MemoryTransport, bool) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	t, ok := n.listeners[addr]
+	return t, ok
+}
+
+func (n *MemoryNetwork) remove(addr string) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	delete(n.listeners, addr)
+}
+
+// MemoryTransportOpts holds the options to initialize the memory transport
+type MemoryTransportOpts struct {
+	// Address the transport listens on in the virtual network
+	ListenAddress string
+	Network       *MemoryNetwork
+	HandshakeFunc HandshakeFunc
+	Decoder       Decoder
+	OnPeer        func(peer Peer) error
+}
+
+// MemoryTransport implements the Transport interface over in process connections
+// created by net.Pipe, so many nodes can run in a single test without real ports
+type MemoryTransport struct {
+	MemoryTransportOpts
+	rpcChan chan RPC
+
+	lock  sync.Mutex
+	conns map[net.Conn]struct{}
+}
+
+// NewMemoryTransport initializes the memory transport in the given network
+func NewMemoryTransport(opts MemoryTransportOpts) *MemoryTransport {
+	return &MemoryTransport{
+		MemoryTransportOpts: opts,
+		rpcChan:             make(chan RPC, 1024),
+		conns:               make(map[net.Conn]struct{}),
+	}
+}
+
+// Addr implements the Transport interface
+func (t *MemoryTransport) Addr() string {
+	return t.ListenAddress
+}
+
+// Consume implements the Transport interface
+func (t *MemoryTransport) Consume() <-chan RPC {
+	return t.rpcChan
+}
+
+// ListenAndAccept implements the Transport interface, registering the transport
+// in the network so the other nodes can dial it
+func (t *MemoryTransport) ListenAndAccept() error {
+	return t.Network.listen(t)
+}
+
+// Dial implements the Transport interface. The connection is handed to the remote
+// transport right away, as there's no accept loop in the virtual network
+func (t *MemoryTransport) Dial(addr string) error {
+	remote, ok := t.Network.lookup(addr)
+	if !ok {
+		return fmt.Errorf("dial %s: connection refused", addr)
+	}
+
+	c1, c2 := net.Pipe()
+	go t.handleConn(&memoryConn{Conn: c1, local: t.ListenAddress, remote: addr}, true)
+	go remote.handleConn(&memoryConn{Conn: c2, local: addr, remote: t.ListenAddress}, false)
+
+	return nil
+}
+
+// Close implements the Transport interface, removing the transport from the network
+// and dropping its connections
+func (t *MemoryTransport) Close() error {
+	t.Network.remove(t.ListenAddress)
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	for conn := range t.conns {
+		conn.Close()
+	}
+
+	return nil
+}
+
+func (t *MemoryTransport) handleConn(conn net.Conn, outbound bool) {
+	t.lock.Lock()
+	t.conns[conn] = struct{}{}
+	t.lock.Unlock()
+
+	err := serveConn(conn, outbound, t.HandshakeFunc, t.Decoder, t.OnPeer, t.rpcChan)
+	logDroppedConn(err)
+
+	t.lock.Lock()
+	delete(t.conns, conn)
+	t.lock.Unlock()
+	conn.Close()
+}
+
+// memoryConn gives the addresses of the virtual network to the piped connection,
+// the remote address of an accepted connection is the address of the dialing node
+type memoryConn struct {
+	net.Conn
+	local, remote string
+}
+
+func (c *memoryConn) LocalAddr() net.Addr {
+	return memoryAddr(c.local)
+}
+
+func (c *memoryConn) RemoteAddr() net.Addr {
+	return memoryAddr(c.remote)
+}
+
+// memoryAddr implements net.Addr for the virtual network
+type memoryAddr string
+
+func (a memoryAddr) Network() string {
+	return "memory"
+}
+
+func (a memoryAddr) String() string {
+	return string(a)
+}
@@ -0,0 +1,70 @@
+package p2p
+
+import (
+	"io"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMemoryTransport(t *testing.T) {
+	var (
+		network = NewMemoryNetwork()
+		server  = newMemoryTransport(network, "node-1")
+		client  = newMemoryTransport(network, "node-2")
+		peers   = make(chan Peer, 1)
+	)
+	client.OnPeer = func(p Peer) error {
+		peers <- p
+		return nil
+	}
+	assert.Nil(t, server.ListenAndAccept())
+	assert.Nil(t, client.ListenAndAccept())
+	assert.Equal(t, []string{"node-1", "node-2"}, network.Addrs())
+	assert.NotNil(t, client.Dial("node-3"))
+
+	assert.Nil(t, client.Dial("node-1"))
+
+	var peer Peer
+	select {
+	case peer = <-peers:
+		assert.Equal(t, "node-1", peer.RemoteAddr().String())
+	case <-time.After(time.Second):
+		t.Fatal("memory connection was not established")
+	}
+
+	st, err := peer.OpenStream()
+	assert.Nil(t, err)
+	go func() {
+		st.Write(NewMessageFrame([]byte("Foo not Bar")))
+		st.Write([]byte("stream data"))
+		st.Close()
+	}()
+
+	select {
+	case rpc := <-server.Consume():
+		assert.Equal(t, "node-2", rpc.From)
+		assert.Equal(t, []byte("Foo not Bar"), rpc.Payload)
+		data, err := io.ReadAll(rpc.Stream)
+		assert.Nil(t, err)
+		assert.Equal(t, []byte("stream data"), data)
+	case <-time.After(time.Second):
+		t.Fatal("stream not received")
+	}
+
+	// Closing the transport drops its connections
+	assert.Nil(t, server.Close())
+	assert.Equal(t, []string{"node-2"}, network.Addrs())
+	_, err = st.Read(make([]byte, 1))
+	assert.NotNil(t, err)
+}
+
+func newMemoryTransport(network *MemoryNetwork, addr string) *MemoryTransport {
+	return NewMemoryTransport(MemoryTransportOpts{
+		ListenAddress: addr,
+		Network:       network,
+		HandshakeFunc: NOPHandshakeFunc,
+		Decoder:       DefaultDecoder{},
+	})
+}
@@ -1,14 +1,28 @@
 package p2p
 
-const (
-	IncomingMessage = 0x1
-	IncomingStream  = 0x2
-)
+import "encoding/binary"
+
+const IncomingMessage = 0x1
+
+// MaxMessageSize is the biggest message payload accepted by the DefaultDecoder
+const MaxMessageSize = 4 << 20
+
+// NewMessageFrame returns the payload prefixed with the IncomingMessage byte and
+// the payload length, as expected by the DefaultDecoder
+func NewMessageFrame(payload []byte) []byte {
+	frame := make([]byte, 5+len(payload))
+	frame[0] = IncomingMessage
+	binary.LittleEndian.PutUint32(frame[1:], uint32(len(payload)))
+	copy(frame[5:], payload)
+	return frame
+}
 
 // RPC holds any data that is being transported between two
 // nodes in the network
 type RPC struct {
 	From    string
 	Payload []byte
-	Stream  bool
+	// Stream is set when the message was sent as the header of a new stream.
+	// The data of the request is read from it and the response is written to it
+	Stream Stream
 }
@@ -0,0 +1,391 @@
+package p2p
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// Frame types sent over a multiplexed connection
+const (
+	frameMessage byte = iota + 1 // control message, not bound to any stream
+	frameOpen                    // opens a new stream
+	frameData                    // data of a stream
+	frameClose                   // the sender won't write anything else to the stream
+	frameWindow                  // the receiver consumed data and the sender can write more
+	frameReset                   // the stream is aborted, its data is discarded on both sides
+)
+
+const (
+	// frameHeaderSize is the size of type (1 byte) + stream id (4 bytes) + payload length (4 bytes)
+	frameHeaderSize = 9
+	// maxDataFrame is the biggest payload of a data frame, big writes are split so
+	// the streams take turns on the connection
+	maxDataFrame = 32 * 1024
+	// streamWindow is how many bytes can be sent to a stream before the receiver reads them
+	streamWindow = 256 * 1024
+)
+
+var (
+	// ErrStreamClosed is returned when writing to a stream that was already closed
+	ErrStreamClosed = errors.New("stream closed")
+	// ErrStreamReset is returned when using a stream reset by either side
+	ErrStreamReset = errors.New("stream reset")
+)
+
+// Stream is a logical connection multiplexed with other streams over a single peer
+// connection. Close signals the remote that nothing else will be written, the stream
+// can still be read until the remote closes it as well. Reset aborts the stream on
+// both sides instead
+type Stream interface {
+	io.ReadWriteCloser
+	ID() uint32
+	Reset() error
+}
+
+// session multiplexes the control messages and the streams over a connection. Every
+// stream has its own flow control window, so a slow stream never blocks the others
+type session struct {
+	conn io.ReadWriteCloser
+
+	writeLock sync.Mutex
+
+	lock    sync.Mutex
+	streams map[uint32]*stream
+	// The dialer side uses odd stream ids and the accepting side even ids, so
+	// both sides can open streams without colliding
+	nextID uint32
+	err    error
+	// done is closed once the session is closed
+	done chan struct{}
+}
+
+func newSession(conn io.ReadWriteCloser, outbound bool) *session {
+	s := &session{
+		conn:    conn,
+		streams: make(map[uint32]*stream),
+		nextID:  2,
+		done:    make(chan struct{}),
+	}
+	if outbound {
+		s.nextID = 1
+	}
+	return s
+}
+
+// sendMessage sends a control message
+func (s *session) sendMessage(payload []byte) error {
+	if len(payload) > MaxMessageSize+5 {
+		return fmt.Errorf("message of %d bytes exceeds the limit of %d bytes", len(payload), MaxMessageSize)
+	}
+	return s.writeFrame(frameMessage, 0, payload)
+}
+
+// open creates a new stream and notifies the remote about it
+func (s *session) open() (*stream, error) {
+	s.lock.Lock()
+	if s.err != nil {
+		s.lock.Unlock()
+		return nil, s.err
+	}
+	st := newStream(s, s.nextID)
+	s.streams[st.id] = st
+	s.nextID += 2
+	s.lock.Unlock()
+
+	if err := s.writeFrame(frameOpen, st.id, nil); err != nil {
+		return nil, err
+	}
+	return st, nil
+}
+
+// serve reads the frames from the connection until it fails, calling onMessage for
+// every control message and onStream for every stream opened by the remote.
+// onStream must not block, as no other frame is read while it runs
+func (s *session) serve(onMessage func(payload []byte), onStream func(st Stream)) (err error) {
+	defer func() {
+		s.close(err)
+	}()
+
+	header := make([]byte, frameHeaderSize)
+	for {
+		if _, err := io.ReadFull(s.conn, header); err != nil {
+			return err
+		}
+		var (
+			typ    = header[0]
+			id     = binary.LittleEndian.Uint32(header[1:5])
+			length = binary.LittleEndian.Uint32(header[5:9])
+		)
+		if length > MaxMessageSize+5 {
+			return fmt.Errorf("frame of %d bytes exceeds the limit of %d bytes", length, MaxMessageSize)
+		}
+		payload := make([]byte, length)
+		if _, err := io.ReadFull(s.conn, payload); err != nil {
+			return err
+		}
+
+		switch typ {
+		case frameMessage:
+			onMessage(payload)
+		case frameOpen:
+			st := newStream(s, id)
+			s.lock.Lock()
+			s.streams[id] = st
+			s.lock.Unlock()
+			onStream(st)
+		case frameData:
+			// Frames of streams already closed on both sides are dropped
+			if st := s.stream(id); st != nil {
+				if err := st.push(payload); err != nil {
+					return err
+				}
+			}
+		case frameClose:
+			if st := s.stream(id); st != nil {
+				st.remoteClose()
+			}
+		case frameWindow:
+			if st := s.stream(id); st != nil && len(payload) == 4 {
+				st.grow(binary.LittleEndian.Uint32(payload))
+			}
+		case frameReset:
+			if st := s.stream(id); st != nil {
+				st.reset()
+			}
+		default:
+			return fmt.Errorf("unknown frame type %d", typ)
+		}
+	}
+}
+
+func (s *session) writeFrame(typ byte, id uint32, payload []byte) error {
+	frame := make([]byte, frameHeaderSize+len(payload))
+	frame[0] = typ
+	binary.LittleEndian.PutUint32(frame[1:5], id)
+	binary.LittleEndian.PutUint32(frame[5:9], uint32(len(payload)))
+	copy(frame[frameHeaderSize:], payload)
+
+	s.writeLock.Lock()
+	defer s.writeLock.Unlock()
+
+	_, err := s.conn.Write(frame)
+	return err
+}
+
+func (s *session) stream(id uint32) *stream {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.streams[id]
+}
+
+func (s *session) remove(id uint32) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	delete(s.streams, id)
+}
+
+// close closes the connection and fails every stream still open
+func (s *session) close(err error) {
+	if err == nil || errors.Is(err, io.EOF) {
+		err = io.ErrUnexpectedEOF
+	}
+
+	s.lock.Lock()
+	if s.err == nil {
+		s.err = err
+		close(s.done)
+	}
+	streams := s.streams
+	s.streams = make(map[uint32]*stream)
+	s.lock.Unlock()
+
+	s.conn.Close()
+	for _, st := range streams {
+		st.fail(err)
+	}
+}
+
+type stream struct {
+	id   uint32
+	sess *session
+
+	lock sync.Mutex
+	cond *sync.Cond
+	buf  bytes.Buffer
+	// consumed is the amount of bytes read since the last window update
+	consumed   uint32
+	sendWindow uint32
+
+	localClosed  bool
+	remoteClosed bool
+	err          error
+}
+
+func newStream(sess *session, id uint32) *stream {
+	st := &stream{
+		id:         id,
+		sess:       sess,
+		sendWindow: streamWindow,
+	}
+	st.cond = sync.NewCond(&st.lock)
+	return st
+}
+
+func (st *stream) ID() uint32 {
+	return st.id
+}
+
+// Read blocks until there is data in the stream, returning io.EOF once the
+// remote closed the stream and all its data was read
+func (st *stream) Read(p []byte) (int, error) {
+	st.lock.Lock()
+	for st.buf.Len() == 0 && !st.remoteClosed && st.err == nil {
+		st.cond.Wait()
+	}
+	if st.buf.Len() == 0 {
+		err := st.err
+		if st.remoteClosed && !errors.Is(err, ErrStreamReset) {
+			err = io.EOF
+		}
+		st.lock.Unlock()
+		return 0, err
+	}
+
+	n, _ := st.buf.Read(p)
+	st.consumed += uint32(n)
+
+	// Let the remote know it can send more data once half of the window was read
+	var update uint32
+	if st.consumed >= streamWindow/2 && !st.remoteClosed {
+		update, st.consumed = st.consumed, 0
+	}
+	st.lock.Unlock()
+
+	if update > 0 {
+		payload := make([]byte, 4)
+		binary.LittleEndian.PutUint32(payload, update)
+		if err := st.sess.writeFrame(frameWindow, st.id, payload); err != nil {
+			return n, err
+		}
+	}
+
+	return n, nil
+}
+
+// Write splits the data in frames, blocking while the remote window is full
+func (st *stream) Write(p []byte) (int, error) {
+	var written int
+	for len(p) > 0 {
+		st.lock.Lock()
+		for st.sendWindow == 0 && !st.localClosed && st.err == nil {
+			st.cond.Wait()
+		}
+		if st.err != nil {
+			err := st.err
+			st.lock.Unlock()
+			return written, err
+		}
+		if st.localClosed {
+			st.lock.Unlock()
+			return written, ErrStreamClosed
+		}
+		n := min(len(p), int(st.sendWindow), maxDataFrame)
+		st.sendWindow -= uint32(n)
+		st.lock.Unlock()
+
+		if err := st.sess.writeFrame(frameData, st.id, p[:n]); err != nil {
+			return written, err
+		}
+		written += n
+		p = p[n:]
+	}
+
+	return written, nil
+}
+
+func (st *stream) Close() error {
+	st.lock.Lock()
+	if st.localClosed || errors.Is(st.err, ErrStreamReset) {
+		st.lock.Unlock()
+		return nil
+	}
+	st.localClosed = true
+	done := st.remoteClosed
+	st.cond.Broadcast()
+	st.lock.Unlock()
+
+	if done {
+		st.sess.remove(st.id)
+	}
+	return st.sess.writeFrame(frameClose, st.id, nil)
+}
+
+// Reset discards the data of the stream and tells the remote to do the same, so both
+// sides fail with ErrStreamReset
+func (st *stream) Reset() error {
+	st.lock.Lock()
+	if errors.Is(st.err, ErrStreamReset) {
+		st.lock.Unlock()
+		return nil
+	}
+	st.lock.Unlock()
+
+	st.reset()
+	return st.sess.writeFrame(frameReset, st.id, nil)
+}
+
+// reset fails the stream with ErrStreamReset and forgets it
+func (st *stream) reset() {
+	st.lock.Lock()
+	st.err = ErrStreamReset
+	st.buf.Reset()
+	st.cond.Broadcast()
+	st.lock.Unlock()
+
+	st.sess.remove(st.id)
+}
+
+func (st *stream) push(data []byte) error {
+	st.lock.Lock()
+	defer st.lock.Unlock()
+
+	if st.buf.Len()+len(data) > streamWindow {
+		return fmt.Errorf("stream %d exceeded its window", st.id)
+	}
+	st.buf.Write(data)
+	st.cond.Broadcast()
+
+	return nil
+}
+
+func (st *stream) remoteClose() {
+	st.lock.Lock()
+	st.remoteClosed = true
+	done := st.localClosed
+	st.cond.Broadcast()
+	st.lock.Unlock()
+
+	if done {
+		st.sess.remove(st.id)
+	}
+}
+
+func (st *stream) grow(n uint32) {
+	st.lock.Lock()
+	defer st.lock.Unlock()
+
+	st.sendWindow += n
+	st.cond.Broadcast()
+}
+
+func (st *stream) fail(err error) {
+	st.lock.Lock()
+	defer st.lock.Unlock()
+
+	st.err = err
+	st.cond.Broadcast()
+}
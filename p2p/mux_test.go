@@ -0,0 +1,112 @@
+package p2p
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSessionConcurrentStreams(t *testing.T) {
+	c1, c2 := net.Pipe()
+	var (
+		client   = newSession(c1, true)
+		server   = newSession(c2, false)
+		messages = make(chan []byte, 1)
+	)
+	go client.serve(func([]byte) {}, func(Stream) {})
+	// The server echoes every stream back to the client
+	go server.serve(
+		func(payload []byte) { messages <- payload },
+		func(st Stream) {
+			go func() {
+				defer st.Close()
+				io.Copy(st, st)
+			}()
+		},
+	)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			// Bigger than the window, so the flow control has to kick in
+			data := bytes.Repeat([]byte{byte(i)}, streamWindow*2+100)
+			st, err := client.open()
+			assert.Nil(t, err)
+
+			go func() {
+				st.Write(data)
+				st.Close()
+			}()
+			echo, err := io.ReadAll(st)
+			assert.Nil(t, err)
+			assert.Equal(t, data, echo)
+		}(i)
+	}
+
+	// Control messages are not blocked by the streams in flight
+	assert.Nil(t, client.sendMessage([]byte("Foo not Bar")))
+	assert.Equal(t, []byte("Foo not Bar"), <-messages)
+
+	wg.Wait()
+}
+
+func TestSessionCloseFailsStreams(t *testing.T) {
+	c1, c2 := net.Pipe()
+	var (
+		client = newSession(c1, true)
+		server = newSession(c2, false)
+	)
+	go client.serve(func([]byte) {}, func(Stream) {})
+	go server.serve(func([]byte) {}, func(Stream) {})
+
+	st, err := client.open()
+	assert.Nil(t, err)
+
+	// Dropping the connection fails the streams still open
+	c2.Close()
+	_, err = st.Read(make([]byte, 1))
+	assert.ErrorIs(t, err, io.ErrUnexpectedEOF)
+}
+
+func TestSessionResetStream(t *testing.T) {
+	c1, c2 := net.Pipe()
+	var (
+		client  = newSession(c1, true)
+		server  = newSession(c2, false)
+		streams = make(chan Stream, 1)
+	)
+	go client.serve(func([]byte) {}, func(Stream) {})
+	go server.serve(func([]byte) {}, func(st Stream) { streams <- st })
+
+	st, err := client.open()
+	assert.Nil(t, err)
+	_, err = st.Write([]byte("discarded"))
+	assert.Nil(t, err)
+	remote := <-streams
+
+	// Both sides fail, even with data still buffered or a half-closed stream
+	assert.Nil(t, st.Close())
+	assert.Nil(t, st.Reset())
+	_, err = st.Read(make([]byte, 1))
+	assert.ErrorIs(t, err, ErrStreamReset)
+	assert.Eventually(t, func() bool {
+		_, err := remote.Read(make([]byte, 1))
+		return errors.Is(err, ErrStreamReset)
+	}, time.Second, 10*time.Millisecond)
+	_, err = remote.Write([]byte("Foo"))
+	assert.ErrorIs(t, err, ErrStreamReset)
+
+	// The session still works
+	st, err = client.open()
+	assert.Nil(t, err)
+	assert.Nil(t, st.Close())
+}
@@ -0,0 +1,438 @@
+package p2p
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// noiseProtocolName is the full name of the handshake implemented below, see
+// https://noiseprotocol.org/noise.html
+const noiseProtocolName = "Noise_XX_25519_AESGCM_SHA256"
+
+const (
+	// noiseMaxMessage is the maximum size of a Noise message, tag included
+	noiseMaxMessage = 65535
+	noiseTagSize    = 16
+	noiseKeySize    = 32
+)
+
+// ErrUntrustedPeer is returned when the static key of the remote node is not allowed
+var ErrUntrustedPeer = errors.New("peer static key is not trusted")
+
+// NoiseConfig configures the Noise secure channel. It's an alternative to TLS for
+// deployments without a PKI: nodes authenticate each other by their static keys
+type NoiseConfig struct {
+	// StaticKey is the X25519 key identifying the local node
+	StaticKey *ecdh.PrivateKey
+	// Allowed holds the static public keys of the trusted nodes. Peers whose key is not
+	// in the list are rejected
+	Allowed [][]byte
+}
+
+// GenerateNoiseKey returns a new static key for the Noise secure channel
+func GenerateNoiseKey() (*ecdh.PrivateKey, error) {
+	return ecdh.X25519().GenerateKey(rand.Reader)
+}
+
+// NoiseKeyFromEd25519 derives the Noise static key from the Ed25519 identity of a node,
+// the same way Ed25519 derives its scalar, so a node needs a single persistent key
+func NoiseKeyFromEd25519(key ed25519.PrivateKey) (*ecdh.PrivateKey, error) {
+	digest := sha512.Sum512(key.Seed())
+	return ecdh.X25519().NewPrivateKey(digest[:noiseKeySize])
+}
+
+func (c *NoiseConfig) allowed(key []byte) bool {
+	for _, k := range c.Allowed {
+		if bytes.Equal(k, key) {
+			return true
+		}
+	}
+	return false
+}
+
+// NoiseConn is a connection encrypted by the keys negotiated in the Noise handshake
+type NoiseConn struct {
+	net.Conn
+
+	remoteStatic []byte
+
+	readLock sync.Mutex
+	recv     *noiseCipher
+	// pending holds the decrypted bytes not read yet
+	pending []byte
+
+	writeLock sync.Mutex
+	send      *noiseCipher
+}
+
+// RemoteStaticKey returns the static public key of the remote node
+func (c *NoiseConn) RemoteStaticKey() []byte {
+	return c.remoteStatic
+}
+
+// NewNoiseConn runs the Noise XX handshake over the connection, as the initiator when
+// the connection was dialed. Both nodes learn and check the static key of each other,
+// the returned connection encrypts everything sent afterward
+func NewNoiseConn(conn net.Conn, initiator bool, cfg *NoiseConfig) (*NoiseConn, error) {
+	conn.SetDeadline(time.Now().Add(handshakeTimeout))
+	defer conn.SetDeadline(time.Time{})
+
+	hs := newNoiseHandshake(cfg.StaticKey)
+
+	var err error
+	if initiator {
+		err = hs.initiate(conn)
+	} else {
+		err = hs.respond(conn)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("noise handshake: %w", err)
+	}
+	if !cfg.allowed(hs.rs) {
+		return nil, ErrUntrustedPeer
+	}
+
+	c1, c2 := hs.split()
+	nc := &NoiseConn{
+		Conn:         conn,
+		remoteStatic: hs.rs,
+		send:         c1,
+		recv:         c2,
+	}
+	if !initiator {
+		nc.send, nc.recv = c2, c1
+	}
+
+	return nc, nil
+}
+
+// Read implements the net.Conn interface, decrypting the messages from the remote node
+func (c *NoiseConn) Read(b []byte) (int, error) {
+	c.readLock.Lock()
+	defer c.readLock.Unlock()
+
+	if len(c.pending) == 0 {
+		msg, err := readNoiseMessage(c.Conn)
+		if err != nil {
+			return 0, err
+		}
+		if c.pending, err = c.recv.decrypt(nil, msg); err != nil {
+			return 0, err
+		}
+	}
+
+	n := copy(b, c.pending)
+	c.pending = c.pending[n:]
+
+	return n, nil
+}
+
+// Write implements the net.Conn interface, encrypting the data in messages of at most
+// noiseMaxMessage bytes
+func (c *NoiseConn) Write(b []byte) (int, error) {
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+
+	var written int
+	for len(b) > 0 {
+		size := min(len(b), noiseMaxMessage-noiseTagSize)
+		if err := writeNoiseMessage(c.Conn, c.send.encrypt(nil, b[:size])); err != nil {
+			return written, err
+		}
+		written += size
+		b = b[size:]
+	}
+
+	return written, nil
+}
+
+// noiseHandshake holds the symmetric and key state of the handshake
+type noiseHandshake struct {
+	// ck is the chaining key and h the hash of everything sent so far
+	ck, h []byte
+	c     *noiseCipher
+
+	s  *ecdh.PrivateKey
+	e  *ecdh.PrivateKey
+	re []byte
+	rs []byte
+}
+
+func newNoiseHandshake(s *ecdh.PrivateKey) *noiseHandshake {
+	h := make([]byte, sha256.Size)
+	copy(h, noiseProtocolName)
+
+	hs := &noiseHandshake{ck: h, h: h, s: s}
+	// Empty prologue
+	hs.mixHash(nil)
+
+	return hs
+}
+
+// initiate runs the initiator side of the XX pattern:
+//
+//	-> e
+//	<- e, ee, s, es
+//	-> s, se
+func (hs *noiseHandshake) initiate(conn net.Conn) (err error) {
+	if hs.e, err = GenerateNoiseKey(); err != nil {
+		return err
+	}
+	msg := hs.e.PublicKey().Bytes()
+	hs.mixHash(msg)
+	if err := writeNoiseMessage(conn, hs.encryptAndHash(msg, nil)); err != nil {
+		return err
+	}
+
+	msg, err = readNoiseMessage(conn)
+	if err != nil {
+		return err
+	}
+	if msg, err = hs.readEphemeral(msg); err != nil {
+		return err
+	}
+	if err := hs.mixDH(hs.e, hs.re); err != nil {
+		return err
+	}
+	if msg, err = hs.readStatic(msg); err != nil {
+		return err
+	}
+	if err := hs.mixDH(hs.e, hs.rs); err != nil {
+		return err
+	}
+	if _, err := hs.decryptAndHash(msg); err != nil {
+		return err
+	}
+
+	msg = hs.encryptAndHash(nil, hs.s.PublicKey().Bytes())
+	if err := hs.mixDH(hs.s, hs.re); err != nil {
+		return err
+	}
+	msg = append(msg, hs.encryptAndHash(nil, nil)...)
+
+	return writeNoiseMessage(conn, msg)
+}
+
+// respond runs the responder side of the XX pattern
+func (hs *noiseHandshake) respond(conn net.Conn) (err error) {
+	msg, err := readNoiseMessage(conn)
+	if err != nil {
+		return err
+	}
+	if msg, err = hs.readEphemeral(msg); err != nil {
+		return err
+	}
+	if _, err := hs.decryptAndHash(msg); err != nil {
+		return err
+	}
+
+	if hs.e, err = GenerateNoiseKey(); err != nil {
+		return err
+	}
+	msg = hs.e.PublicKey().Bytes()
+	hs.mixHash(msg)
+	if err := hs.mixDH(hs.e, hs.re); err != nil {
+		return err
+	}
+	msg = hs.encryptAndHash(msg, hs.s.PublicKey().Bytes())
+	if err := hs.mixDH(hs.s, hs.re); err != nil {
+		return err
+	}
+	if err := writeNoiseMessage(conn, hs.encryptAndHash(msg, nil)); err != nil {
+		return err
+	}
+
+	if msg, err = readNoiseMessage(conn); err != nil {
+		return err
+	}
+	if msg, err = hs.readStatic(msg); err != nil {
+		return err
+	}
+	if err := hs.mixDH(hs.e, hs.rs); err != nil {
+		return err
+	}
+	_, err = hs.decryptAndHash(msg)
+
+	return err
+}
+
+// readEphemeral reads the ephemeral key of the remote node, returning the rest of the message
+func (hs *noiseHandshake) readEphemeral(msg []byte) ([]byte, error) {
+	if len(msg) < noiseKeySize {
+		return nil, io.ErrUnexpectedEOF
+	}
+	hs.re = msg[:noiseKeySize]
+	hs.mixHash(hs.re)
+
+	return msg[noiseKeySize:], nil
+}
+
+// readStatic decrypts the static key of the remote node, returning the rest of the message
+func (hs *noiseHandshake) readStatic(msg []byte) ([]byte, error) {
+	size := noiseKeySize + noiseTagSize
+	if len(msg) < size {
+		return nil, io.ErrUnexpectedEOF
+	}
+	rs, err := hs.decryptAndHash(msg[:size])
+	if err != nil {
+		return nil, err
+	}
+	hs.rs = rs
+
+	return msg[size:], nil
+}
+
+func (hs *noiseHandshake) mixHash(data []byte) {
+	h := sha256.New()
+	h.Write(hs.h)
+	h.Write(data)
+	hs.h = h.Sum(nil)
+}
+
+// mixDH mixes the shared secret of the local and remote keys into the chaining key
+func (hs *noiseHandshake) mixDH(local *ecdh.PrivateKey, remote []byte) error {
+	pub, err := ecdh.X25519().NewPublicKey(remote)
+	if err != nil {
+		return err
+	}
+	secret, err := local.ECDH(pub)
+	if err != nil {
+		return err
+	}
+
+	var k []byte
+	hs.ck, k = noiseHKDF(hs.ck, secret)
+	hs.c = newNoiseCipher(k)
+
+	return nil
+}
+
+// encryptAndHash appends the encrypted plaintext to dst. Before the first key is mixed
+// in, the plaintext is sent as is
+func (hs *noiseHandshake) encryptAndHash(dst, plaintext []byte) []byte {
+	ciphertext := plaintext
+	if hs.c != nil {
+		ciphertext = hs.c.seal(nil, plaintext, hs.h)
+	}
+	hs.mixHash(ciphertext)
+
+	return append(dst, ciphertext...)
+}
+
+func (hs *noiseHandshake) decryptAndHash(ciphertext []byte) ([]byte, error) {
+	plaintext := ciphertext
+	if hs.c != nil {
+		var err error
+		if plaintext, err = hs.c.open(nil, ciphertext, hs.h); err != nil {
+			return nil, err
+		}
+	}
+	hs.mixHash(ciphertext)
+
+	return plaintext, nil
+}
+
+// split returns the ciphers for the messages sent by the initiator and by the responder
+func (hs *noiseHandshake) split() (*noiseCipher, *noiseCipher) {
+	k1, k2 := noiseHKDF(hs.ck, nil)
+	return newNoiseCipher(k1), newNoiseCipher(k2)
+}
+
+// noiseHKDF derives two keys from the chaining key and the input key material
+func noiseHKDF(ck, ikm []byte) ([]byte, []byte) {
+	mac := hmac.New(sha256.New, ck)
+	mac.Write(ikm)
+	prk := mac.Sum(nil)
+
+	mac = hmac.New(sha256.New, prk)
+	mac.Write([]byte{0x01})
+	out1 := mac.Sum(nil)
+
+	mac = hmac.New(sha256.New, prk)
+	mac.Write(out1)
+	mac.Write([]byte{0x02})
+	out2 := mac.Sum(nil)
+
+	return out1, out2
+}
+
+// noiseCipher is AES-GCM with the counter nonce used by Noise
+type noiseCipher struct {
+	aead  cipher.AEAD
+	nonce uint64
+}
+
+func newNoiseCipher(key []byte) *noiseCipher {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		// The key always has 32 bytes
+		panic(err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		panic(err)
+	}
+
+	return &noiseCipher{aead: aead}
+}
+
+func (c *noiseCipher) nextNonce() []byte {
+	nonce := make([]byte, c.aead.NonceSize())
+	binary.BigEndian.PutUint64(nonce[4:], c.nonce)
+	c.nonce++
+
+	return nonce
+}
+
+func (c *noiseCipher) seal(dst, plaintext, ad []byte) []byte {
+	return c.aead.Seal(dst, c.nextNonce(), plaintext, ad)
+}
+
+func (c *noiseCipher) open(dst, ciphertext, ad []byte) ([]byte, error) {
+	return c.aead.Open(dst, c.nextNonce(), ciphertext, ad)
+}
+
+func (c *noiseCipher) encrypt(dst, plaintext []byte) []byte {
+	return c.seal(dst, plaintext, nil)
+}
+
+func (c *noiseCipher) decrypt(dst, ciphertext []byte) ([]byte, error) {
+	return c.open(dst, ciphertext, nil)
+}
+
+// writeNoiseMessage writes the message prefixed by its 2 bytes big endian length
+func writeNoiseMessage(w io.Writer, msg []byte) error {
+	if len(msg) > noiseMaxMessage {
+		return fmt.Errorf("noise message of %d bytes exceeds the limit of %d bytes", len(msg), noiseMaxMessage)
+	}
+	_, err := w.Write(append(binary.BigEndian.AppendUint16(nil, uint16(len(msg))), msg...))
+
+	return err
+}
+
+func readNoiseMessage(r io.Reader) ([]byte, error) {
+	var size uint16
+	if err := binary.Read(r, binary.BigEndian, &size); err != nil {
+		return nil, err
+	}
+	msg := make([]byte, size)
+	if _, err := io.ReadFull(r, msg); err != nil {
+		return nil, err
+	}
+
+	return msg, nil
+}
@@ -0,0 +1,125 @@
+package p2p
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNoiseConn(t *testing.T) {
+	var (
+		k1, _ = GenerateNoiseKey()
+		k2, _ = GenerateNoiseKey()
+		cfg1  = &NoiseConfig{StaticKey: k1, Allowed: [][]byte{k2.PublicKey().Bytes()}}
+		cfg2  = &NoiseConfig{StaticKey: k2, Allowed: [][]byte{k1.PublicKey().Bytes()}}
+	)
+	c1, c2, err1, err2 := runNoiseHandshake(cfg1, cfg2)
+	assert.Nil(t, err1)
+	assert.Nil(t, err2)
+	assert.Equal(t, k2.PublicKey().Bytes(), c1.RemoteStaticKey())
+	assert.Equal(t, k1.PublicKey().Bytes(), c2.RemoteStaticKey())
+
+	// Bigger than a single Noise message
+	data := make([]byte, noiseMaxMessage*3)
+	rand.Read(data)
+	go func() {
+		c1.Write(data)
+		c1.Close()
+	}()
+	received, err := io.ReadAll(c2)
+	assert.Nil(t, err)
+	assert.Equal(t, data, received)
+}
+
+func TestNoiseConnRejectsUntrustedPeer(t *testing.T) {
+	var (
+		k1, _    = GenerateNoiseKey()
+		k2, _    = GenerateNoiseKey()
+		other, _ = GenerateNoiseKey()
+		cfg1     = &NoiseConfig{StaticKey: k1, Allowed: [][]byte{other.PublicKey().Bytes()}}
+		cfg2     = &NoiseConfig{StaticKey: k2, Allowed: [][]byte{k1.PublicKey().Bytes()}}
+	)
+	_, _, err1, _ := runNoiseHandshake(cfg1, cfg2)
+	assert.ErrorIs(t, err1, ErrUntrustedPeer)
+}
+
+func TestNoiseKeyFromEd25519(t *testing.T) {
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	assert.Nil(t, err)
+
+	k1, err := NoiseKeyFromEd25519(priv)
+	assert.Nil(t, err)
+	k2, err := NoiseKeyFromEd25519(priv)
+	assert.Nil(t, err)
+	assert.True(t, k1.Equal(k2))
+}
+
+func TestNoiseTransport(t *testing.T) {
+	var (
+		k1, _  = GenerateNoiseKey()
+		k2, _  = GenerateNoiseKey()
+		server = newNoiseTransport("127.0.0.1:8085", &NoiseConfig{StaticKey: k1, Allowed: [][]byte{k2.PublicKey().Bytes()}})
+		client = newNoiseTransport("127.0.0.1:8086", &NoiseConfig{StaticKey: k2, Allowed: [][]byte{k1.PublicKey().Bytes()}})
+		peers  = make(chan Peer, 1)
+	)
+	client.OnPeer = func(p Peer) error {
+		peers <- p
+		return nil
+	}
+	assert.Nil(t, server.ListenAndAccept())
+	defer server.Close()
+
+	assert.Nil(t, client.Dial(server.Addr()))
+
+	select {
+	case p := <-peers:
+		assert.Nil(t, p.Send(NewMessageFrame([]byte("Foo not Bar"))))
+	case <-time.After(2 * time.Second):
+		t.Fatal("Noise connection was not established")
+	}
+
+	select {
+	case rpc := <-server.Consume():
+		assert.Equal(t, []byte("Foo not Bar"), rpc.Payload)
+	case <-time.After(2 * time.Second):
+		t.Fatal("message not received over Noise")
+	}
+}
+
+func newNoiseTransport(addr string, cfg *NoiseConfig) *TCPTransport {
+	return NewTCPTransport(TCPTransportOpts{
+		ListenAddress: addr,
+		HandshakeFunc: NOPHandshakeFunc,
+		Decoder:       DefaultDecoder{},
+		NoiseConfig:   cfg,
+	})
+}
+
+func runNoiseHandshake(cfg1, cfg2 *NoiseConfig) (*NoiseConn, *NoiseConn, error, error) {
+	p1, p2 := net.Pipe()
+
+	type result struct {
+		conn *NoiseConn
+		err  error
+	}
+	done := make(chan result, 1)
+	go func() {
+		conn, err := NewNoiseConn(p2, false, cfg2)
+		if err != nil {
+			p2.Close()
+		}
+		done <- result{conn, err}
+	}()
+	c1, err1 := NewNoiseConn(p1, true, cfg1)
+	if err1 != nil {
+		p1.Close()
+	}
+	r := <-done
+
+	return c1, r.conn, err1, r.err
+}
@@ -1,14 +1,15 @@
 package p2p
 
 import (
+	"crypto/tls"
 	"errors"
-	"fmt"
 	"log"
 	"net"
-	"sync"
+	"time"
 )
 
-// TCPPeer represents the remote node over a TCP established connection
+// TCPPeer represents the remote node over an established connection. Besides TCP, it
+// serves the connections of the other transports, as it only relies on net.Conn
 type TCPPeer struct {
 	// Underlying connection of the peer. In this case, a TCP connectoin
 	net.Conn
@@ -17,32 +18,45 @@ type TCPPeer struct {
 	// If we accept and retrieve a connection => outbound == false
 	outbound bool
 
-	wg *sync.WaitGroup
-}
+	// session multiplexes the messages and streams over the connection
+	session *session
 
-func (p *TCPPeer) CloseStream() {
-	p.wg.Done()
+	// info is the remote node info negotiated during the handshake
+	info NodeInfo
 }
 
 // NewTCPPeer initialize Peer with connection and outbound
 func NewTCPPeer(conn net.Conn, outbound bool) *TCPPeer {
-	return &TCPPeer{conn, outbound, &sync.WaitGroup{}}
+	return &TCPPeer{
+		Conn:     conn,
+		outbound: outbound,
+		session:  newSession(conn, outbound),
+	}
+}
+
+// Info implements the Peer interface
+func (p *TCPPeer) Info() NodeInfo {
+	return p.info
 }
 
-//// Close implements the Peer interface method Close()
-//func (tp *TCPPeer) Close() error {
-//	return tp.conn.Close()
-//}
-//
-//// RemoteAddr implements the Peer interface method RemoteAddr()
-//// it will return the remote address of its underlying connection
-//func (tp *TCPPeer) RemoteAddr() net.Addr {
-//	return tp.conn.RemoteAddr()
-//}
+// Outbound implements the Peer interface
+func (p *TCPPeer) Outbound() bool {
+	return p.outbound
+}
 
+// Send implements the Peer interface, sending a control message
 func (p *TCPPeer) Send(data []byte) error {
-	_, err := p.Conn.Write(data)
-	return err
+	return p.session.sendMessage(data)
+}
+
+// OpenStream implements the Peer interface
+func (p *TCPPeer) OpenStream() (Stream, error) {
+	return p.session.open()
+}
+
+// Done implements the Peer interface
+func (p *TCPPeer) Done() <-chan struct{} {
+	return p.session.done
 }
 
 // TCPTransportOpts holds the options to initialize the transporter
@@ -54,6 +68,12 @@ type TCPTransportOpts struct {
 	// Responsible to decode the data we receive through the connection
 	Decoder Decoder
 	OnPeer  func(peer Peer) error
+	// TLSConfig enables TLS on both the dialed and the accepted connections.
+	// See NewClusterTLSConfig for a mutual TLS config with a pinned cluster CA
+	TLSConfig *tls.Config
+	// NoiseConfig enables the Noise secure channel, an alternative to TLS when
+	// there's no PKI. Only the nodes with an allowed static key can connect
+	NoiseConfig *NoiseConfig
 }
 
 // TCPTransport contains info and functions to handle the listening
@@ -97,6 +117,9 @@ func (t *TCPTransport) Dial(addr string) error {
 	if err != nil {
 		return err
 	}
+	if t.TLSConfig != nil {
+		conn = tls.Client(conn, t.TLSConfig)
+	}
 
 	go t.handleConn(conn, true)
 
@@ -110,6 +133,9 @@ func (t *TCPTransport) ListenAndAccept() (err error) {
 	if err != nil {
 		return
 	}
+	if t.TLSConfig != nil {
+		t.listener = tls.NewListener(t.listener, t.TLSConfig)
+	}
 	go t.starAcceptLoop()
 
 	log.Printf("TCP transport listening on port: %s\n", t.ListenAddress)
@@ -117,6 +143,9 @@ func (t *TCPTransport) ListenAndAccept() (err error) {
 	return
 }
 
+// acceptRetryDelay is how long the accept loop waits after a failed Accept
+const acceptRetryDelay = 50 * time.Millisecond
+
 // starAcceptLoop accept and establish connection with listener
 func (t *TCPTransport) starAcceptLoop() {
 	for {
@@ -126,53 +155,40 @@ func (t *TCPTransport) starAcceptLoop() {
 			return
 		}
 		if err != nil {
-			fmt.Printf("TCP accept loop error: %s\n", err)
+			// Errors like running out of file descriptors go away after a while,
+			// so the loop waits a moment instead of spinning on them
+			log.Printf("TCP accept loop error: %s\n", err)
+			time.Sleep(acceptRetryDelay)
+			continue
 		}
 
 		go t.handleConn(conn, false)
 	}
 }
 
-// handleConn defer the closing of the connection, create a new peer, calls the
-// handshake to see if connection is ok and calls the onPeer function.
+// handleConn defer the closing of the connection, secures it with TLS or Noise when
+// enabled and serves it until it fails
 func (t *TCPTransport) handleConn(conn net.Conn, outbound bool) {
 	var err error
 	defer func() {
-		fmt.Printf("Dropping peer connection: %+v\n", err)
+		logDroppedConn(err)
 		conn.Close()
 	}()
 
-	peer := NewTCPPeer(conn, outbound)
-
-	// Does a handshake with the peer to check if everything is ok with the connection
-	if err = t.HandshakeFunc(peer); err != nil {
-		return
-	}
-
-	if t.OnPeer != nil {
-		if err = t.OnPeer(peer); err != nil {
+	// The TLS handshake is done before anything else, so a node that can't be
+	// authenticated is dropped before reaching the server
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		if err = tlsConn.Handshake(); err != nil {
 			return
 		}
 	}
-
-	// Create the struct containing the decoded payload and the sender address
-	for {
-		rpc := RPC{}
-		// Decode de data received from the connection
-		if err := t.Decoder.Decode(conn, &rpc); err != nil {
+	if t.NoiseConfig != nil {
+		var noiseConn *NoiseConn
+		if noiseConn, err = NewNoiseConn(conn, outbound, t.NoiseConfig); err != nil {
 			return
 		}
-		// Takes the remote address from the sender
-		rpc.From = conn.RemoteAddr().String()
-
-		if rpc.Stream {
-			peer.wg.Add(1)
-			fmt.Printf("[%s] incoming stream, waiting...\n", rpc.From)
-			peer.wg.Wait()
-			continue
-		}
-
-		// Put the data into the channel to be consumed
-		t.rpcChan <- rpc
+		conn = noiseConn
 	}
+
+	err = serveConn(conn, outbound, t.HandshakeFunc, t.Decoder, t.OnPeer, t.rpcChan)
 }
@@ -0,0 +1,70 @@
+package p2p
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+)
+
+// NewClusterTLSConfig returns a mutual TLS config for the nodes of a cluster. Both sides
+// of a connection must present a certificate signed by the cluster CA, and only that CA
+// is trusted (the system roots are ignored). As nodes dial each other by address, the
+// host name is not verified, being signed by the cluster CA is what identifies a node
+func NewClusterTLSConfig(caPEM []byte, cert tls.Certificate) (*tls.Config, error) {
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(caPEM) {
+		return nil, errors.New("no certificate found in the cluster CA")
+	}
+
+	return &tls.Config{
+		MinVersion:   tls.VersionTLS13,
+		Certificates: []tls.Certificate{cert},
+		ClientCAs:    pool,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		// The default verification checks the host name, which is replaced by
+		// verifyClusterCertificate for the client side of the connection
+		InsecureSkipVerify: true,
+		VerifyConnection: func(cs tls.ConnectionState) error {
+			return verifyClusterCertificate(pool, cs)
+		},
+	}, nil
+}
+
+// LoadClusterTLSConfig reads the PEM encoded cluster CA, node certificate and node key
+// from the given files and returns the config built by NewClusterTLSConfig
+func LoadClusterTLSConfig(caFile, certFile, keyFile string) (*tls.Config, error) {
+	caPEM, err := os.ReadFile(caFile)
+	if err != nil {
+		return nil, err
+	}
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	return NewClusterTLSConfig(caPEM, cert)
+}
+
+// verifyClusterCertificate checks if the certificate presented by the remote node
+// was signed by the cluster CA
+func verifyClusterCertificate(pool *x509.CertPool, cs tls.ConnectionState) error {
+	if len(cs.PeerCertificates) == 0 {
+		return errors.New("remote node did not present a certificate")
+	}
+
+	opts := x509.VerifyOptions{
+		Roots:         pool,
+		Intermediates: x509.NewCertPool(),
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+	}
+	for _, cert := range cs.PeerCertificates[1:] {
+		opts.Intermediates.AddCert(cert)
+	}
+	if _, err := cs.PeerCertificates[0].Verify(opts); err != nil {
+		return fmt.Errorf("remote node certificate not signed by the cluster CA: %w", err)
+	}
+
+	return nil
+}
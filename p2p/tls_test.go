@@ -0,0 +1,122 @@
+package p2p
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTLSTransport(t *testing.T) {
+	var (
+		ca, caKey, caPEM = newTestCA(t)
+		server           = newTLSTransport(t, "127.0.0.1:8081", caPEM, newTestCert(t, ca, caKey))
+		client           = newTLSTransport(t, "127.0.0.1:8082", caPEM, newTestCert(t, ca, caKey))
+		peers            = make(chan Peer, 1)
+	)
+	client.OnPeer = func(p Peer) error {
+		peers <- p
+		return nil
+	}
+	assert.Nil(t, server.ListenAndAccept())
+	defer server.Close()
+
+	assert.Nil(t, client.Dial(server.Addr()))
+
+	select {
+	case p := <-peers:
+		assert.Nil(t, p.Send(NewMessageFrame([]byte("Foo not Bar"))))
+	case <-time.After(2 * time.Second):
+		t.Fatal("TLS connection was not established")
+	}
+
+	select {
+	case rpc := <-server.Consume():
+		assert.Equal(t, []byte("Foo not Bar"), rpc.Payload)
+	case <-time.After(2 * time.Second):
+		t.Fatal("message not received over TLS")
+	}
+}
+
+func TestTLSTransportRejectsUnknownCA(t *testing.T) {
+	var (
+		ca, caKey, caPEM            = newTestCA(t)
+		otherCA, otherKey, otherPEM = newTestCA(t)
+		server                      = newTLSTransport(t, "127.0.0.1:8083", caPEM, newTestCert(t, ca, caKey))
+		client                      = newTLSTransport(t, "127.0.0.1:8084", otherPEM, newTestCert(t, otherCA, otherKey))
+		peers                       = make(chan Peer, 1)
+	)
+	server.OnPeer = func(p Peer) error {
+		peers <- p
+		return nil
+	}
+	assert.Nil(t, server.ListenAndAccept())
+	defer server.Close()
+
+	assert.Nil(t, client.Dial(server.Addr()))
+
+	select {
+	case <-peers:
+		t.Fatal("node signed by another CA was accepted")
+	case <-time.After(500 * time.Millisecond):
+	}
+}
+
+func newTLSTransport(t *testing.T, addr string, caPEM []byte, cert tls.Certificate) *TCPTransport {
+	cfg, err := NewClusterTLSConfig(caPEM, cert)
+	assert.Nil(t, err)
+
+	return NewTCPTransport(TCPTransportOpts{
+		ListenAddress: addr,
+		HandshakeFunc: NOPHandshakeFunc,
+		Decoder:       DefaultDecoder{},
+		TLSConfig:     cfg,
+	})
+}
+
+func newTestCA(t *testing.T) (*x509.Certificate, *ecdsa.PrivateKey, []byte) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.Nil(t, err)
+
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "gofs test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	assert.Nil(t, err)
+	cert, err := x509.ParseCertificate(der)
+	assert.Nil(t, err)
+
+	return cert, key, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+}
+
+func newTestCert(t *testing.T, ca *x509.Certificate, caKey *ecdsa.PrivateKey) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.Nil(t, err)
+
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "gofs test node"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca, &key.PublicKey, caKey)
+	assert.Nil(t, err)
+
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
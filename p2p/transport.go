@@ -1,12 +1,28 @@
 package p2p
 
-import "net"
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+)
 
-// Peer is an interface that represents the remote node
+// Peer is an interface that represents the remote node. Messages and streams
+// are multiplexed over the same connection, so many transfers can be in
+// flight at the same time
 type Peer interface {
-	net.Conn
+	RemoteAddr() net.Addr
+	Close() error
+	// Info returns the remote node info negotiated during the handshake
+	Info() NodeInfo
+	// Outbound reports if the connection was dialed by the local node
+	Outbound() bool
+	// Send sends a control message to the remote node
 	Send([]byte) error
-	CloseStream()
+	// OpenStream opens a new stream to the remote node
+	OpenStream() (Stream, error)
+	// Done is closed once the connection to the remote node is closed
+	Done() <-chan struct{}
 }
 
 // Transport is an interface that handle the communication
@@ -19,3 +35,57 @@ type Transport interface {
 	Consume() <-chan RPC
 	Close() error
 }
+
+// serveConn calls the handshake to see if the connection is ok, creates the peer and
+// calls the onPeer function. Then it serves the multiplexed connection until it fails:
+// both the control messages and the headers of the new streams are decoded and put
+// into the channel to be consumed
+func serveConn(conn net.Conn, outbound bool, handshake HandshakeFunc, decoder Decoder, onPeer func(Peer) error, rpcChan chan RPC) error {
+	// The handshake runs over the raw connection, before the session starts multiplexing it
+	info, err := handshake(conn)
+	if err != nil {
+		return err
+	}
+
+	peer := NewTCPPeer(conn, outbound)
+	peer.info = info
+
+	if onPeer != nil {
+		if err := onPeer(peer); err != nil {
+			peer.session.close(err)
+			return err
+		}
+	}
+
+	from := conn.RemoteAddr().String()
+	return peer.session.serve(
+		func(payload []byte) {
+			rpc := RPC{From: from}
+			if err := decoder.Decode(bytes.NewReader(payload), &rpc); err != nil {
+				fmt.Printf("[%s] error decoding message: %s\n", from, err)
+				return
+			}
+			rpcChan <- rpc
+		},
+		func(st Stream) {
+			go func() {
+				rpc := RPC{From: from, Stream: st}
+				if err := decoder.Decode(st, &rpc); err != nil {
+					fmt.Printf("[%s] error decoding stream header: %s\n", from, err)
+					st.Close()
+					return
+				}
+				rpcChan <- rpc
+			}()
+		},
+	)
+}
+
+// logDroppedConn logs why the connection of a peer was dropped, unless it was closed
+// by the local node
+func logDroppedConn(err error) {
+	if errors.Is(err, net.ErrClosed) {
+		return
+	}
+	fmt.Printf("Dropping peer connection: %+v\n", err)
+}
@@ -0,0 +1,536 @@
+package p2p
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// Types of the UDP packets. Data and fin packets are numbered and delivered reliably
+// and in order, the others are sent as they are
+const (
+	udpSyn byte = iota + 1
+	udpSynAck
+	udpData
+	udpAck
+	udpFin
+)
+
+const (
+	// udpHeaderSize is the size of the packet header: type, connection ID and sequence
+	udpHeaderSize = 9
+	// udpMaxPayload keeps the packets below the usual MTU
+	udpMaxPayload = 1200
+	// udpWindow is the number of packets sent and not acknowledged yet
+	udpWindow = 128
+	// udpRTO is the time without acknowledgement before the packets are sent again
+	udpRTO = 100 * time.Millisecond
+	// udpMaxRetries is the number of retransmissions without progress before the
+	// connection is considered dead
+	udpMaxRetries = 50
+	// udpDupAcks is the number of repeated acknowledgements triggering a retransmission
+	// before the timeout
+	udpDupAcks = 3
+)
+
+// ErrConnTimeout is returned when the remote node stops acknowledging the packets
+var ErrConnTimeout = errors.New("connection timed out")
+
+// UDPTransportOpts holds the options to initialize the UDP transport
+type UDPTransportOpts struct {
+	ListenAddress string
+	HandshakeFunc HandshakeFunc
+	Decoder       Decoder
+	OnPeer        func(peer Peer) error
+}
+
+// UDPTransport implements the Transport interface over UDP. The packets of each peer
+// are numbered, acknowledged and sent again when lost, so the peers get the ordered
+// and reliable connection the messages and streams are multiplexed on. A single socket
+// is used to listen and dial, so the remote address of a peer is its listen address
+type UDPTransport struct {
+	UDPTransportOpts
+	rpcChan chan RPC
+
+	// listenPacket opens the socket, replaced by the tests to lose packets
+	listenPacket func(network, address string) (net.PacketConn, error)
+	pc           net.PacketConn
+
+	lock  sync.Mutex
+	conns map[string]*udpConn
+}
+
+// NewUDPTransport initializes the UDP transport
+func NewUDPTransport(opts UDPTransportOpts) *UDPTransport {
+	return &UDPTransport{
+		UDPTransportOpts: opts,
+		rpcChan:          make(chan RPC, 1024),
+		listenPacket:     net.ListenPacket,
+		conns:            make(map[string]*udpConn),
+	}
+}
+
+// Addr implements the Transport interface
+func (t *UDPTransport) Addr() string {
+	return t.ListenAddress
+}
+
+// Consume implements the Transport interface
+func (t *UDPTransport) Consume() <-chan RPC {
+	return t.rpcChan
+}
+
+// Close implements the Transport interface, failing all the connections
+func (t *UDPTransport) Close() error {
+	return t.pc.Close()
+}
+
+// ListenAndAccept implements the Transport interface
+func (t *UDPTransport) ListenAndAccept() (err error) {
+	t.pc, err = t.listenPacket("udp", t.ListenAddress)
+	if err != nil {
+		return
+	}
+	go t.readLoop()
+
+	log.Printf("UDP transport listening on port: %s\n", t.ListenAddress)
+
+	return
+}
+
+// Dial implements the Transport interface. The transport must be listening, as the
+// same socket is used for the dialed connections
+func (t *UDPTransport) Dial(addr string) error {
+	if t.pc == nil {
+		return errors.New("UDP transport must listen before dialing")
+	}
+	raddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return err
+	}
+	// The packets of a node listening on all the interfaces come from the loopback
+	if raddr.IP == nil || raddr.IP.IsUnspecified() {
+		raddr.IP = net.IPv4(127, 0, 0, 1)
+	}
+
+	idBuf := make([]byte, 4)
+	if _, err := rand.Read(idBuf); err != nil {
+		return err
+	}
+	c := t.register(raddr, binary.BigEndian.Uint32(idBuf))
+
+	for i := 0; i < udpMaxRetries; i++ {
+		if err := t.send(raddr, udpSyn, c.id, 0, nil); err != nil {
+			c.fail(err)
+			return err
+		}
+		select {
+		case <-c.established:
+			go t.handleConn(c, true)
+			return nil
+		case <-time.After(udpRTO):
+		}
+	}
+	c.fail(ErrConnTimeout)
+
+	return fmt.Errorf("dial %s: %w", addr, ErrConnTimeout)
+}
+
+// register creates the connection with the remote address, replacing the previous one
+func (t *UDPTransport) register(addr net.Addr, id uint32) *udpConn {
+	c := newUDPConn(t, addr, id)
+
+	t.lock.Lock()
+	old := t.conns[addr.String()]
+	t.conns[addr.String()] = c
+	t.lock.Unlock()
+
+	if old != nil {
+		old.fail(io.ErrUnexpectedEOF)
+	}
+
+	return c
+}
+
+func (t *UDPTransport) lookup(addr net.Addr, id uint32) *udpConn {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	c := t.conns[addr.String()]
+	if c == nil || c.id != id {
+		return nil
+	}
+	return c
+}
+
+func (t *UDPTransport) remove(c *udpConn) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if t.conns[c.addr.String()] == c {
+		delete(t.conns, c.addr.String())
+	}
+}
+
+func (t *UDPTransport) send(addr net.Addr, typ byte, id, seq uint32, payload []byte) error {
+	packet := make([]byte, udpHeaderSize, udpHeaderSize+len(payload))
+	packet[0] = typ
+	binary.BigEndian.PutUint32(packet[1:], id)
+	binary.BigEndian.PutUint32(packet[5:], seq)
+
+	_, err := t.pc.WriteTo(append(packet, payload...), addr)
+	return err
+}
+
+// readLoop dispatches the packets to the connections, accepting the new ones
+func (t *UDPTransport) readLoop() {
+	buf := make([]byte, 64*1024)
+	for {
+		n, addr, err := t.pc.ReadFrom(buf)
+		if errors.Is(err, net.ErrClosed) {
+			t.lock.Lock()
+			conns := t.conns
+			t.conns = make(map[string]*udpConn)
+			t.lock.Unlock()
+			for _, c := range conns {
+				c.fail(net.ErrClosed)
+			}
+			return
+		}
+		if err != nil {
+			fmt.Printf("UDP read loop error: %s\n", err)
+			continue
+		}
+		if n < udpHeaderSize {
+			continue
+		}
+
+		var (
+			typ     = buf[0]
+			id      = binary.BigEndian.Uint32(buf[1:])
+			seq     = binary.BigEndian.Uint32(buf[5:])
+			payload = buf[udpHeaderSize:n]
+		)
+		switch typ {
+		case udpSyn:
+			// A repeated syn means the syn ack was lost
+			if t.lookup(addr, id) == nil {
+				c := t.register(addr, id)
+				c.establish()
+				go t.handleConn(c, false)
+			}
+			t.send(addr, udpSynAck, id, 0, nil)
+		case udpSynAck:
+			if c := t.lookup(addr, id); c != nil {
+				c.establish()
+			}
+		case udpData, udpFin:
+			if c := t.lookup(addr, id); c != nil {
+				c.receive(typ, seq, payload)
+			}
+		case udpAck:
+			if c := t.lookup(addr, id); c != nil {
+				c.ack(seq)
+			}
+		}
+	}
+}
+
+func (t *UDPTransport) handleConn(conn net.Conn, outbound bool) {
+	err := serveConn(conn, outbound, t.HandshakeFunc, t.Decoder, t.OnPeer, t.rpcChan)
+	logDroppedConn(err)
+	conn.Close()
+}
+
+// udpPacket is a packet sent and not acknowledged yet
+type udpPacket struct {
+	typ     byte
+	seq     uint32
+	payload []byte
+}
+
+// udpConn implements net.Conn over the packets exchanged with a single remote node
+type udpConn struct {
+	t    *UDPTransport
+	addr net.Addr
+	id   uint32
+
+	established chan struct{}
+	once        sync.Once
+
+	lock sync.Mutex
+	cond *sync.Cond
+
+	// nextSeq is the sequence of the next packet sent
+	nextSeq uint32
+	unacked []udpPacket
+	retries int
+	dupAcks int
+	timer   *time.Timer
+
+	// expected is the sequence of the next packet to be received
+	expected     uint32
+	buf          bytes.Buffer
+	remoteClosed bool
+
+	closed        bool
+	err           error
+	readDeadline  time.Time
+	writeDeadline time.Time
+}
+
+func newUDPConn(t *UDPTransport, addr net.Addr, id uint32) *udpConn {
+	c := &udpConn{
+		t:           t,
+		addr:        addr,
+		id:          id,
+		established: make(chan struct{}),
+	}
+	c.cond = sync.NewCond(&c.lock)
+
+	return c
+}
+
+func (c *udpConn) establish() {
+	c.once.Do(func() { close(c.established) })
+}
+
+// Read implements the net.Conn interface
+func (c *udpConn) Read(b []byte) (int, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	for {
+		switch {
+		case c.buf.Len() > 0:
+			return c.buf.Read(b)
+		case c.remoteClosed:
+			return 0, io.EOF
+		case c.err != nil:
+			return 0, c.err
+		case c.closed:
+			return 0, net.ErrClosed
+		case deadlineExceeded(c.readDeadline):
+			return 0, os.ErrDeadlineExceeded
+		}
+		c.cond.Wait()
+	}
+}
+
+// Write implements the net.Conn interface, blocking while the window is full
+func (c *udpConn) Write(b []byte) (int, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	var written int
+	for len(b) > 0 {
+		for len(c.unacked) >= udpWindow && c.err == nil && !c.closed && !deadlineExceeded(c.writeDeadline) {
+			c.cond.Wait()
+		}
+		switch {
+		case c.err != nil:
+			return written, c.err
+		case c.closed:
+			return written, net.ErrClosed
+		case deadlineExceeded(c.writeDeadline):
+			return written, os.ErrDeadlineExceeded
+		}
+
+		size := min(len(b), udpMaxPayload)
+		if err := c.queue(udpData, bytes.Clone(b[:size])); err != nil {
+			return written, err
+		}
+		written += size
+		b = b[size:]
+	}
+
+	return written, nil
+}
+
+// Close implements the net.Conn interface. The fin is delivered after the data
+// still in flight, the connection lingers so it can still acknowledge the fin of
+// the remote node, then it's forgotten by the transport
+func (c *udpConn) Close() error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.closed {
+		return nil
+	}
+	c.closed = true
+	c.cond.Broadcast()
+	if c.err != nil {
+		return nil
+	}
+	time.AfterFunc(udpRTO*udpMaxRetries, func() { c.fail(net.ErrClosed) })
+
+	return c.queue(udpFin, nil)
+}
+
+// queue sends the packet, keeping it until it's acknowledged
+func (c *udpConn) queue(typ byte, payload []byte) error {
+	p := udpPacket{typ: typ, seq: c.nextSeq, payload: payload}
+	c.nextSeq++
+	c.unacked = append(c.unacked, p)
+	if c.timer == nil {
+		c.timer = time.AfterFunc(udpRTO, c.retransmit)
+	}
+
+	return c.t.send(c.addr, p.typ, c.id, p.seq, p.payload)
+}
+
+// receive handles a numbered packet. Only the expected packet is accepted, the ones
+// out of order are dropped and will be sent again
+func (c *udpConn) receive(typ byte, seq uint32, payload []byte) {
+	c.lock.Lock()
+	if seq == c.expected {
+		c.expected++
+		if typ == udpFin {
+			c.remoteClosed = true
+		} else {
+			c.buf.Write(payload)
+		}
+		c.cond.Broadcast()
+	}
+	expected := c.expected
+	c.lock.Unlock()
+
+	c.t.send(c.addr, udpAck, c.id, expected, nil)
+}
+
+// ack handles the acknowledgement of every packet before seq
+func (c *udpConn) ack(seq uint32) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	var acked int
+	for acked < len(c.unacked) && int32(c.unacked[acked].seq-seq) < 0 {
+		acked++
+	}
+	if acked == 0 {
+		c.dupAcks++
+		if c.dupAcks == udpDupAcks {
+			c.resend()
+		}
+		return
+	}
+
+	c.unacked = c.unacked[acked:]
+	c.retries = 0
+	c.dupAcks = 0
+	c.cond.Broadcast()
+
+	if c.timer != nil {
+		c.timer.Stop()
+		c.timer = nil
+	}
+	if len(c.unacked) > 0 {
+		c.timer = time.AfterFunc(udpRTO, c.retransmit)
+	}
+}
+
+func (c *udpConn) retransmit() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.timer = nil
+	if len(c.unacked) == 0 || c.err != nil {
+		return
+	}
+	c.retries++
+	if c.retries > udpMaxRetries {
+		c.failLocked(ErrConnTimeout)
+		return
+	}
+	c.resend()
+	c.timer = time.AfterFunc(udpRTO, c.retransmit)
+}
+
+// resend sends again all the packets not acknowledged yet
+func (c *udpConn) resend() {
+	for _, p := range c.unacked {
+		c.t.send(c.addr, p.typ, c.id, p.seq, p.payload)
+	}
+}
+
+func (c *udpConn) fail(err error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.failLocked(err)
+}
+
+func (c *udpConn) failLocked(err error) {
+	if c.err != nil {
+		return
+	}
+	c.err = err
+	if c.timer != nil {
+		c.timer.Stop()
+		c.timer = nil
+	}
+	c.cond.Broadcast()
+	c.t.remove(c)
+}
+
+// LocalAddr implements the net.Conn interface
+func (c *udpConn) LocalAddr() net.Addr {
+	return c.t.pc.LocalAddr()
+}
+
+// RemoteAddr implements the net.Conn interface
+func (c *udpConn) RemoteAddr() net.Addr {
+	return c.addr
+}
+
+// SetDeadline implements the net.Conn interface
+func (c *udpConn) SetDeadline(t time.Time) error {
+	c.SetReadDeadline(t)
+	return c.SetWriteDeadline(t)
+}
+
+// SetReadDeadline implements the net.Conn interface
+func (c *udpConn) SetReadDeadline(t time.Time) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.readDeadline = t
+	c.wakeAt(t)
+
+	return nil
+}
+
+// SetWriteDeadline implements the net.Conn interface
+func (c *udpConn) SetWriteDeadline(t time.Time) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.writeDeadline = t
+	c.wakeAt(t)
+
+	return nil
+}
+
+// wakeAt wakes up the blocked reads and writes when the deadline is reached
+func (c *udpConn) wakeAt(t time.Time) {
+	if t.IsZero() {
+		return
+	}
+	time.AfterFunc(time.Until(t), func() {
+		c.lock.Lock()
+		c.cond.Broadcast()
+		c.lock.Unlock()
+	})
+}
+
+func deadlineExceeded(t time.Time) bool {
+	return !t.IsZero() && !time.Now().Before(t)
+}
@@ -0,0 +1,119 @@
+package p2p
+
+import (
+	"io"
+	"math/rand"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUDPTransport(t *testing.T) {
+	var (
+		server = newUDPTransport("127.0.0.1:8087", 0)
+		client = newUDPTransport("127.0.0.1:8088", 0)
+	)
+	assertTransportEcho(t, server, client, []byte("Foo not Bar"))
+}
+
+func TestUDPTransportLosingPackets(t *testing.T) {
+	var (
+		server = newUDPTransport("127.0.0.1:8089", 0.05)
+		client = newUDPTransport("127.0.0.1:8090", 0.05)
+		data   = make([]byte, 200_000)
+	)
+	rand.New(rand.NewSource(1)).Read(data)
+	assertTransportEcho(t, server, client, data)
+}
+
+// assertTransportEcho connects the client to the server and sends the data over a
+// stream, which the server echoes back. The transports are the ones returned by the
+// constructors, so their OnPeer can be set
+func assertTransportEcho(t *testing.T, server, client Transport, data []byte) {
+	peers := make(chan Peer, 1)
+	setOnPeer(client, func(p Peer) error {
+		peers <- p
+		return nil
+	})
+	assert.Nil(t, server.ListenAndAccept())
+	defer server.Close()
+	assert.Nil(t, client.ListenAndAccept())
+	defer client.Close()
+
+	assert.Nil(t, client.Dial(server.Addr()))
+
+	var peer Peer
+	select {
+	case peer = <-peers:
+	case <-time.After(5 * time.Second):
+		t.Fatal("connection was not established")
+	}
+
+	go func() {
+		rpc := <-server.Consume()
+		defer rpc.Stream.Close()
+		io.Copy(rpc.Stream, rpc.Stream)
+	}()
+
+	st, err := peer.OpenStream()
+	assert.Nil(t, err)
+	go func() {
+		st.Write(NewMessageFrame([]byte("echo")))
+		st.Write(data)
+		st.Close()
+	}()
+	echo, err := io.ReadAll(st)
+	assert.Nil(t, err)
+	assert.Equal(t, data, echo)
+}
+
+func setOnPeer(tr Transport, onPeer func(Peer) error) {
+	switch v := tr.(type) {
+	case *UDPTransport:
+		v.OnPeer = onPeer
+	case *UnixTransport:
+		v.OnPeer = onPeer
+	case *WebSocketTransport:
+		v.OnPeer = onPeer
+	}
+}
+
+func newUDPTransport(addr string, lossRate float64) *UDPTransport {
+	tr := NewUDPTransport(UDPTransportOpts{
+		ListenAddress: addr,
+		HandshakeFunc: NOPHandshakeFunc,
+		Decoder:       DefaultDecoder{},
+	})
+	tr.listenPacket = func(network, address string) (net.PacketConn, error) {
+		pc, err := net.ListenPacket(network, address)
+		if err != nil {
+			return nil, err
+		}
+		return &lossyPacketConn{PacketConn: pc, rate: lossRate, rng: rand.New(rand.NewSource(2))}, nil
+	}
+
+	return tr
+}
+
+// lossyPacketConn drops part of the packets written
+type lossyPacketConn struct {
+	net.PacketConn
+	rate float64
+
+	lock sync.Mutex
+	rng  *rand.Rand
+}
+
+func (c *lossyPacketConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	c.lock.Lock()
+	lost := c.rng.Float64() < c.rate
+	c.lock.Unlock()
+	if lost {
+		return len(b), nil
+	}
+
+	return c.PacketConn.WriteTo(b, addr)
+}
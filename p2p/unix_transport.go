@@ -0,0 +1,115 @@
+package p2p
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"sync/atomic"
+)
+
+// UnixTransportOpts holds the options to initialize the unix socket transport
+type UnixTransportOpts struct {
+	// ListenAddress is the path of the socket file the transport listens on
+	ListenAddress string
+	HandshakeFunc HandshakeFunc
+	Decoder       Decoder
+	OnPeer        func(peer Peer) error
+}
+
+// UnixTransport implements the Transport interface over unix domain sockets, for
+// nodes running on the same host
+type UnixTransport struct {
+	UnixTransportOpts
+	listener net.Listener
+	rpcChan  chan RPC
+	// accepted counts the accepted connections, to name their remote address
+	accepted atomic.Int64
+}
+
+// NewUnixTransport initializes the unix socket transport
+func NewUnixTransport(opts UnixTransportOpts) *UnixTransport {
+	return &UnixTransport{
+		UnixTransportOpts: opts,
+		rpcChan:           make(chan RPC, 1024),
+	}
+}
+
+// Addr implements the Transport interface
+func (t *UnixTransport) Addr() string {
+	return t.ListenAddress
+}
+
+// Consume implements the Transport interface
+func (t *UnixTransport) Consume() <-chan RPC {
+	return t.rpcChan
+}
+
+// Close implements the Transport interface, the socket file is removed by the listener
+func (t *UnixTransport) Close() error {
+	return t.listener.Close()
+}
+
+// Dial implements the Transport interface
+func (t *UnixTransport) Dial(addr string) error {
+	conn, err := net.Dial("unix", addr)
+	if err != nil {
+		return err
+	}
+
+	go t.handleConn(conn, true)
+
+	return nil
+}
+
+// ListenAndAccept implements the Transport interface. A socket file left behind by
+// a node that didn't stop cleanly is removed first
+func (t *UnixTransport) ListenAndAccept() (err error) {
+	if err := os.Remove(t.ListenAddress); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	t.listener, err = net.Listen("unix", t.ListenAddress)
+	if err != nil {
+		return
+	}
+	go t.startAcceptLoop()
+
+	log.Printf("Unix transport listening on socket: %s\n", t.ListenAddress)
+
+	return
+}
+
+func (t *UnixTransport) startAcceptLoop() {
+	for {
+		conn, err := t.listener.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
+		if err != nil {
+			fmt.Printf("Unix accept loop error: %s\n", err)
+			continue
+		}
+
+		// The dialing side of a unix socket has no name, so each accepted connection
+		// gets one to tell the peers apart
+		remote := &net.UnixAddr{Net: "unix", Name: fmt.Sprintf("%s#%d", t.ListenAddress, t.accepted.Add(1))}
+		go t.handleConn(&unixConn{Conn: conn, remote: remote}, false)
+	}
+}
+
+func (t *UnixTransport) handleConn(conn net.Conn, outbound bool) {
+	err := serveConn(conn, outbound, t.HandshakeFunc, t.Decoder, t.OnPeer, t.rpcChan)
+	logDroppedConn(err)
+	conn.Close()
+}
+
+// unixConn is an accepted connection with the name given to the remote address
+type unixConn struct {
+	net.Conn
+	remote net.Addr
+}
+
+func (c *unixConn) RemoteAddr() net.Addr {
+	return c.remote
+}
@@ -0,0 +1,15 @@
+package p2p
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestUnixTransport(t *testing.T) {
+	var (
+		dir    = t.TempDir()
+		server = NewUnixTransport(UnixTransportOpts{ListenAddress: dir + "/server.sock", HandshakeFunc: NOPHandshakeFunc, Decoder: DefaultDecoder{}})
+		client = NewUnixTransport(UnixTransportOpts{ListenAddress: dir + "/client.sock", HandshakeFunc: NOPHandshakeFunc, Decoder: DefaultDecoder{}})
+	)
+	assertTransportEcho(t, server, client, bytes.Repeat([]byte("Foo not Bar"), 10_000))
+}
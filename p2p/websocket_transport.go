@@ -0,0 +1,463 @@
+package p2p
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// websocketGUID is appended to the key of the client to compute the accept header,
+// as defined by RFC 6455
+const websocketGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// DefaultWebSocketPath is the path the nodes are upgraded on when none is given
+const DefaultWebSocketPath = "/p2p"
+
+// Opcodes of the WebSocket frames
+const (
+	wsContinuation byte = 0x0
+	wsText         byte = 0x1
+	wsBinary       byte = 0x2
+	wsClose        byte = 0x8
+	wsPing         byte = 0x9
+	wsPong         byte = 0xa
+)
+
+const (
+	// wsMaxFrame limits the size of the frames read, so a broken peer can't exhaust the memory
+	wsMaxFrame = 16 << 20
+	// wsMaxWrite is the size of the frames the writes are split into
+	wsMaxWrite = 1 << 20
+	// wsMaxControl is the longest payload of a control frame allowed by RFC 6455
+	wsMaxControl = 125
+)
+
+// WebSocketTransportOpts holds the options to initialize the WebSocket transport
+type WebSocketTransportOpts struct {
+	// ListenAddress is the address of the HTTP server started by ListenAndAccept
+	ListenAddress string
+	// Path the HTTP connections are upgraded on, DefaultWebSocketPath when empty
+	Path string
+	// TLSConfig serves the accepted connections over TLS (wss://) and secures the
+	// dialed ones, unless the address is a ws:// URL
+	TLSConfig     *tls.Config
+	HandshakeFunc HandshakeFunc
+	Decoder       Decoder
+	OnPeer        func(peer Peer) error
+}
+
+// WebSocketTransport implements the Transport interface over WebSocket connections,
+// so the nodes can run behind HTTP reverse proxies. The framed messages and streams
+// are the same as TCPTransport, carried in binary WebSocket frames
+type WebSocketTransport struct {
+	WebSocketTransportOpts
+	server  *http.Server
+	rpcChan chan RPC
+}
+
+// NewWebSocketTransport initializes the WebSocket transport
+func NewWebSocketTransport(opts WebSocketTransportOpts) *WebSocketTransport {
+	if len(opts.Path) == 0 {
+		opts.Path = DefaultWebSocketPath
+	}
+
+	return &WebSocketTransport{
+		WebSocketTransportOpts: opts,
+		rpcChan:                make(chan RPC, 1024),
+	}
+}
+
+// Addr implements the Transport interface
+func (t *WebSocketTransport) Addr() string {
+	return t.ListenAddress
+}
+
+// Consume implements the Transport interface
+func (t *WebSocketTransport) Consume() <-chan RPC {
+	return t.rpcChan
+}
+
+// Close implements the Transport interface
+func (t *WebSocketTransport) Close() error {
+	if t.server == nil {
+		return nil
+	}
+	return t.server.Close()
+}
+
+// ListenAndAccept implements the Transport interface, starting an HTTP server that
+// only serves the WebSocket path. To share a server, mount Handler on it instead
+func (t *WebSocketTransport) ListenAndAccept() error {
+	ln, err := net.Listen("tcp", t.ListenAddress)
+	if err != nil {
+		return err
+	}
+	if t.TLSConfig != nil {
+		ln = tls.NewListener(ln, t.TLSConfig)
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle(t.Path, t.Handler())
+	t.server = &http.Server{Handler: mux}
+	go func() {
+		if err := t.server.Serve(ln); !errors.Is(err, http.ErrServerClosed) {
+			fmt.Printf("WebSocket server error: %s\n", err)
+		}
+	}()
+
+	log.Printf("WebSocket transport listening on: %s%s\n", t.ListenAddress, t.Path)
+
+	return nil
+}
+
+// Handler returns the HTTP handler upgrading the requests into peers
+func (t *WebSocketTransport) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet ||
+			!headerContains(r.Header, "Connection", "upgrade") ||
+			!headerContains(r.Header, "Upgrade", "websocket") {
+			http.Error(w, "expected a WebSocket upgrade", http.StatusBadRequest)
+			return
+		}
+		if r.Header.Get("Sec-WebSocket-Version") != "13" {
+			w.Header().Set("Sec-WebSocket-Version", "13")
+			http.Error(w, "unsupported WebSocket version", http.StatusUpgradeRequired)
+			return
+		}
+		key := r.Header.Get("Sec-WebSocket-Key")
+		if len(key) == 0 {
+			http.Error(w, "missing Sec-WebSocket-Key", http.StatusBadRequest)
+			return
+		}
+
+		hijacker, ok := w.(http.Hijacker)
+		if !ok {
+			http.Error(w, "connection can't be upgraded", http.StatusInternalServerError)
+			return
+		}
+		conn, rw, err := hijacker.Hijack()
+		if err != nil {
+			return
+		}
+
+		rw.WriteString("HTTP/1.1 101 Switching Protocols\r\n")
+		rw.WriteString("Upgrade: websocket\r\n")
+		rw.WriteString("Connection: Upgrade\r\n")
+		rw.WriteString("Sec-WebSocket-Accept: " + websocketAccept(key) + "\r\n\r\n")
+		if err := rw.Flush(); err != nil {
+			conn.Close()
+			return
+		}
+
+		go t.handleConn(newWSConn(conn, rw.Reader, false), false)
+	})
+}
+
+// Dial implements the Transport interface. The address is either host:port, using
+// the path of the transport and TLS when TLSConfig is set, or a ws:// or wss:// URL
+func (t *WebSocketTransport) Dial(addr string) error {
+	host, path, secure := addr, t.Path, t.TLSConfig != nil
+	for scheme, wss := range map[string]bool{"ws://": false, "wss://": true} {
+		if rest, ok := strings.CutPrefix(addr, scheme); ok {
+			host, path, secure = rest, "/", wss
+			if i := strings.Index(rest, "/"); i >= 0 {
+				host, path = rest[:i], rest[i:]
+			}
+		}
+	}
+
+	conn, err := net.Dial("tcp", host)
+	if err != nil {
+		return err
+	}
+	if secure {
+		conn = tls.Client(conn, t.clientTLSConfig(host))
+	}
+	ws, err := upgradeClient(conn, host, path)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+
+	go t.handleConn(ws, true)
+
+	return nil
+}
+
+// clientTLSConfig returns the TLS config to dial the host with. Without TLSConfig the
+// server certificate is verified against the system roots
+func (t *WebSocketTransport) clientTLSConfig(host string) *tls.Config {
+	cfg := &tls.Config{}
+	if t.TLSConfig != nil {
+		cfg = t.TLSConfig.Clone()
+	}
+	if len(cfg.ServerName) == 0 {
+		cfg.ServerName, _, _ = net.SplitHostPort(host)
+	}
+	return cfg
+}
+
+func (t *WebSocketTransport) handleConn(conn net.Conn, outbound bool) {
+	err := serveConn(conn, outbound, t.HandshakeFunc, t.Decoder, t.OnPeer, t.rpcChan)
+	logDroppedConn(err)
+	conn.Close()
+}
+
+// upgradeClient sends the upgrade request over the connection and checks the response
+func upgradeClient(conn net.Conn, host, path string) (*wsConn, error) {
+	nonce := make([]byte, 16)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	key := base64.StdEncoding.EncodeToString(nonce)
+
+	req, err := http.NewRequest(http.MethodGet, "http://"+host+path, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Sec-WebSocket-Key", key)
+	req.Header.Set("Sec-WebSocket-Version", "13")
+	if err := req.Write(conn); err != nil {
+		return nil, err
+	}
+
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		return nil, fmt.Errorf("WebSocket upgrade refused: %s", resp.Status)
+	}
+	if resp.Header.Get("Sec-WebSocket-Accept") != websocketAccept(key) {
+		return nil, errors.New("invalid Sec-WebSocket-Accept header")
+	}
+
+	return newWSConn(conn, br, true), nil
+}
+
+// websocketAccept returns the accept header the server answers to the client key
+func websocketAccept(key string) string {
+	hash := sha1.Sum([]byte(key + websocketGUID))
+	return base64.StdEncoding.EncodeToString(hash[:])
+}
+
+func headerContains(h http.Header, name, token string) bool {
+	for _, value := range h.Values(name) {
+		for _, v := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(v), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// wsConn implements net.Conn over the frames of a WebSocket connection. The frames
+// sent by the client are masked, as required by RFC 6455
+type wsConn struct {
+	net.Conn
+	br     *bufio.Reader
+	client bool
+
+	// remaining is the amount of bytes of the current data frame not read yet
+	remaining uint64
+	mask      [4]byte
+	masked    bool
+	maskPos   int
+
+	writeLock sync.Mutex
+	closeOnce sync.Once
+}
+
+func newWSConn(conn net.Conn, br *bufio.Reader, client bool) *wsConn {
+	return &wsConn{Conn: conn, br: br, client: client}
+}
+
+// Read implements the net.Conn interface, returning the payload of the data frames.
+// Pings are answered and a close frame ends the connection
+func (c *wsConn) Read(b []byte) (int, error) {
+	for c.remaining == 0 {
+		opcode, length, err := c.readHeader()
+		if err != nil {
+			return 0, err
+		}
+
+		switch opcode {
+		case wsBinary, wsText, wsContinuation:
+			c.remaining = length
+		case wsPing:
+			payload, err := c.readControl(length)
+			if err != nil {
+				return 0, err
+			}
+			if err := c.writeFrame(wsPong, payload); err != nil {
+				return 0, err
+			}
+		case wsPong:
+			if _, err := c.readControl(length); err != nil {
+				return 0, err
+			}
+		case wsClose:
+			payload, err := c.readControl(length)
+			if err != nil {
+				return 0, err
+			}
+			c.closeOnce.Do(func() { c.writeFrame(wsClose, payload) })
+			return 0, io.EOF
+		default:
+			return 0, fmt.Errorf("unknown WebSocket opcode %#x", opcode)
+		}
+	}
+
+	if uint64(len(b)) > c.remaining {
+		b = b[:c.remaining]
+	}
+	n, err := c.br.Read(b)
+	c.unmask(b[:n])
+	c.remaining -= uint64(n)
+
+	return n, err
+}
+
+// readHeader reads the header of the next frame, setting up the mask of its payload
+func (c *wsConn) readHeader() (byte, uint64, error) {
+	var head [2]byte
+	if _, err := io.ReadFull(c.br, head[:]); err != nil {
+		return 0, 0, err
+	}
+	// No extension is negotiated, so the RSV bits must be clear
+	if head[0]&0x70 != 0 {
+		return 0, 0, errors.New("WebSocket frame with RSV bits set")
+	}
+	fin := head[0]&0x80 != 0
+	opcode := head[0] & 0x0f
+	c.masked = head[1]&0x80 != 0
+	if c.masked == c.client {
+		return 0, 0, errors.New("WebSocket frame masking doesn't match the side of the connection")
+	}
+
+	length := uint64(head[1] & 0x7f)
+	switch length {
+	case 126:
+		var l uint16
+		if err := binary.Read(c.br, binary.BigEndian, &l); err != nil {
+			return 0, 0, err
+		}
+		length = uint64(l)
+	case 127:
+		if err := binary.Read(c.br, binary.BigEndian, &length); err != nil {
+			return 0, 0, err
+		}
+	}
+	if length > wsMaxFrame {
+		return 0, 0, fmt.Errorf("WebSocket frame of %d bytes exceeds the limit of %d bytes", length, wsMaxFrame)
+	}
+	// Control frames can't be fragmented and are limited to 125 bytes (RFC 6455, 5.5)
+	if opcode >= wsClose && (!fin || length > wsMaxControl) {
+		return 0, 0, fmt.Errorf("invalid WebSocket control frame %#x of %d bytes", opcode, length)
+	}
+
+	c.maskPos = 0
+	if c.masked {
+		if _, err := io.ReadFull(c.br, c.mask[:]); err != nil {
+			return 0, 0, err
+		}
+	}
+
+	return opcode, length, nil
+}
+
+func (c *wsConn) readControl(length uint64) ([]byte, error) {
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(c.br, payload); err != nil {
+		return nil, err
+	}
+	c.unmask(payload)
+
+	return payload, nil
+}
+
+func (c *wsConn) unmask(b []byte) {
+	if !c.masked {
+		return
+	}
+	for i := range b {
+		b[i] ^= c.mask[c.maskPos%4]
+		c.maskPos++
+	}
+}
+
+// Write implements the net.Conn interface, sending the data in binary frames
+func (c *wsConn) Write(b []byte) (int, error) {
+	var written int
+	for len(b) > 0 {
+		size := min(len(b), wsMaxWrite)
+		if err := c.writeFrame(wsBinary, b[:size]); err != nil {
+			return written, err
+		}
+		written += size
+		b = b[size:]
+	}
+
+	return written, nil
+}
+
+// Close implements the net.Conn interface, sending a close frame first
+func (c *wsConn) Close() error {
+	c.closeOnce.Do(func() { c.writeFrame(wsClose, nil) })
+	return c.Conn.Close()
+}
+
+func (c *wsConn) writeFrame(opcode byte, payload []byte) error {
+	frame := make([]byte, 0, 14+len(payload))
+	frame = append(frame, 0x80|opcode)
+
+	var maskBit byte
+	if c.client {
+		maskBit = 0x80
+	}
+	switch {
+	case len(payload) < 126:
+		frame = append(frame, maskBit|byte(len(payload)))
+	case len(payload) <= 0xffff:
+		frame = append(frame, maskBit|126)
+		frame = binary.BigEndian.AppendUint16(frame, uint16(len(payload)))
+	default:
+		frame = append(frame, maskBit|127)
+		frame = binary.BigEndian.AppendUint64(frame, uint64(len(payload)))
+	}
+
+	if c.client {
+		var mask [4]byte
+		if _, err := rand.Read(mask[:]); err != nil {
+			return err
+		}
+		frame = append(frame, mask[:]...)
+		for i, b := range payload {
+			frame = append(frame, b^mask[i%4])
+		}
+	} else {
+		frame = append(frame, payload...)
+	}
+
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+
+	_, err := c.Conn.Write(frame)
+	return err
+}
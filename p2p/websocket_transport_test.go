@@ -0,0 +1,66 @@
+package p2p
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWebSocketAccept(t *testing.T) {
+	// Example from RFC 6455, section 1.3
+	assert.Equal(t, "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=", websocketAccept("dGhlIHNhbXBsZSBub25jZQ=="))
+}
+
+func TestWebSocketTransport(t *testing.T) {
+	var (
+		server = NewWebSocketTransport(WebSocketTransportOpts{ListenAddress: "127.0.0.1:8091", HandshakeFunc: NOPHandshakeFunc, Decoder: DefaultDecoder{}})
+		client = NewWebSocketTransport(WebSocketTransportOpts{ListenAddress: "127.0.0.1:8092", HandshakeFunc: NOPHandshakeFunc, Decoder: DefaultDecoder{}})
+	)
+	assertTransportEcho(t, server, client, bytes.Repeat([]byte("Foo not Bar"), 100_000))
+}
+
+func TestWebSocketTransportTLS(t *testing.T) {
+	var (
+		ca, caKey, caPEM = newTestCA(t)
+		server           = newWSSTransport(t, "127.0.0.1:8093", caPEM, newTestCert(t, ca, caKey))
+		client           = newWSSTransport(t, "127.0.0.1:8094", caPEM, newTestCert(t, ca, caKey))
+	)
+	assertTransportEcho(t, server, client, []byte("Foo not Bar"))
+}
+
+func TestWebSocketInvalidFrames(t *testing.T) {
+	mask := []byte{1, 2, 3, 4}
+	tests := map[string][]byte{
+		"long control":       append([]byte{0x80 | wsPing, 0x80 | 126, 0, 126}, mask...),
+		"fragmented control": append([]byte{wsPing, 0x80}, mask...),
+		"rsv bits":           append([]byte{0x80 | 0x40 | wsBinary, 0x81}, append(mask, 0)...),
+	}
+	for name, frame := range tests {
+		t.Run(name, func(t *testing.T) {
+			server, client := net.Pipe()
+			defer server.Close()
+			defer client.Close()
+
+			go client.Write(frame)
+
+			_, err := newWSConn(server, bufio.NewReader(server), false).Read(make([]byte, 1))
+			assert.NotNil(t, err)
+		})
+	}
+}
+
+func newWSSTransport(t *testing.T, addr string, caPEM []byte, cert tls.Certificate) *WebSocketTransport {
+	cfg, err := NewClusterTLSConfig(caPEM, cert)
+	assert.Nil(t, err)
+
+	return NewWebSocketTransport(WebSocketTransportOpts{
+		ListenAddress: addr,
+		HandshakeFunc: NOPHandshakeFunc,
+		Decoder:       DefaultDecoder{},
+		TLSConfig:     cfg,
+	})
+}
@@ -0,0 +1,827 @@
+package main
+
+import (
+	"bufio"
+	"crypto/md5"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	s3Namespace   = "http://s3.amazonaws.com/doc/2006-03-01/"
+	s3MaxKeys     = 1000
+	s3TimeFormat  = "2006-01-02T15:04:05.000Z"
+	s3UploadsPath = "uploads" // folder of the storage root holding the parts of the multipart uploads
+	s3UploadFile  = "upload.json"
+	// s3UploadExpiry is how long a multipart upload is kept before it's considered
+	// abandoned and its parts are removed
+	s3UploadExpiry = 24 * time.Hour
+)
+
+// S3Gateway serves a subset of the S3 API on top of a FileServer, so the files can be
+// managed with the usual S3 clients. Each node owns a single bucket named after its
+// node ID. The supported operations are ListBuckets, HeadBucket, GetBucketLocation,
+// PutObject, GetObject, HeadObject, DeleteObject, DeleteObjects, ListObjectsV2 and
+// the multipart uploads.
+//
+// Only path-style requests are supported and the request signatures are not checked,
+// so the gateway must not be exposed outside of a trusted network
+type S3Gateway struct {
+	server *FileServer
+
+	mu      sync.Mutex
+	uploads map[string]*s3Upload
+}
+
+// s3Upload is a multipart upload in progress. The parts are saved in dir until the
+// upload is completed, along with the key and the creation time in s3UploadFile, so
+// the upload survives a restart of the node
+type s3Upload struct {
+	key     string
+	dir     string
+	created time.Time
+	parts   map[int]string // ETag of each uploaded part
+}
+
+// s3Error is the body of the error responses
+type s3Error struct {
+	XMLName  xml.Name `xml:"Error"`
+	Code     string
+	Message  string
+	Resource string
+	status   int
+}
+
+func (e *s3Error) Error() string {
+	return e.Code + ": " + e.Message
+}
+
+var (
+	errS3NoSuchBucket   = &s3Error{Code: "NoSuchBucket", Message: "The specified bucket does not exist", status: http.StatusNotFound}
+	errS3NoSuchKey      = &s3Error{Code: "NoSuchKey", Message: "The specified key does not exist", status: http.StatusNotFound}
+	errS3NoSuchUpload   = &s3Error{Code: "NoSuchUpload", Message: "The specified multipart upload does not exist", status: http.StatusNotFound}
+	errS3AccessDenied   = &s3Error{Code: "AccessDenied", Message: "Access Denied", status: http.StatusForbidden}
+	errS3InvalidPart    = &s3Error{Code: "InvalidPart", Message: "One or more of the specified parts could not be found", status: http.StatusBadRequest}
+	errS3InvalidOrder   = &s3Error{Code: "InvalidPartOrder", Message: "The list of parts was not in ascending order", status: http.StatusBadRequest}
+	errS3InvalidRange   = &s3Error{Code: "InvalidRange", Message: "The requested range is not satisfiable", status: http.StatusRequestedRangeNotSatisfiable}
+	errS3InvalidRequest = &s3Error{Code: "InvalidRequest", Message: "Invalid request", status: http.StatusBadRequest}
+	errS3MalformedXML   = &s3Error{Code: "MalformedXML", Message: "The XML you provided was not well-formed", status: http.StatusBadRequest}
+	errS3NotImplemented = &s3Error{Code: "NotImplemented", Message: "The requested functionality is not implemented", status: http.StatusNotImplemented}
+)
+
+// NewS3Gateway creates the gateway, loading the multipart uploads left in progress
+// by a previous run
+func NewS3Gateway(server *FileServer) *S3Gateway {
+	g := &S3Gateway{
+		server:  server,
+		uploads: make(map[string]*s3Upload),
+	}
+	g.loadUploads()
+
+	return g
+}
+
+func (g *S3Gateway) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	bucket, key, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+
+	var err error
+	switch {
+	case bucket == "":
+		if r.Method != http.MethodGet {
+			err = errS3NotImplemented
+			break
+		}
+		err = g.listBuckets(w)
+	case key == "":
+		err = g.serveBucket(w, r, bucket)
+	default:
+		err = g.serveObject(w, r, bucket, key)
+	}
+	if err != nil {
+		g.error(w, r, err)
+	}
+}
+
+func (g *S3Gateway) serveBucket(w http.ResponseWriter, r *http.Request, bucket string) error {
+	if err := g.checkBucket(bucket); err != nil {
+		return err
+	}
+
+	query := r.URL.Query()
+	switch {
+	case r.Method == http.MethodHead:
+		w.WriteHeader(http.StatusOK)
+		return nil
+	case r.Method == http.MethodPut:
+		// The bucket of the node always exists
+		w.WriteHeader(http.StatusOK)
+		return nil
+	case r.Method == http.MethodGet && query.Has("location"):
+		return writeXML(w, http.StatusOK, struct {
+			XMLName xml.Name `xml:"LocationConstraint"`
+			XMLNS   string   `xml:"xmlns,attr"`
+		}{XMLNS: s3Namespace})
+	case r.Method == http.MethodGet && query.Get("list-type") == "2":
+		return g.listObjects(w, bucket, query)
+	case r.Method == http.MethodPost && query.Has("delete"):
+		return g.deleteObjects(w, r)
+	}
+
+	return errS3NotImplemented
+}
+
+func (g *S3Gateway) serveObject(w http.ResponseWriter, r *http.Request, bucket, key string) error {
+	if err := g.checkBucket(bucket); err != nil {
+		return err
+	}
+
+	query := r.URL.Query()
+	switch r.Method {
+	case http.MethodPut:
+		if r.Header.Get("x-amz-copy-source") != "" {
+			return errS3NotImplemented
+		}
+		if query.Has("uploadId") {
+			return g.uploadPart(w, r, key, query)
+		}
+		return g.putObject(w, r, key)
+	case http.MethodGet, http.MethodHead:
+		return g.getObject(w, r, key)
+	case http.MethodDelete:
+		if query.Has("uploadId") {
+			return g.abortUpload(w, key, query.Get("uploadId"))
+		}
+		return g.deleteObject(w, key)
+	case http.MethodPost:
+		if query.Has("uploads") {
+			return g.createUpload(w, bucket, key)
+		}
+		if query.Has("uploadId") {
+			return g.completeUpload(w, r, bucket, key, query.Get("uploadId"))
+		}
+	}
+
+	return errS3NotImplemented
+}
+
+// checkBucket fails unless the bucket is the one of the node. The files of the other
+// nodes are encrypted with their keys, so their buckets can't be read from here
+func (g *S3Gateway) checkBucket(bucket string) error {
+	if bucket == g.server.ID {
+		return nil
+	}
+	if _, err := os.Stat(filepath.Join(g.server.store.Root, bucket)); err == nil {
+		return errS3AccessDenied
+	}
+	return errS3NoSuchBucket
+}
+
+func (g *S3Gateway) listBuckets(w http.ResponseWriter) error {
+	type bucket struct {
+		Name         string
+		CreationDate string
+	}
+	return writeXML(w, http.StatusOK, struct {
+		XMLName xml.Name `xml:"ListAllMyBucketsResult"`
+		XMLNS   string   `xml:"xmlns,attr"`
+		Owner   struct{ ID string }
+		Buckets []bucket `xml:"Buckets>Bucket"`
+	}{
+		XMLNS:   s3Namespace,
+		Owner:   struct{ ID string }{g.server.ID},
+		Buckets: []bucket{{Name: g.server.ID, CreationDate: time.Unix(0, 0).UTC().Format(s3TimeFormat)}},
+	})
+}
+
+type s3Object struct {
+	Key          string
+	LastModified string
+	ETag         string
+	Size         int64
+	StorageClass string
+}
+
+type s3Prefix struct {
+	Prefix string
+}
+
+type s3ListResult struct {
+	XMLName               xml.Name `xml:"ListBucketResult"`
+	XMLNS                 string   `xml:"xmlns,attr"`
+	Name                  string
+	Prefix                string
+	Delimiter             string `xml:",omitempty"`
+	StartAfter            string `xml:",omitempty"`
+	ContinuationToken     string `xml:",omitempty"`
+	NextContinuationToken string `xml:",omitempty"`
+	EncodingType          string `xml:",omitempty"`
+	MaxKeys               int
+	KeyCount              int
+	IsTruncated           bool
+	Contents              []s3Object
+	CommonPrefixes        []s3Prefix
+}
+
+// listObjects implements ListObjectsV2. The continuation token is the last key or
+// common prefix returned, so the next page starts right after it
+func (g *S3Gateway) listObjects(w http.ResponseWriter, bucket string, query url.Values) error {
+	res := s3ListResult{
+		XMLNS:             s3Namespace,
+		Name:              bucket,
+		Prefix:            query.Get("prefix"),
+		Delimiter:         query.Get("delimiter"),
+		StartAfter:        query.Get("start-after"),
+		ContinuationToken: query.Get("continuation-token"),
+		EncodingType:      query.Get("encoding-type"),
+		MaxKeys:           s3MaxKeys,
+	}
+	if v := query.Get("max-keys"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			return errS3InvalidRequest
+		}
+		res.MaxKeys = min(n, s3MaxKeys)
+	}
+
+	marker := res.StartAfter
+	if res.ContinuationToken != "" {
+		b, err := base64.StdEncoding.DecodeString(res.ContinuationToken)
+		if err != nil {
+			return errS3InvalidRequest
+		}
+		marker = max(marker, string(b))
+	}
+
+	encode := func(s string) string {
+		if res.EncodingType == "url" {
+			return url.QueryEscape(s)
+		}
+		return s
+	}
+
+	var last string
+	for _, info := range g.server.index.List(res.Prefix) {
+		if info.Key <= marker {
+			continue
+		}
+
+		prefix := commonPrefix(info.Key, res.Prefix, res.Delimiter)
+		if prefix != "" && (prefix == marker || prefix == last) {
+			continue
+		}
+		if res.KeyCount == res.MaxKeys {
+			res.IsTruncated = true
+			res.NextContinuationToken = base64.StdEncoding.EncodeToString([]byte(last))
+			break
+		}
+
+		if prefix != "" {
+			res.CommonPrefixes = append(res.CommonPrefixes, s3Prefix{Prefix: encode(prefix)})
+			last = prefix
+		} else {
+			res.Contents = append(res.Contents, s3Object{
+				Key:          encode(info.Key),
+				LastModified: info.ModTime.Format(s3TimeFormat),
+				ETag:         s3ETag(info),
+				Size:         info.Size,
+				StorageClass: "STANDARD",
+			})
+			last = info.Key
+		}
+		res.KeyCount++
+	}
+	res.Prefix = encode(res.Prefix)
+	res.Delimiter = encode(res.Delimiter)
+	res.StartAfter = encode(res.StartAfter)
+
+	return writeXML(w, http.StatusOK, res)
+}
+
+// commonPrefix returns the key up to the first delimiter after the prefix, or an
+// empty string when there is no delimiter after the prefix
+func commonPrefix(key, prefix, delimiter string) string {
+	if delimiter == "" {
+		return ""
+	}
+	i := strings.Index(key[len(prefix):], delimiter)
+	if i < 0 {
+		return ""
+	}
+	return key[:len(prefix)+i+len(delimiter)]
+}
+
+func (g *S3Gateway) putObject(w http.ResponseWriter, r *http.Request, key string) error {
+	if err := g.server.Store(key, s3Body(r)); err != nil {
+		return err
+	}
+	info, ok := g.server.index.Get(key)
+	if !ok {
+		return errS3NoSuchKey
+	}
+
+	w.Header().Set("ETag", s3ETag(info))
+	w.WriteHeader(http.StatusOK)
+
+	return nil
+}
+
+func (g *S3Gateway) getObject(w http.ResponseWriter, r *http.Request, key string) error {
+	info, err := g.server.Stat(key)
+	if err != nil {
+		return err
+	}
+	if r.Method == http.MethodHead {
+		setObjectHeaders(w, info)
+		w.WriteHeader(http.StatusOK)
+		return nil
+	}
+
+	offset, length, partial, err := parseRange(r.Header.Get("Range"), info.Size)
+	if err != nil {
+		return errS3InvalidRange
+	}
+	f, err := openFile(g.server, key, offset, length, partial)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	setObjectHeaders(w, info)
+	w.Header().Set("Content-Length", strconv.FormatInt(length, 10))
+	status := http.StatusOK
+	if partial {
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", offset, offset+length-1, info.Size))
+		status = http.StatusPartialContent
+	}
+	w.WriteHeader(status)
+	if _, err := io.CopyN(w, f, length); err != nil {
+		log.Printf("[%s] could not send (%s) to %s: %s", g.server.Transport.Addr(), key, r.RemoteAddr, err)
+	}
+
+	return nil
+}
+
+// setObjectHeaders sets the headers of the object. Only the size is known of the
+// objects held by the peers
+func setObjectHeaders(w http.ResponseWriter, info FileInfo) {
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Length", strconv.FormatInt(info.Size, 10))
+	if info.MD5 != "" {
+		w.Header().Set("ETag", s3ETag(info))
+		w.Header().Set("Last-Modified", info.ModTime.Format(http.TimeFormat))
+	}
+	w.Header().Set("Accept-Ranges", "bytes")
+}
+
+// deleteObject removes the file. As in S3, deleting a missing key succeeds
+func (g *S3Gateway) deleteObject(w http.ResponseWriter, key string) error {
+	if err := g.server.Delete(key); err != nil && !errors.Is(err, ErrNotFound) {
+		return err
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+func (g *S3Gateway) deleteObjects(w http.ResponseWriter, r *http.Request) error {
+	var req struct {
+		Quiet   bool
+		Objects []struct {
+			Key string
+		} `xml:"Object"`
+	}
+	if err := xml.NewDecoder(r.Body).Decode(&req); err != nil {
+		return errS3MalformedXML
+	}
+
+	type deleted struct {
+		Key string
+	}
+	type deleteError struct {
+		Key     string
+		Code    string
+		Message string
+	}
+	res := struct {
+		XMLName xml.Name      `xml:"DeleteResult"`
+		XMLNS   string        `xml:"xmlns,attr"`
+		Deleted []deleted     `xml:"Deleted"`
+		Errors  []deleteError `xml:"Error"`
+	}{XMLNS: s3Namespace}
+	for _, obj := range req.Objects {
+		err := g.server.Delete(obj.Key)
+		if err != nil && !errors.Is(err, ErrNotFound) {
+			e := toS3Error(err)
+			res.Errors = append(res.Errors, deleteError{Key: obj.Key, Code: e.Code, Message: e.Message})
+			continue
+		}
+		if !req.Quiet {
+			res.Deleted = append(res.Deleted, deleted{Key: obj.Key})
+		}
+	}
+
+	return writeXML(w, http.StatusOK, res)
+}
+
+func (g *S3Gateway) createUpload(w http.ResponseWriter, bucket, key string) error {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return err
+	}
+	id := hex.EncodeToString(b)
+	upload := &s3Upload{
+		key:     key,
+		dir:     filepath.Join(g.server.store.Root, s3UploadsPath, id),
+		created: time.Now().UTC(),
+		parts:   make(map[int]string),
+	}
+	if err := os.MkdirAll(upload.dir, os.ModePerm); err != nil {
+		return err
+	}
+	meta, err := json.Marshal(s3UploadMeta{Key: upload.key, Created: upload.created})
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(filepath.Join(upload.dir, s3UploadFile), meta, 0o644); err != nil {
+		return err
+	}
+
+	g.mu.Lock()
+	g.uploads[id] = upload
+	g.mu.Unlock()
+	g.reapUploads()
+
+	return writeXML(w, http.StatusOK, struct {
+		XMLName  xml.Name `xml:"InitiateMultipartUploadResult"`
+		XMLNS    string   `xml:"xmlns,attr"`
+		Bucket   string
+		Key      string
+		UploadId string
+	}{XMLNS: s3Namespace, Bucket: bucket, Key: key, UploadId: id})
+}
+
+// upload returns the multipart upload of the key with the given ID
+func (g *S3Gateway) upload(key, id string) (*s3Upload, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	upload, ok := g.uploads[id]
+	if !ok || upload.key != key {
+		return nil, errS3NoSuchUpload
+	}
+	return upload, nil
+}
+
+func (g *S3Gateway) uploadPart(w http.ResponseWriter, r *http.Request, key string, query url.Values) error {
+	upload, err := g.upload(key, query.Get("uploadId"))
+	if err != nil {
+		return err
+	}
+	part, err := strconv.Atoi(query.Get("partNumber"))
+	if err != nil || part < 1 || part > 10000 {
+		return errS3InvalidRequest
+	}
+
+	f, err := os.Create(filepath.Join(upload.dir, strconv.Itoa(part)))
+	if err != nil {
+		return err
+	}
+	hash := md5.New()
+	_, err = io.Copy(io.MultiWriter(f, hash), s3Body(r))
+	closeFile(f)
+	if err != nil {
+		return err
+	}
+
+	etag := fmt.Sprintf("%q", hex.EncodeToString(hash.Sum(nil)))
+	g.mu.Lock()
+	upload.parts[part] = etag
+	g.mu.Unlock()
+
+	w.Header().Set("ETag", etag)
+	w.WriteHeader(http.StatusOK)
+
+	return nil
+}
+
+// completeUpload stores the parts listed in the request, in order, as a single file
+func (g *S3Gateway) completeUpload(w http.ResponseWriter, r *http.Request, bucket, key, id string) error {
+	upload, err := g.upload(key, id)
+	if err != nil {
+		return err
+	}
+
+	var req struct {
+		Parts []struct {
+			PartNumber int
+			ETag       string
+		} `xml:"Part"`
+	}
+	if err := xml.NewDecoder(r.Body).Decode(&req); err != nil {
+		return errS3MalformedXML
+	}
+	if len(req.Parts) == 0 {
+		return errS3MalformedXML
+	}
+
+	var (
+		files   []*os.File
+		readers []io.Reader
+	)
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+	// The ETag of a multipart object is the MD5 of the MD5 of its parts, followed by
+	// the amount of parts
+	for i := 1; i < len(req.Parts); i++ {
+		if req.Parts[i].PartNumber <= req.Parts[i-1].PartNumber {
+			return errS3InvalidOrder
+		}
+	}
+	etags := md5.New()
+	g.mu.Lock()
+	for _, part := range req.Parts {
+		etag, ok := upload.parts[part.PartNumber]
+		if !ok || strings.Trim(etag, `"`) != strings.Trim(part.ETag, `"`) {
+			g.mu.Unlock()
+			return errS3InvalidPart
+		}
+		sum, _ := hex.DecodeString(strings.Trim(etag, `"`))
+		etags.Write(sum)
+	}
+	g.mu.Unlock()
+	for _, part := range req.Parts {
+		f, err := os.Open(filepath.Join(upload.dir, strconv.Itoa(part.PartNumber)))
+		if err != nil {
+			return err
+		}
+		files = append(files, f)
+		readers = append(readers, f)
+	}
+
+	if err := g.server.Store(key, io.MultiReader(readers...)); err != nil {
+		return err
+	}
+	if err := g.abort(id); err != nil {
+		return err
+	}
+	info, ok := g.server.index.Get(key)
+	if !ok {
+		return errS3NoSuchKey
+	}
+	info.ETag = fmt.Sprintf("%x-%d", etags.Sum(nil), len(req.Parts))
+	if err := g.server.index.Put(info); err != nil {
+		return err
+	}
+
+	return writeXML(w, http.StatusOK, struct {
+		XMLName xml.Name `xml:"CompleteMultipartUploadResult"`
+		XMLNS   string   `xml:"xmlns,attr"`
+		Bucket  string
+		Key     string
+		ETag    string
+	}{XMLNS: s3Namespace, Bucket: bucket, Key: key, ETag: s3ETag(info)})
+}
+
+func (g *S3Gateway) abortUpload(w http.ResponseWriter, key, id string) error {
+	if _, err := g.upload(key, id); err != nil {
+		return err
+	}
+	if err := g.abort(id); err != nil {
+		return err
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+// abort forgets the multipart upload and removes its parts
+func (g *S3Gateway) abort(id string) error {
+	g.mu.Lock()
+	upload, ok := g.uploads[id]
+	delete(g.uploads, id)
+	g.mu.Unlock()
+	if !ok {
+		return nil
+	}
+
+	return os.RemoveAll(upload.dir)
+}
+
+// s3UploadMeta is the content of the s3UploadFile of a multipart upload
+type s3UploadMeta struct {
+	Key     string
+	Created time.Time
+}
+
+// loadUploads reads the multipart uploads saved in the storage root. The ETags of
+// the parts are computed again from their content, and the uploads that expired or
+// can't be read are removed
+func (g *S3Gateway) loadUploads() {
+	root := filepath.Join(g.server.store.Root, s3UploadsPath)
+	entries, err := os.ReadDir(root)
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			log.Printf("[%s] could not read the multipart uploads: %s", g.server.Transport.Addr(), err)
+		}
+		return
+	}
+
+	for _, entry := range entries {
+		dir := filepath.Join(root, entry.Name())
+		upload, err := loadUpload(dir)
+		if err != nil || time.Since(upload.created) > s3UploadExpiry {
+			if err != nil {
+				log.Printf("[%s] removing the broken multipart upload %s: %s", g.server.Transport.Addr(), entry.Name(), err)
+			}
+			os.RemoveAll(dir)
+			continue
+		}
+		g.uploads[entry.Name()] = upload
+	}
+}
+
+func loadUpload(dir string) (*s3Upload, error) {
+	b, err := os.ReadFile(filepath.Join(dir, s3UploadFile))
+	if err != nil {
+		return nil, err
+	}
+	var meta s3UploadMeta
+	if err := json.Unmarshal(b, &meta); err != nil {
+		return nil, err
+	}
+
+	upload := &s3Upload{
+		key:     meta.Key,
+		dir:     dir,
+		created: meta.Created,
+		parts:   make(map[int]string),
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range entries {
+		part, err := strconv.Atoi(entry.Name())
+		if err != nil {
+			continue
+		}
+		f, err := os.Open(filepath.Join(dir, entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+		hash := md5.New()
+		_, err = io.Copy(hash, f)
+		f.Close()
+		if err != nil {
+			return nil, err
+		}
+		upload.parts[part] = fmt.Sprintf("%q", hex.EncodeToString(hash.Sum(nil)))
+	}
+
+	return upload, nil
+}
+
+// reapUploads removes the multipart uploads abandoned for longer than s3UploadExpiry
+func (g *S3Gateway) reapUploads() {
+	g.mu.Lock()
+	var expired []string
+	for id, upload := range g.uploads {
+		if time.Since(upload.created) > s3UploadExpiry {
+			expired = append(expired, id)
+		}
+	}
+	g.mu.Unlock()
+
+	for _, id := range expired {
+		if err := g.abort(id); err != nil {
+			log.Printf("[%s] could not remove the expired multipart upload %s: %s", g.server.Transport.Addr(), id, err)
+		}
+	}
+}
+
+func (g *S3Gateway) error(w http.ResponseWriter, r *http.Request, err error) {
+	e := toS3Error(err)
+	e.Resource = r.URL.Path
+	if e.status >= http.StatusInternalServerError {
+		log.Printf("[%s] %s %s failed: %s", g.server.Transport.Addr(), r.Method, r.URL.Path, err)
+	}
+
+	if r.Method == http.MethodHead {
+		w.WriteHeader(e.status)
+		return
+	}
+	writeXML(w, e.status, e)
+}
+
+// toS3Error returns the S3 error matching the error
+func toS3Error(err error) s3Error {
+	var e *s3Error
+	switch {
+	case errors.As(err, &e):
+		return *e
+	case errors.Is(err, ErrNotFound):
+		return *errS3NoSuchKey
+	case errors.Is(err, ErrForbidden):
+		return *errS3AccessDenied
+	case errors.Is(err, ErrQuotaExceeded):
+		return s3Error{Code: "QuotaExceeded", Message: "The storage quota of the node was exceeded", status: http.StatusInsufficientStorage}
+	case errors.Is(err, ErrOutOfRange):
+		return *errS3InvalidRange
+	case errors.Is(err, ErrInvalid):
+		return s3Error{Code: "InvalidArgument", Message: "The object key is not valid", status: http.StatusBadRequest}
+	case errors.Is(err, ErrServerClosed):
+		return s3Error{Code: "ServiceUnavailable", Message: "The node is shutting down. Please try again.", status: http.StatusServiceUnavailable}
+	}
+	return s3Error{Code: "InternalError", Message: "We encountered an internal error. Please try again.", status: http.StatusInternalServerError}
+}
+
+func writeXML(w http.ResponseWriter, status int, v any) error {
+	b, err := xml.Marshal(v)
+	if err != nil {
+		return err
+	}
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	_, err = w.Write(append([]byte(xml.Header), b...))
+
+	return err
+}
+
+func s3ETag(info FileInfo) string {
+	if info.ETag != "" {
+		return fmt.Sprintf("%q", info.ETag)
+	}
+	return fmt.Sprintf("%q", info.MD5)
+}
+
+// s3Body returns the content of the request. The SDKs may send it in the aws-chunked
+// encoding, with the chunk signatures and checksums inlined in the body
+func s3Body(r *http.Request) io.Reader {
+	if !strings.HasPrefix(r.Header.Get("x-amz-content-sha256"), "STREAMING-") &&
+		!slices.Contains(strings.Split(r.Header.Get("Content-Encoding"), ","), "aws-chunked") {
+		return r.Body
+	}
+	return &awsChunkedReader{r: bufio.NewReader(r.Body)}
+}
+
+// awsChunkedReader decodes the aws-chunked encoding. Every chunk is sent as
+// "hex-size[;chunk-signature=...]\r\n" followed by the data and "\r\n", the last chunk
+// being empty and optionally followed by trailing checksum headers
+type awsChunkedReader struct {
+	r    *bufio.Reader
+	left int64
+	done bool
+}
+
+func (c *awsChunkedReader) Read(b []byte) (int, error) {
+	if c.done {
+		return 0, io.EOF
+	}
+	if c.left == 0 {
+		line, err := c.r.ReadString('\n')
+		if err != nil {
+			return 0, io.ErrUnexpectedEOF
+		}
+		sizeField, _, _ := strings.Cut(strings.TrimSpace(line), ";")
+		size, err := strconv.ParseInt(sizeField, 16, 64)
+		if err != nil || size < 0 {
+			return 0, fmt.Errorf("invalid aws-chunked chunk size %q", sizeField)
+		}
+		if size == 0 {
+			c.done = true
+			return 0, io.EOF
+		}
+		c.left = size
+	}
+
+	n, err := c.r.Read(b[:min(int64(len(b)), c.left)])
+	c.left -= int64(n)
+	if err == io.EOF {
+		return n, io.ErrUnexpectedEOF
+	}
+	if err == nil && c.left == 0 {
+		// Skip the \r\n ending the chunk
+		_, err = c.r.Discard(2)
+	}
+
+	return n, err
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestS3GatewayObjects(t *testing.T) {
+	servers := newTestCluster(t, 2, FileServerOpts{}, nil)
+	s := servers[1]
+	srv := httptest.NewServer(NewS3Gateway(s))
+	defer srv.Close()
+
+	var (
+		bucket = srv.URL + "/" + s.ID
+		data   = []byte("my big data file here!")
+		etag   = fmt.Sprintf("%q", fmt.Sprintf("%x", md5.Sum(data)))
+	)
+
+	resp := doRequest(t, http.MethodHead, bucket, nil, nil)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	resp = doRequest(t, http.MethodGet, srv.URL+"/unknown/foo", nil, nil)
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+	assert.Equal(t, "NoSuchBucket", readS3Error(t, resp))
+	// The bucket of the other node is on disk, but can't be read from this node
+	assert.Nil(t, servers[0].Store("foo", bytes.NewReader(data)))
+	resp = doRequest(t, http.MethodGet, srv.URL+"/"+servers[0].ID+"/foo", nil, nil)
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+
+	resp = doRequest(t, http.MethodGet, bucket+"/foo", nil, nil)
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+	assert.Equal(t, "NoSuchKey", readS3Error(t, resp))
+
+	resp = doRequest(t, http.MethodPut, bucket+"/foo", bytes.NewReader(data), nil)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, etag, resp.Header.Get("ETag"))
+
+	// Body sent by the SDKs with the aws-chunked encoding and a trailing checksum
+	chunked := fmt.Sprintf("%x;chunk-signature=abc\r\n%s\r\n0;chunk-signature=def\r\nx-amz-checksum-crc32:AAAAAA==\r\n\r\n", len(data), data)
+	resp = doRequest(t, http.MethodPut, bucket+"/bar", strings.NewReader(chunked), map[string]string{
+		"x-amz-content-sha256": "STREAMING-UNSIGNED-PAYLOAD-TRAILER",
+		"Content-Encoding":     "aws-chunked",
+	})
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, etag, resp.Header.Get("ETag"))
+
+	assert.Nil(t, s.store.Delete(s.ID, "bar"))
+	resp = doRequest(t, http.MethodGet, bucket+"/bar", nil, nil)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, etag, resp.Header.Get("ETag"))
+	b, err := io.ReadAll(resp.Body)
+	assert.Nil(t, err)
+	assert.Equal(t, data, b)
+
+	assert.Nil(t, s.store.Delete(s.ID, "bar"))
+	resp = doRequest(t, http.MethodGet, bucket+"/bar", nil, map[string]string{"Range": "bytes=3-5"})
+	assert.Equal(t, http.StatusPartialContent, resp.StatusCode)
+	b, err = io.ReadAll(resp.Body)
+	assert.Nil(t, err)
+	assert.Equal(t, data[3:6], b)
+
+	resp = doRequest(t, http.MethodHead, bucket+"/bar", nil, nil)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, int64(len(data)), resp.ContentLength)
+
+	resp = doRequest(t, http.MethodDelete, bucket+"/bar", nil, nil)
+	assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+	resp = doRequest(t, http.MethodDelete, bucket+"/bar", nil, nil)
+	assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+	resp = doRequest(t, http.MethodHead, bucket+"/bar", nil, nil)
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+	body := `<Delete><Object><Key>foo</Key></Object><Object><Key>missing</Key></Object></Delete>`
+	resp = doRequest(t, http.MethodPost, bucket+"?delete", strings.NewReader(body), nil)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	b, err = io.ReadAll(resp.Body)
+	assert.Nil(t, err)
+	assert.Contains(t, string(b), "<Deleted><Key>foo</Key></Deleted><Deleted><Key>missing</Key></Deleted>")
+	assert.Empty(t, s.index.List(""))
+}
+
+func TestS3GatewayListObjects(t *testing.T) {
+	servers := newTestCluster(t, 1, FileServerOpts{}, nil)
+	s := servers[0]
+	srv := httptest.NewServer(NewS3Gateway(s))
+	defer srv.Close()
+
+	for _, key := range []string{"a/1", "a/2", "b/1", "c", "d"} {
+		assert.Nil(t, s.Store(key, strings.NewReader(key)))
+	}
+
+	list := func(query string) s3ListResult {
+		resp := doRequest(t, http.MethodGet, srv.URL+"/"+s.ID+"?list-type=2&"+query, nil, nil)
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		var res s3ListResult
+		assert.Nil(t, xml.NewDecoder(resp.Body).Decode(&res))
+		return res
+	}
+	keys := func(res s3ListResult) []string {
+		var keys []string
+		for _, p := range res.CommonPrefixes {
+			keys = append(keys, p.Prefix)
+		}
+		for _, o := range res.Contents {
+			keys = append(keys, o.Key)
+		}
+		return keys
+	}
+
+	res := list("")
+	assert.Equal(t, []string{"a/1", "a/2", "b/1", "c", "d"}, keys(res))
+	assert.Equal(t, int64(3), res.Contents[0].Size)
+	assert.False(t, res.IsTruncated)
+
+	assert.Equal(t, []string{"a/1", "a/2"}, keys(list("prefix=a/")))
+
+	// Walk the pages of the listing grouped by the delimiter
+	var (
+		pages [][]string
+		token string
+	)
+	for {
+		res := list("delimiter=/&max-keys=2&continuation-token=" + token)
+		pages = append(pages, keys(res))
+		if !res.IsTruncated {
+			break
+		}
+		token = res.NextContinuationToken
+	}
+	assert.Equal(t, [][]string{{"a/", "b/"}, {"c", "d"}}, pages)
+
+	res = list("start-after=b/1")
+	assert.Equal(t, []string{"c", "d"}, keys(res))
+}
+
+func TestS3GatewayMultipartUpload(t *testing.T) {
+	servers := newTestCluster(t, 2, FileServerOpts{}, nil)
+	s := servers[1]
+	srv := httptest.NewServer(NewS3Gateway(s))
+	defer srv.Close()
+	object := srv.URL + "/" + s.ID + "/big"
+
+	resp := doRequest(t, http.MethodPost, object+"?uploads", nil, nil)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	var initiated struct {
+		UploadId string
+	}
+	assert.Nil(t, xml.NewDecoder(resp.Body).Decode(&initiated))
+
+	var (
+		parts    = [][]byte{bytes.Repeat([]byte("a"), 1000), bytes.Repeat([]byte("b"), 500)}
+		complete = "<CompleteMultipartUpload>"
+	)
+	for i, part := range parts {
+		url := fmt.Sprintf("%s?partNumber=%d&uploadId=%s", object, i+1, initiated.UploadId)
+		resp := doRequest(t, http.MethodPut, url, bytes.NewReader(part), nil)
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		complete += fmt.Sprintf("<Part><PartNumber>%d</PartNumber><ETag>%s</ETag></Part>", i+1, resp.Header.Get("ETag"))
+	}
+	complete += "</CompleteMultipartUpload>"
+
+	resp = doRequest(t, http.MethodPost, object+"?uploadId=unknown", strings.NewReader(complete), nil)
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+	assert.Equal(t, "NoSuchUpload", readS3Error(t, resp))
+
+	unordered := "<CompleteMultipartUpload><Part><PartNumber>2</PartNumber></Part><Part><PartNumber>1</PartNumber></Part></CompleteMultipartUpload>"
+	resp = doRequest(t, http.MethodPost, object+"?uploadId="+initiated.UploadId, strings.NewReader(unordered), nil)
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	assert.Equal(t, "InvalidPartOrder", readS3Error(t, resp))
+
+	// The upload survives a restart of the gateway
+	srv.Close()
+	srv = httptest.NewServer(NewS3Gateway(s))
+	defer srv.Close()
+	object = srv.URL + "/" + s.ID + "/big"
+
+	resp = doRequest(t, http.MethodPost, object+"?uploadId="+initiated.UploadId, strings.NewReader(complete), nil)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	var completed struct {
+		ETag string
+	}
+	assert.Nil(t, xml.NewDecoder(resp.Body).Decode(&completed))
+	var sums []byte
+	for _, part := range parts {
+		sum := md5.Sum(part)
+		sums = append(sums, sum[:]...)
+	}
+	etag := fmt.Sprintf(`"%x-2"`, md5.Sum(sums))
+	assert.Equal(t, etag, completed.ETag)
+
+	resp = doRequest(t, http.MethodHead, object, nil, nil)
+	assert.Equal(t, etag, resp.Header.Get("ETag"))
+
+	resp = doRequest(t, http.MethodGet, object, nil, nil)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	b, err := io.ReadAll(resp.Body)
+	assert.Nil(t, err)
+	assert.Equal(t, append(parts[0], parts[1]...), b)
+
+	// The upload is gone once completed
+	resp = doRequest(t, http.MethodDelete, object+"?uploadId="+initiated.UploadId, nil, nil)
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+}
+
+func TestS3GatewayExpiredUploads(t *testing.T) {
+	s := newTestCluster(t, 1, FileServerOpts{}, nil)[0]
+	dir := filepath.Join(s.store.Root, s3UploadsPath, "old")
+	assert.Nil(t, os.MkdirAll(dir, os.ModePerm))
+	meta, err := json.Marshal(s3UploadMeta{Key: "foo", Created: time.Now().Add(-2 * s3UploadExpiry)})
+	assert.Nil(t, err)
+	assert.Nil(t, os.WriteFile(filepath.Join(dir, s3UploadFile), meta, 0o644))
+
+	g := NewS3Gateway(s)
+	assert.Empty(t, g.uploads)
+	_, err = os.Stat(dir)
+	assert.ErrorIs(t, err, os.ErrNotExist)
+}
+
+func readS3Error(t *testing.T, resp *http.Response) string {
+	var e s3Error
+	assert.Nil(t, xml.NewDecoder(resp.Body).Decode(&e))
+	return e.Code
+}
@@ -2,33 +2,88 @@ package main
 
 import (
 	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/sha256"
 	"encoding/binary"
 	"encoding/gob"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"github.com/marcosvdn7/go-filestorage/p2p"
 	"io"
 	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
 type FileServerOpts struct {
-	ID                  string
+	// ID is the ID of the node, derived from the public key of PrivateKey
+	ID string
+	// PrivateKey is the Ed25519 identity of the node, used to sign the messages it sends.
+	// When nil, the key is loaded from the storage root, being created on the first start
+	PrivateKey          ed25519.PrivateKey
 	EncryptionKey       []byte
 	StorageRoot         string              // Root folder where the store is going to save the files
 	PathTransformerFunc PathTransformerFunc // Transformer func to implement how the folders are going to be organized
 	Transport           p2p.Transport
 	BootstrapNodes      []string
+	// Erasure enables the Reed-Solomon mode: instead of replicating the whole file to
+	// every peer, each peer receives only some of the data/parity shards of the file
+	Erasure *ErasureOpts
+	// ChunkSize enables the chunked mode: files are split into chunks of ChunkSize bytes
+	// described by a manifest, so Get can download the chunks from several peers in parallel
+	ChunkSize int64
+	// CDC enables the content defined chunking, which takes precedence over ChunkSize.
+	// Chunks are cut based on their content, so similar files share most of the chunks
+	// and only the chunks missing on the peers are sent over the network
+	CDC *CDCOpts
+	// Codecs lists the names of the codecs offered to the peers during the handshake,
+	// all of them when empty. See the codecs var for the available ones
+	Codecs []string
+	// Quota limits how many bytes each node can store on this one, no limit when zero
+	Quota int64
 }
 
+const (
+	// minRedialBackoff and maxRedialBackoff bound how long the node waits between the
+	// attempts to dial a lost peer again
+	minRedialBackoff = 100 * time.Millisecond
+	maxRedialBackoff = 30 * time.Second
+)
+
 type FileServer struct {
 	FileServerOpts
 
 	peerLock sync.Mutex
 	peers    map[string]p2p.Peer
 
-	store  *Store
-	quitCh chan struct{} // Empty struct channel to close the server
+	store   *Store
+	index   *FileIndex
+	cluster *ClusterState
+	rs      *ReedSolomon
+	metrics *Metrics
+	nonces  *nonceCache
+	quitCh  chan struct{} // Empty struct channel to close the server
+
+	// refsLock guards the reference counts of the chunks held for the peers
+	refsLock sync.Mutex
+
+	// opsLock guards closing and the additions to ops, so no operation starts once
+	// Shutdown waits for the running ones
+	opsLock  sync.Mutex
+	closing  bool
+	ops      sync.WaitGroup
+	stopOnce sync.Once
+	running  atomic.Bool
+	loopDone chan struct{}
 }
 
 type Message struct {
@@ -40,42 +95,147 @@ type MessageStoreFile struct {
 	ID   string
 	Key  string
 	Size int64
+	// Hash identifies the content being sent, so the receiver never mixes the
+	// bytes of an interrupted transfer with the bytes of a different content
+	Hash string
+	// Offset is where the stream starts, the stream holds Size - Offset bytes
+	Offset int64
 }
 
 type MessageGetFile struct {
+	ID     string
+	Key    string
+	Offset int64
+	// Hash identifies the content of the first Offset bytes the requester holds. The
+	// peer sends the whole file when it holds a different content
+	Hash string
+}
+
+// fileHeader precedes the data of the file sent in response to MessageGetFile
+type fileHeader struct {
+	// Hash is the SHA-256 of the whole file, so the requester can check it
+	Hash [sha256.Size]byte
+	// Offset is where the data starts in the file
+	Offset    int64
+	Remaining int64
+}
+
+// rangeHeader precedes the data of the range sent in response to MessageGetRange
+type rangeHeader struct {
+	// Size is the size of the whole file
+	Size int64
+	// Length is the size of the range, which may be shorter than the length requested
+	Length int64
+}
+
+type MessageGetOffset struct {
+	ID   string
+	Key  string
+	Hash string
+}
+
+type MessageHasChunks struct {
+	ID     string
+	Hashes []string
+}
+
+type MessageStoreShard struct {
+	ID    string
+	Key   string
+	Index int
+	Size  int64
+}
+
+type MessageGetShards struct {
+	ID     string
+	Key    string
+	Shards int
+}
+
+type MessageGetRange struct {
+	ID     string
+	Key    string
+	Offset int64
+	Length int64
+}
+
+// MessageLeave tells the peer the node is leaving the network
+type MessageLeave struct {
+	ID string
+}
+
+type MessageDeleteFile struct {
 	ID  string
 	Key string
+	// Shards is the amount of erasure shards of the file, zero when it's not sharded
+	Shards int
 }
 
-func NewFileServer(opts FileServerOpts) *FileServer {
+// NewFileServer creates the server, loading the node identity, the index and the
+// cluster state saved in the storage root
+func NewFileServer(opts FileServerOpts) (*FileServer, error) {
 	storeOpts := StoreOpts{
 		Root:                opts.StorageRoot,
 		PathTransformerFunc: opts.PathTransformerFunc,
 	}
 
-	if len(opts.ID) == 0 {
-		opts.ID, _ = generateID()
+	if opts.PrivateKey == nil {
+		privKey, err := LoadOrCreateIdentity(filepath.Join(storeOpts.Root, identityFile))
+		if err != nil {
+			return nil, err
+		}
+		opts.PrivateKey = privKey
+	}
+	// The ID is bound to the key, so a node can't claim the files of another node
+	opts.ID = nodeID(opts.PrivateKey.Public().(ed25519.PublicKey))
+
+	store := NewStore(storeOpts)
+	index, err := OpenFileIndex(filepath.Join(store.Root, indexFile))
+	if err != nil {
+		return nil, err
+	}
+	cluster, err := OpenClusterState(filepath.Join(store.Root, clusterFile), opts.ID)
+	if err != nil {
+		return nil, err
 	}
 
 	return &FileServer{
 		FileServerOpts: opts,
-		store:          NewStore(storeOpts),
+		store:          store,
+		index:          index,
+		cluster:        cluster,
+		metrics:        NewMetrics(),
+		nonces:         newNonceCache(),
 		quitCh:         make(chan struct{}),
+		loopDone:       make(chan struct{}),
 		peers:          make(map[string]p2p.Peer),
-	}
+	}, nil
 }
 
 // Start calls the giving transporter listen and accept function to start listening to a server
 func (fs *FileServer) Start() error {
 	fs.init()
+	for _, name := range fs.Codecs {
+		if _, err := codecByName(name); err != nil {
+			return err
+		}
+	}
+	if fs.Erasure != nil && fs.chunked() {
+		return fmt.Errorf("erasure coding and chunked mode can't be enabled together")
+	}
+	if fs.Erasure != nil {
+		rs, err := NewReedSolomon(*fs.Erasure)
+		if err != nil {
+			return err
+		}
+		fs.rs = rs
+	}
 	if err := fs.Transport.ListenAndAccept(); err != nil {
 		return err
 	}
 
-	if len(fs.BootstrapNodes) != 0 {
-		if err := fs.bootstrapNetwork(); err != nil {
-			return err
-		}
+	if err := fs.bootstrapNetwork(); err != nil {
+		return err
 	}
 
 	fs.loop()
@@ -83,66 +243,319 @@ func (fs *FileServer) Start() error {
 	return nil
 }
 
-// Stop close the quit channel, shutting down the connection
+// Stop close the quit channel, shutting down the connection. New operations are
+// refused and the ones in flight are cut, see Shutdown to wait for them
 func (fs *FileServer) Stop() {
-	close(fs.quitCh)
+	fs.opsLock.Lock()
+	fs.closing = true
+	fs.opsLock.Unlock()
+
+	fs.stopOnce.Do(func() {
+		close(fs.quitCh)
+	})
+}
+
+// Shutdown stops the server gracefully: the new operations and requests of the peers
+// are refused with ErrServerClosed, the running ones are waited for, the peers are
+// told the node is leaving and their connections are closed. When the context
+// expires first, the server is stopped right away and the context error is returned
+func (fs *FileServer) Shutdown(ctx context.Context) error {
+	fs.opsLock.Lock()
+	fs.closing = true
+	fs.opsLock.Unlock()
+
+	drained := make(chan struct{})
+	go func() {
+		fs.ops.Wait()
+		fs.leave()
+		close(drained)
+	}()
+
+	var err error
+	select {
+	case <-drained:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+
+	for _, peer := range fs.sortedPeers() {
+		peer.Close()
+	}
+	fs.peerLock.Lock()
+	clear(fs.peers)
+	fs.peerLock.Unlock()
+
+	fs.Stop()
+	if fs.running.Load() {
+		select {
+		case <-fs.loopDone:
+		case <-ctx.Done():
+			err = ctx.Err()
+		}
+	}
+	fmt.Printf("[%s] shut down\n", fs.Transport.Addr())
+
+	return err
+}
+
+// begin registers a new operation, which must call fs.ops.Done once it's over.
+// ErrServerClosed is returned when the server is shutting down
+func (fs *FileServer) begin() error {
+	fs.opsLock.Lock()
+	defer fs.opsLock.Unlock()
+
+	if fs.closing {
+		return fmt.Errorf("[%s] %w", fs.Transport.Addr(), ErrServerClosed)
+	}
+	fs.ops.Add(1)
+
+	return nil
+}
+
+// leave tells the peers the node is leaving the network, so they stop sending it
+// requests. Peers that can't be told will notice when the connection is closed
+func (fs *FileServer) leave() {
+	msg := Message{
+		Payload: MessageLeave{
+			ID: fs.ID,
+		},
+	}
+	for _, peer := range fs.sortedPeers() {
+		stream, err := fs.request(peer, &msg)
+		if err == nil {
+			err = closeAndWait(stream, codecFor(peer))
+		}
+		if err != nil {
+			log.Printf("[%s] could not tell peer (%s) the node is leaving: %s", fs.Transport.Addr(), peer.RemoteAddr().String(), err)
+		}
+	}
+}
+
+// handleMessageLeave forgets the peer, whose connection is closed by the peer itself
+func (fs *FileServer) handleMessageLeave(from string, msg MessageLeave) error {
+	fs.peerLock.Lock()
+	delete(fs.peers, from)
+	fs.peerLock.Unlock()
+
+	// The peer is not dialed again on restart
+	if err := fs.cluster.RemovePeer(msg.ID); err != nil {
+		return err
+	}
+
+	fmt.Printf("[%s] peer (%s) left the network\n", fs.Transport.Addr(), from)
+
+	return nil
+}
+
+// NodeInfo returns the info announced by the server during the handshake with its peers
+func (fs *FileServer) NodeInfo() p2p.NodeInfo {
+	return p2p.NodeInfo{
+		ID:            fs.ID,
+		ListenAddress: fs.Transport.Addr(),
+		Version:       p2p.ProtocolVersion,
+		Features:      append([]string{p2p.FeatureChunking, p2p.FeatureErasure, p2p.FeatureResume}, fs.codecFeatures()...),
+	}
+}
+
+// codecFeatures returns the handshake features announcing the codecs of the server
+func (fs *FileServer) codecFeatures() []string {
+	var features []string
+	for _, c := range codecs {
+		if len(fs.Codecs) == 0 || slices.Contains(fs.Codecs, c.Name()) {
+			features = append(features, codecFeature(c.Name()))
+		}
+	}
+	return features
 }
 
 func (fs *FileServer) OnPeer(p p2p.Peer) error {
 	fs.peerLock.Lock()
 	defer func() {
 		fs.peerLock.Unlock()
-		log.Printf("established connection with remote %s", p.RemoteAddr().String())
+		log.Printf("established connection with remote %s (node %q, features %v)", p.RemoteAddr().String(), p.Info().ID, p.Info().Features)
 	}()
 
 	fs.peers[p.RemoteAddr().String()] = p
 
+	// Peers without an ID skipped the handshake, they can't be told apart
+	if p.Info().ID != "" {
+		if err := fs.cluster.PutPeer(newKnownPeer(p)); err != nil {
+			log.Printf("[%s] could not save peer %s: %s", fs.Transport.Addr(), p.RemoteAddr().String(), err)
+		}
+	}
+	go fs.watchPeer(p)
+
 	return nil
 }
 
-func (fs *FileServer) Store(key string, r io.Reader) error {
+// watchPeer forgets the peer once its connection is closed. When the node dialed the
+// peer, it's dialed again until the connection is back. Peers that left the network
+// were already forgotten, so they are not dialed again
+func (fs *FileServer) watchPeer(p p2p.Peer) {
+	<-p.Done()
+
+	addr := p.RemoteAddr().String()
+	fs.peerLock.Lock()
+	// The peer may have been replaced by a new connection already
+	current, ok := fs.peers[addr]
+	if !ok || current != p {
+		fs.peerLock.Unlock()
+		return
+	}
+	delete(fs.peers, addr)
+	fs.peerLock.Unlock()
+
+	fmt.Printf("[%s] lost connection to peer (%s)\n", fs.Transport.Addr(), addr)
+	// The peer was seen up to now, which is when its expiry starts. Nothing is saved
+	// once the server is stopping
+	if p.Info().ID != "" && fs.begin() == nil {
+		if err := fs.cluster.PutPeer(newKnownPeer(p)); err != nil {
+			log.Printf("[%s] could not save peer %s: %s", fs.Transport.Addr(), addr, err)
+		}
+		fs.ops.Done()
+	}
+	if p.Outbound() {
+		fs.redial(peerAddress(p), p.Info().ID)
+	}
+}
+
+// redial dials the peer with an exponential backoff until it's connected again, by
+// either side, the server stops or the peer is forgotten
+func (fs *FileServer) redial(addr, id string) {
+	for backoff := minRedialBackoff; ; backoff = min(backoff*2, maxRedialBackoff) {
+		select {
+		case <-fs.quitCh:
+			return
+		case <-time.After(backoff):
+		}
+		if fs.connected(addr, id) {
+			return
+		}
+		if !fs.knownPeer(id) {
+			fmt.Printf("[%s] giving up on peer (%s), not seen for %s\n", fs.Transport.Addr(), addr, knownPeerTTL)
+			return
+		}
+		if err := fs.Transport.Dial(addr); err != nil {
+			log.Printf("[%s] could not dial peer (%s) again: %s", fs.Transport.Addr(), addr, err)
+		}
+	}
+}
+
+// knownPeer reports if the peer with the ID is still in the cluster state, removing
+// it once it expired. Peers without an ID are not saved, so they never expire
+func (fs *FileServer) knownPeer(id string) bool {
+	if id == "" {
+		return true
+	}
+	peer, ok := fs.cluster.Peer(id)
+	if !ok {
+		return false
+	}
+	if time.Since(peer.LastSeen) <= knownPeerTTL {
+		return true
+	}
+	if err := fs.cluster.RemovePeer(id); err != nil {
+		log.Printf("[%s] could not remove peer %s: %s", fs.Transport.Addr(), id, err)
+	}
+	return false
+}
+
+// connected reports if the node is connected to the peer with the ID, or at the
+// address for the peers without an ID
+func (fs *FileServer) connected(addr, id string) bool {
+	for _, p := range fs.sortedPeers() {
+		if id != "" && p.Info().ID == id || id == "" && sameAddress(peerAddress(p), addr) {
+			return true
+		}
+	}
+	return false
+}
+
+func (fs *FileServer) Store(key string, r io.Reader) (err error) {
+	if err := checkKey(key); err != nil {
+		return err
+	}
+	if err := fs.begin(); err != nil {
+		return err
+	}
+	defer fs.ops.Done()
+	defer fs.metrics.observeOperation("store", time.Now(), &err)
+
+	// The file is streamed to the disk, and the peers are sent the file read back from
+	// the disk, so it's never held in memory. The IV is derived from the content as
+	// convergentIV does, so sending the same file again produces the same encrypted
+	// data and an interrupted transfer can be resumed
 	var (
-		fileBuffer = new(bytes.Buffer)
-		tee        = io.TeeReader(r, fileBuffer)
+		hasher = newFileHasher()
+		mac    = hmac.New(sha256.New, fs.EncryptionKey)
 	)
-
-	size, err := fs.store.Write(fs.ID, key, tee)
+	size, err := fs.store.Write(fs.ID, key, io.TeeReader(r, io.MultiWriter(hasher, mac)))
 	if err != nil {
 		return err
 	}
-	msg := Message{
-		Payload: MessageStoreFile{
-			ID:   fs.ID,
-			Key:  hashKey(key),
-			Size: size + 16,
-		},
+	fs.metrics.bytesStored.add(float64(size), "client")
+	if err := fs.index.Put(hasher.info(key, size)); err != nil {
+		return err
 	}
 
-	if err := fs.broadcast(&msg); err != nil {
+	// The replication lag runs from the moment the file is on the local disk
+	written := time.Now()
+	defer func() {
+		if err == nil {
+			fs.metrics.replication.observe(time.Since(written).Seconds(), fs.replicationMode())
+		}
+	}()
+	_, f, err := fs.store.Read(fs.ID, key)
+	if err != nil {
 		return err
 	}
+	defer f.(io.Closer).Close()
 
-	time.Sleep(time.Millisecond * 5)
-
-	var peers []io.Writer
-	for _, peer := range fs.peers {
-		peers = append(peers, peer)
+	if fs.rs != nil {
+		return fs.storeShards(key, f)
 	}
-	mw := io.MultiWriter(peers...)
-	if _, err = mw.Write([]byte{p2p.IncomingStream}); err != nil {
-		return err
+	if fs.chunked() {
+		return fs.storeChunks(key, f)
 	}
-	n, err := copyEncrypt(fs.EncryptionKey, fileBuffer, mw)
+
+	encrypted, err := fs.encryptedContent(f.(io.ReadSeeker), size, mac.Sum(nil)[:aes.BlockSize])
 	if err != nil {
 		return err
 	}
 
-	fmt.Printf("[%s] received and writter (%d) bytes to disk\n", fs.Transport.Addr(), n)
+	peers := fs.sortedPeers()
+	for _, peer := range peers {
+		if err := fs.transfer(peer, hashKey(key), encrypted); err != nil {
+			return err
+		}
+	}
+
+	fmt.Printf("[%s] stored (%d) bytes to disk and replicated to %d peers\n", fs.Transport.Addr(), size, len(peers))
 
 	return nil
 }
 
-func (fs *FileServer) Get(key string) (io.Reader, error) {
+func (fs *FileServer) Get(key string) (_ io.Reader, err error) {
+	if err := checkKey(key); err != nil {
+		return nil, err
+	}
+	if err := fs.begin(); err != nil {
+		return nil, err
+	}
+	defer fs.ops.Done()
+	defer fs.metrics.observeOperation("get", time.Now(), &err)
+
+	r, err := fs.get(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return fs.metrics.countServed(r), nil
+}
+
+// get returns the file from the local disk, fetching it from the peers first when
+// it's missing
+func (fs *FileServer) get(key string) (io.Reader, error) {
 	if fs.store.Has(fs.ID, key) {
 		fmt.Printf("[%s] serving file (%s) from local disk\n", fs.Transport.Addr(), key)
 		_, r, err := fs.store.Read(fs.ID, key)
@@ -151,111 +564,556 @@ func (fs *FileServer) Get(key string) (io.Reader, error) {
 
 	fmt.Printf("[%s] don't have file (%s) locally, fetching from network\n", fs.Transport.Addr(), key)
 
-	msg := Message{
-		Payload: MessageGetFile{
-			ID:  fs.ID,
-			Key: hashKey(key),
-		},
+	if fs.rs != nil {
+		return fs.getShards(key)
+	}
+	if fs.chunked() {
+		return fs.getChunks(key)
+	}
+
+	// Try one peer at a time. When a peer drops in the middle of the download
+	// the next one resumes from the bytes already on disk
+	err := ErrNotFound
+	for _, peer := range fs.sortedPeers() {
+		if err = fs.download(peer, key); err == nil {
+			_, r, err := fs.store.Read(fs.ID, key)
+			return r, err
+		}
+		log.Printf("[%s] download of (%s) from peer (%s) failed: %s", fs.Transport.Addr(), key, peer.RemoteAddr().String(), err)
+	}
+
+	return nil, fmt.Errorf("[%s] could not fetch (%s) from the network: %w", fs.Transport.Addr(), key, err)
+}
+
+// GetRange returns up to length bytes of the file starting at the offset. Unlike Get,
+// only the bytes of the range are fetched from the network, except in the erasure mode
+// where the whole file is needed to rebuild the shards
+func (fs *FileServer) GetRange(key string, offset, length int64) (_ io.ReadCloser, err error) {
+	if err := checkKey(key); err != nil {
+		return nil, err
+	}
+	if err := fs.begin(); err != nil {
+		return nil, err
 	}
+	defer fs.ops.Done()
+	defer fs.metrics.observeOperation("get_range", time.Now(), &err)
 
-	if err := fs.broadcast(&msg); err != nil {
+	r, err := fs.openRange(key, offset, length)
+	if err != nil {
 		return nil, err
 	}
 
-	time.Sleep(time.Millisecond * 500)
+	return fs.metrics.countServed(r), nil
+}
 
-	for _, peer := range fs.peers {
-		// First read the file size so we can limit the amount of bytes that we read from the connection
-		// so it will not keep hanging
-		var fileSize int64
-		if err := binary.Read(peer, binary.LittleEndian, &fileSize); err != nil {
-			return nil, err
+// openRange returns the range of the file from the local disk, fetching it from the
+// peers first when the file is missing
+func (fs *FileServer) openRange(key string, offset, length int64) (io.ReadCloser, error) {
+	if !fs.store.Has(fs.ID, key) {
+		switch {
+		case fs.rs != nil:
+			r, err := fs.getShards(key)
+			if err != nil {
+				return nil, err
+			}
+			r.(io.Closer).Close()
+		case fs.chunked():
+			return fs.getChunksRange(key, offset, length)
+		default:
+			return fs.getRange(key, offset, length)
 		}
-		n, err := fs.store.WriteDecrypt(fs.ID, key, fs.EncryptionKey, io.LimitReader(peer, fileSize))
+	}
+	_, r, err := fs.store.ReadRange(fs.ID, key, offset, length)
+
+	return r, err
+}
+
+// Stat returns the info of the file. Files on the local disk missing in the index,
+// like the ones fetched by Get, are added to it. Files only held by the peers are not
+// fetched, so only their size is known
+func (fs *FileServer) Stat(key string) (FileInfo, error) {
+	if err := checkKey(key); err != nil {
+		return FileInfo{}, err
+	}
+	if info, ok := fs.index.Get(key); ok {
+		return info, nil
+	}
+	if err := fs.begin(); err != nil {
+		return FileInfo{}, err
+	}
+	defer fs.ops.Done()
+
+	// The erasure mode needs the whole file to know its size, as GetRange does
+	if fs.rs != nil && !fs.store.Has(fs.ID, key) {
+		r, err := fs.getShards(key)
 		if err != nil {
-			return nil, err
+			return FileInfo{}, err
 		}
-		fmt.Printf("[%s] received %d bytes from peer (%s)\n", fs.Transport.Addr(), n, peer.RemoteAddr().String())
-
-		peer.CloseStream()
+		r.(io.Closer).Close()
 	}
+	if !fs.store.Has(fs.ID, key) {
+		size, err := fs.remoteSize(key)
+		return FileInfo{Key: key, Size: size}, err
+	}
+
 	_, r, err := fs.store.Read(fs.ID, key)
+	if err != nil {
+		return FileInfo{}, err
+	}
+	defer r.(io.Closer).Close()
 
-	return r, err
+	hasher := newFileHasher()
+	size, err := io.Copy(hasher, r)
+	if err != nil {
+		return FileInfo{}, err
+	}
+	info := hasher.info(key, size)
+
+	return info, fs.index.Put(info)
 }
 
-func (fs *FileServer) broadcast(msg *Message) error {
-	buf := new(bytes.Buffer)
-	if err := gob.NewEncoder(buf).Encode(msg); err != nil {
+// Delete removes the file from the local disk and from every peer. It fails with
+// ErrNotFound when no node holds the file
+func (fs *FileServer) Delete(key string) (err error) {
+	if err := checkKey(key); err != nil {
+		return err
+	}
+	if err := fs.begin(); err != nil {
 		return err
 	}
+	defer fs.ops.Done()
+	defer fs.metrics.observeOperation("delete", time.Now(), &err)
 
-	for _, peer := range fs.peers {
-		if err := peer.Send([]byte{p2p.IncomingMessage}); err != nil {
+	found := true
+	if err := fs.store.Remove(fs.ID, key); err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		found = false
+	}
+
+	if err := fs.index.Remove(key); err != nil {
+		return err
+	}
+
+	var shards int
+	if fs.Erasure != nil {
+		shards = fs.Erasure.TotalShards()
+	}
+	msg := Message{
+		Payload: MessageDeleteFile{
+			ID:     fs.ID,
+			Key:    hashKey(key),
+			Shards: shards,
+		},
+	}
+	for _, peer := range fs.sortedPeers() {
+		stream, err := fs.request(peer, &msg)
+		if err != nil {
 			return err
 		}
-		if err := peer.Send(buf.Bytes()); err != nil {
+		err = closeAndWait(stream, codecFor(peer))
+		if errors.Is(err, ErrNotFound) {
+			continue
+		}
+		if err != nil {
 			return err
 		}
+		found = true
 	}
+	if !found {
+		return fmt.Errorf("[%s] can't delete (%s): %w", fs.Transport.Addr(), key, ErrNotFound)
+	}
+
+	fmt.Printf("[%s] deleted (%s) from disk and from the network\n", fs.Transport.Addr(), key)
 
 	return nil
 }
 
+// storeShards encrypts the file, splits the encrypted data into data + parity shards
+// and spreads them between the peers, so each peer only holds a fraction of the file
+func (fs *FileServer) storeShards(key string, r io.Reader) error {
+	encrypted := new(bytes.Buffer)
+	if _, err := copyEncrypt(fs.EncryptionKey, r, encrypted); err != nil {
+		return err
+	}
+	size := int64(encrypted.Len())
+
+	shards := fs.rs.Split(encrypted.Bytes())
+	if err := fs.rs.Encode(shards); err != nil {
+		return err
+	}
+
+	peers := fs.sortedPeers()
+	if len(peers) == 0 {
+		return fmt.Errorf("[%s] no peers available to store the shards of (%s)", fs.Transport.Addr(), key)
+	}
+	if len(peers) < len(shards) {
+		log.Printf("[%s] only %d peers for %d shards, some peers will hold more than one shard", fs.Transport.Addr(), len(peers), len(shards))
+	}
+
+	for i, shard := range shards {
+		peer := peers[i%len(peers)]
+		// Every stored shard is prefixed with the size of the encrypted file, so it
+		// can be trimmed back after the shards are joined
+		msg := Message{
+			Payload: MessageStoreShard{
+				ID:    fs.ID,
+				Key:   hashKey(key),
+				Index: i,
+				Size:  int64(8 + len(shard)),
+			},
+		}
+		stream, err := fs.request(peer, &msg)
+		if err != nil {
+			return err
+		}
+		if err := binary.Write(stream, binary.LittleEndian, size); err != nil {
+			stream.Close()
+			return err
+		}
+		if _, err := stream.Write(shard); err != nil {
+			stream.Close()
+			return err
+		}
+		if err := closeAndWait(stream, codecFor(peer)); err != nil {
+			return err
+		}
+	}
+
+	fmt.Printf("[%s] stored %d shards of (%s) over %d peers\n", fs.Transport.Addr(), len(shards), key, len(peers))
+
+	return nil
+}
+
+// getShards requests the shards of the file to every peer and rebuilds the file
+// as long as any DataShards of them are received
+func (fs *FileServer) getShards(key string) (io.Reader, error) {
+	msg := Message{
+		Payload: MessageGetShards{
+			ID:     fs.ID,
+			Key:    hashKey(key),
+			Shards: fs.rs.TotalShards(),
+		},
+	}
+
+	var (
+		shards = make([][]byte, fs.rs.TotalShards())
+		size   int64
+	)
+	var received int64
+	for _, peer := range fs.sortedPeers() {
+		n, err := fs.readShards(peer, &msg, shards, &size)
+		if err != nil {
+			// Any DataShards of the shards are enough, so a failing peer is skipped
+			log.Printf("[%s] could not fetch the shards of (%s) from peer (%s): %s", fs.Transport.Addr(), key, peer.RemoteAddr().String(), err)
+			continue
+		}
+		received += n
+		fmt.Printf("[%s] received %d shards from peer (%s)\n", fs.Transport.Addr(), n, peer.RemoteAddr().String())
+	}
+	if received == 0 {
+		return nil, fmt.Errorf("[%s] no shard of (%s) found in the network: %w", fs.Transport.Addr(), key, ErrNotFound)
+	}
+
+	if err := fs.rs.Reconstruct(shards); err != nil {
+		return nil, err
+	}
+	data, err := fs.rs.Join(shards, int(size))
+	if err != nil {
+		return nil, err
+	}
+	if _, err := fs.store.WriteDecrypt(fs.ID, key, fs.EncryptionKey, bytes.NewReader(data)); err != nil {
+		return nil, err
+	}
+	_, r, err := fs.store.Read(fs.ID, key)
+
+	return r, err
+}
+
+// readShards requests the shards to the peer and saves them into shards. Every peer
+// answers with the amount of shards it holds, followed by the index and size of each shard
+func (fs *FileServer) readShards(peer p2p.Peer, msg *Message, shards [][]byte, size *int64) (int64, error) {
+	stream, err := fs.query(peer, msg)
+	if err != nil {
+		return 0, err
+	}
+	defer stream.Close()
+
+	var count int64
+	if err := binary.Read(stream, binary.LittleEndian, &count); err != nil {
+		return 0, err
+	}
+	for i := int64(0); i < count; i++ {
+		var index, shardSize int64
+		if err := binary.Read(stream, binary.LittleEndian, &index); err != nil {
+			return 0, err
+		}
+		if err := binary.Read(stream, binary.LittleEndian, &shardSize); err != nil {
+			return 0, err
+		}
+		if index < 0 || index >= int64(len(shards)) || shardSize < 8 {
+			return 0, fmt.Errorf("invalid shard %d received", index)
+		}
+		var encryptedSize int64
+		if err := binary.Read(stream, binary.LittleEndian, &encryptedSize); err != nil {
+			return 0, err
+		}
+		// Every shard holds an equal part of the encrypted file, so a shard of any
+		// other size, or of another file size than the shards already received, is
+		// refused before it is read
+		data := int64(fs.rs.DataShards)
+		if encryptedSize < 0 || (*size > 0 && encryptedSize != *size) || shardSize-8 != (encryptedSize+data-1)/data {
+			return 0, fmt.Errorf("%w: shard %d of %d bytes received for a file of %d bytes", ErrInvalid, index, shardSize, encryptedSize)
+		}
+		shard, err := io.ReadAll(io.LimitReader(stream, shardSize-8))
+		if err != nil {
+			return 0, err
+		}
+		if int64(len(shard)) < shardSize-8 {
+			return 0, io.ErrUnexpectedEOF
+		}
+		*size = encryptedSize
+		shards[index] = shard
+	}
+
+	return count, nil
+}
+
+// chunked reports if the files are split into chunks before being sent to the peers
+func (fs *FileServer) chunked() bool {
+	return fs.ChunkSize > 0 || fs.CDC != nil
+}
+
+// replicationMode returns how the files are sent to the peers, named like the modes
+// of the config
+func (fs *FileServer) replicationMode() string {
+	switch {
+	case fs.rs != nil:
+		return "erasure"
+	case fs.CDC != nil:
+		return "cdc"
+	case fs.ChunkSize > 0:
+		return "chunked"
+	}
+	return "full"
+}
+
+// sortedPeers returns the connected peers ordered by address, so the shards
+// are always spread in the same order
+func (fs *FileServer) sortedPeers() []p2p.Peer {
+	fs.peerLock.Lock()
+	defer fs.peerLock.Unlock()
+
+	peers := make([]p2p.Peer, 0, len(fs.peers))
+	for _, peer := range fs.peers {
+		peers = append(peers, peer)
+	}
+	sort.Slice(peers, func(i, j int) bool {
+		return peers[i].RemoteAddr().String() < peers[j].RemoteAddr().String()
+	})
+
+	return peers
+}
+
+// request opens a new stream to the peer and sends the message as the header of the
+// stream. The data of the request and the response go through the returned stream
+func (fs *FileServer) request(peer p2p.Peer, msg *Message) (p2p.Stream, error) {
+	b, err := fs.encodeMessage(codecFor(peer), msg)
+	if err != nil {
+		return nil, err
+	}
+
+	stream, err := peer.OpenStream()
+	if err != nil {
+		return nil, err
+	}
+	fs.metrics.streams.add(1, "outbound")
+	if _, err := stream.Write(p2p.NewMessageFrame(b)); err != nil {
+		stream.Close()
+		return nil, err
+	}
+
+	return stream, nil
+}
+
+// query sends the request and reads the response of the peer, so the data requested
+// can be read from the returned stream
+func (fs *FileServer) query(peer p2p.Peer, msg *Message) (p2p.Stream, error) {
+	stream, err := fs.request(peer, msg)
+	if err != nil {
+		return nil, err
+	}
+	if err := readResponse(stream, codecFor(peer)); err != nil {
+		stream.Close()
+		return nil, err
+	}
+
+	return stream, nil
+}
+
+// codecFrom returns the codec negotiated with the peer at the remote address
+func (fs *FileServer) codecFrom(addr string) Codec {
+	fs.peerLock.Lock()
+	peer, ok := fs.peers[addr]
+	fs.peerLock.Unlock()
+	if !ok {
+		return GOBCodec{}
+	}
+
+	return codecFor(peer)
+}
+
+// closeAndWait closes the stream and waits until the remote handled the request,
+// returning the error it responded with
+func closeAndWait(stream p2p.Stream, codec Codec) error {
+	if err := stream.Close(); err != nil {
+		return err
+	}
+	if err := readResponse(stream, codec); err != nil {
+		return err
+	}
+	_, err := io.Copy(io.Discard, stream)
+	return err
+}
+
 // loop Creates the for/select responsible to handle the receiving messages
 func (fs *FileServer) loop() {
+	fs.running.Store(true)
 	defer func() {
 		log.Println("file server stopped due to error or user action")
 		fs.Transport.Close()
+		close(fs.loopDone)
 	}()
 	for {
 		select {
 		case rpc := <-fs.Transport.Consume():
-			var msg Message
-			if err := gob.NewDecoder(bytes.NewReader(rpc.Payload)).Decode(&msg); err != nil {
-				fmt.Printf("Error decoding received message: %s\n", err)
+			// Every request carries its data and its response over a stream, the
+			// node never sends control messages
+			if rpc.Stream == nil {
+				fmt.Printf("[%s] dropping message from %s: not sent over a stream\n", fs.Transport.Addr(), rpc.From)
+				continue
 			}
 
-			if err := fs.handleMessage(rpc.From, &msg); err != nil {
-				fmt.Printf("Error handling message: %s\n", err)
+			codec := fs.codecFrom(rpc.From)
+			msg, signed, err := decodeMessage(codec, rpc.Payload)
+			if err != nil {
+				fs.metrics.decodeErrors.add(1)
 			}
+			if errors.Is(err, ErrInvalidSignature) {
+				err = fmt.Errorf("%w: %w", ErrForbidden, err)
+			}
+			if err == nil {
+				err = fs.verifySender(rpc.From, signed, msg)
+			}
+			if err != nil {
+				fmt.Printf("[%s] dropping message from %s: %s\n", fs.Transport.Addr(), rpc.From, err)
+				go newResponseStream(rpc.Stream, codec).finish(err)
+				continue
+			}
+
+			// Streams are handled in their own goroutine, so a long transfer
+			// never blocks the other messages. The outcome of the handler is
+			// sent back to the requester
+			if err := fs.begin(); err != nil {
+				go newResponseStream(rpc.Stream, codec).finish(err)
+				continue
+			}
+			fs.metrics.streams.add(1, "inbound")
+			fs.metrics.activeStreams.Add(1)
+			go func() {
+				defer fs.ops.Done()
+				defer fs.metrics.activeStreams.Add(-1)
+				start := time.Now()
+				stream := newResponseStream(rpc.Stream, codec)
+				err := fs.handleMessage(rpc.From, stream, msg)
+				fs.metrics.observePeerRequest(msg, start, err)
+				if err != nil {
+					fmt.Printf("Error handling message: %s\n", err)
+				}
+				stream.finish(err)
+			}()
 		case <-fs.quitCh:
 			return
 		}
 	}
 }
 
-func (fs *FileServer) handleMessage(from string, msg *Message) error {
+func (fs *FileServer) handleMessage(from string, stream p2p.Stream, msg *Message) error {
+	if err := checkMessage(msg.Payload); err != nil {
+		return err
+	}
+
 	switch v := msg.Payload.(type) {
 	case MessageStoreFile:
-		return fs.handleMessageStoreFile(from, v)
+		return fs.handleMessageStoreFile(stream, v)
 	case MessageGetFile:
-		return fs.handleMessageGetFile(from, &v)
+		return fs.handleMessageGetFile(from, stream, &v)
+	case MessageGetOffset:
+		return fs.handleMessageGetOffset(stream, v)
+	case MessageHasChunks:
+		return fs.handleMessageHasChunks(stream, v)
+	case MessageStoreShard:
+		return fs.handleMessageStoreShard(stream, v)
+	case MessageGetShards:
+		return fs.handleMessageGetShards(from, stream, v)
+	case MessageDeleteFile:
+		return fs.handleMessageDeleteFile(stream, v)
+	case MessageGetRange:
+		return fs.handleMessageGetRange(from, stream, v)
+	case MessageLeave:
+		return fs.handleMessageLeave(from, v)
 	}
 	return nil
 }
 
-func (fs *FileServer) handleMessageStoreFile(from string, msg MessageStoreFile) error {
-	peer, ok := fs.peers[from]
-	if !ok {
-		return fmt.Errorf("peer %s not found in the peer map", from)
+// checkQuota fails with ErrQuotaExceeded when storing size more bytes of the node
+// would go over the quota
+func (fs *FileServer) checkQuota(id string, size int64) error {
+	if fs.Quota <= 0 {
+		return nil
+	}
+	usage, err := fs.store.Usage(id)
+	if err != nil {
+		return err
+	}
+	if usage+size > fs.Quota {
+		return fmt.Errorf("[%s] node %s would use %d of %d bytes: %w", fs.Transport.Addr(), id, usage+size, fs.Quota, ErrQuotaExceeded)
 	}
 
-	n, err := fs.store.Write(msg.ID, msg.Key, io.LimitReader(peer, msg.Size))
+	return nil
+}
+
+func (fs *FileServer) handleMessageStoreFile(stream p2p.Stream, msg MessageStoreFile) error {
+	if err := fs.checkQuota(msg.ID, msg.Size-msg.Offset); err != nil {
+		return err
+	}
+	// The bytes are written to a partial file, which is only moved to the final
+	// path once the whole content is received
+	n, err := fs.store.WritePartial(msg.ID, msg.Key, msg.Hash, msg.Offset, io.LimitReader(stream, msg.Size-msg.Offset))
 	if err != nil {
 		return err
 	}
+	fs.metrics.bytesStored.add(float64(n), "peer")
+	if msg.Offset+n < msg.Size {
+		return fmt.Errorf("[%s] transfer of (%s) interrupted at byte %d of %d", fs.Transport.Addr(), msg.Key, msg.Offset+n, msg.Size)
+	}
+	// The chunks of a file are only deleted once no manifest references them
+	commit := fs.store.CommitPartial
+	if isManifestKey(msg.Key) {
+		commit = fs.commitManifest
+	}
+	if err := commit(msg.ID, msg.Key, msg.Hash); err != nil {
+		return err
+	}
 	fmt.Printf("[%s] writen %d bytes to disk\n", fs.Transport.Addr(), n)
 
-	peer.CloseStream()
-	fmt.Printf("[%s] stream close, resuming read loop\n", peer.RemoteAddr().String())
-
 	return nil
 }
 
-func (fs *FileServer) handleMessageGetFile(from string, msg *MessageGetFile) error {
+func (fs *FileServer) handleMessageGetFile(from string, stream p2p.Stream, msg *MessageGetFile) error {
 	if !fs.store.Has(msg.ID, msg.Key) {
-		return fmt.Errorf("[%s] need to serve file %s but it does not exist on disk", fs.Transport.Addr(), msg.Key)
+		return fmt.Errorf("[%s] need to serve file %s but it does not exist on disk: %w", fs.Transport.Addr(), msg.Key, ErrNotFound)
 	}
 
 	fmt.Printf("[%s] serving file (%s) over the network\n", fs.Transport.Addr(), msg.Key)
@@ -269,21 +1127,29 @@ func (fs *FileServer) handleMessageGetFile(from string, msg *MessageGetFile) err
 		defer rc.Close()
 	}
 
-	peer, ok := fs.peers[from]
-	if !ok {
-		return fmt.Errorf("[%s] peer %s not found in the peer map", fs.Transport.Addr(), from)
+	var header fileHeader
+	if header.Hash, err = hashContent(r); err != nil {
+		return err
 	}
 
-	// First send the "incomingStream" byte to the peer, and then we can send
-	// the file fileSize as an int64
-	if err := peer.Send([]byte{p2p.IncomingStream}); err != nil {
+	// When resuming an interrupted download of the same content only the bytes after
+	// the offset are sent
+	if msg.Hash == hex.EncodeToString(header.Hash[:]) && msg.Offset <= fileSize {
+		header.Offset = msg.Offset
+	}
+	if _, err := r.(io.Seeker).Seek(header.Offset, io.SeekStart); err != nil {
 		return err
 	}
-	if err := binary.Write(peer, binary.LittleEndian, &fileSize); err != nil {
+	header.Remaining = fileSize - header.Offset
+
+	// First send the header, so the requester knows how many bytes to read from
+	// the stream and which content they belong to
+	if err := binary.Write(stream, binary.LittleEndian, &header); err != nil {
 		return err
 	}
 
-	n, err := io.Copy(peer, r)
+	n, err := io.Copy(stream, r)
+	fs.metrics.bytesServed.add(float64(n), "peer")
 	if err != nil {
 		return err
 	}
@@ -293,9 +1159,124 @@ func (fs *FileServer) handleMessageGetFile(from string, msg *MessageGetFile) err
 	return nil
 }
 
-// bootstrapNetwork dials and establish a connection with every node in the network
+func (fs *FileServer) handleMessageStoreShard(stream p2p.Stream, msg MessageStoreShard) error {
+	if err := fs.checkQuota(msg.ID, msg.Size); err != nil {
+		return err
+	}
+	n, err := fs.store.Write(msg.ID, shardKey(msg.Key, msg.Index), io.LimitReader(stream, msg.Size))
+	if err != nil {
+		return err
+	}
+	fs.metrics.bytesStored.add(float64(n), "peer")
+	fmt.Printf("[%s] writen shard %d (%d bytes) to disk\n", fs.Transport.Addr(), msg.Index, n)
+
+	return nil
+}
+
+func (fs *FileServer) handleMessageGetShards(from string, stream p2p.Stream, msg MessageGetShards) error {
+	var indexes []int
+	for i := 0; i < msg.Shards; i++ {
+		if fs.store.Has(msg.ID, shardKey(msg.Key, i)) {
+			indexes = append(indexes, i)
+		}
+	}
+
+	// Peers without any shard still answer, so the requester knows there is
+	// nothing to wait for
+	if err := binary.Write(stream, binary.LittleEndian, int64(len(indexes))); err != nil {
+		return err
+	}
+
+	for _, i := range indexes {
+		if err := fs.sendShard(stream, msg.ID, msg.Key, i); err != nil {
+			return err
+		}
+	}
+
+	fmt.Printf("[%s] served %d shards of (%s) over the network to %s\n", fs.Transport.Addr(), len(indexes), msg.Key, from)
+
+	return nil
+}
+
+func (fs *FileServer) sendShard(w io.Writer, id, key string, index int) error {
+	size, r, err := fs.store.Read(id, shardKey(key, index))
+	if err != nil {
+		return err
+	}
+	if rc, ok := r.(io.ReadCloser); ok {
+		defer rc.Close()
+	}
+
+	if err := binary.Write(w, binary.LittleEndian, int64(index)); err != nil {
+		return err
+	}
+	if err := binary.Write(w, binary.LittleEndian, size); err != nil {
+		return err
+	}
+	n, err := io.CopyN(w, r, size)
+	fs.metrics.bytesServed.add(float64(n), "peer")
+
+	return err
+}
+
+// handleMessageDeleteFile removes the file along with its manifest and shards. The
+// chunks of the manifest are only removed when no other file references them
+func (fs *FileServer) handleMessageDeleteFile(stream p2p.Stream, msg MessageDeleteFile) error {
+	keys := []string{msg.Key, manifestKey(msg.Key)}
+	for i := 0; i < msg.Shards; i++ {
+		keys = append(keys, shardKey(msg.Key, i))
+	}
+
+	var removed int
+	for _, key := range keys {
+		remove := fs.store.Remove
+		if isManifestKey(key) {
+			remove = fs.removeManifest
+		}
+		err := remove(msg.ID, key)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		removed++
+	}
+	if removed == 0 {
+		return fmt.Errorf("[%s] need to delete file %s but it does not exist on disk: %w", fs.Transport.Addr(), msg.Key, ErrNotFound)
+	}
+	fmt.Printf("[%s] deleted %d files of (%s) from disk\n", fs.Transport.Addr(), removed, msg.Key)
+
+	return nil
+}
+
+// shardKey returns the key used to store the shard with the given index
+func shardKey(key string, index int) string {
+	return fmt.Sprintf("%s.shard.%d", key, index)
+}
+
+// bootstrapNetwork dials the bootstrap nodes and the peers the node dialed before
+// a restart, unless they were not seen for too long
 func (fs *FileServer) bootstrapNetwork() error {
-	for _, addr := range fs.BootstrapNodes {
+	expired, err := fs.cluster.ExpirePeers(time.Now().Add(-knownPeerTTL))
+	if err != nil {
+		return err
+	}
+	for _, peer := range expired {
+		fmt.Printf("[%s] forgetting peer (%s), not seen since %s\n", fs.Transport.Addr(), peer.Address, peer.LastSeen.Format(time.RFC3339))
+	}
+
+	addrs := slices.Clone(fs.BootstrapNodes)
+	for _, peer := range fs.cluster.Peers() {
+		if !peer.Outbound {
+			continue
+		}
+		if !slices.ContainsFunc(addrs, func(addr string) bool { return sameAddress(addr, peer.Address) }) {
+			addrs = append(addrs, peer.Address)
+		}
+	}
+
+	for _, addr := range addrs {
 		if len(addr) == 0 {
 			continue
 		}
@@ -311,6 +1292,7 @@ func (fs *FileServer) bootstrapNetwork() error {
 }
 
 func (fs *FileServer) init() {
-	gob.Register(MessageStoreFile{})
-	gob.Register(MessageGetFile{})
+	for _, t := range messageTypes {
+		gob.Register(t)
+	}
 }
@@ -0,0 +1,508 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/marcosvdn7/go-filestorage/p2p"
+	"github.com/stretchr/testify/assert"
+)
+
+// serverModes are the ways a file can be spread between the peers, named like the
+// replication modes of the config
+var serverModes = map[string]FileServerOpts{
+	"replication": {},
+	"erasure":     {Erasure: &ErasureOpts{DataShards: 2, ParityShards: 1}},
+	"chunked":     {ChunkSize: 4096},
+	"cdc":         {CDC: &CDCOpts{MinSize: 1024, AvgSize: 4096, MaxSize: 16384}},
+}
+
+func TestFileServerStoreGet(t *testing.T) {
+	for name, opts := range serverModes {
+		t.Run(name, func(t *testing.T) {
+			servers := newTestCluster(t, 4, opts, nil)
+			s := servers[3]
+
+			data := make([]byte, 50000)
+			rand.New(rand.NewSource(1)).Read(data)
+			assert.Nil(t, s.Store("foo", bytes.NewReader(data)))
+
+			// Remove the local copy, so it has to come from the other nodes
+			assert.Nil(t, s.store.Delete(s.ID, "foo"))
+			assert.False(t, s.store.Has(s.ID, "foo"))
+
+			r, err := s.Get("foo")
+			assert.Nil(t, err)
+			b, err := io.ReadAll(r)
+			assert.Nil(t, err)
+			assert.Equal(t, data, b)
+		})
+	}
+}
+
+func TestFileServerGetRange(t *testing.T) {
+	for name, opts := range serverModes {
+		t.Run(name, func(t *testing.T) {
+			servers := newTestCluster(t, 3, opts, nil)
+			s := servers[2]
+
+			data := make([]byte, 50000)
+			rand.New(rand.NewSource(1)).Read(data)
+			assert.Nil(t, s.Store("foo", bytes.NewReader(data)))
+
+			for _, r := range [][2]int64{{0, 10}, {4095, 2}, {12345, 20000}, {49990, 100}, {50000, 10}} {
+				assert.Nil(t, s.store.Delete(s.ID, "foo"))
+
+				rc, err := s.GetRange("foo", r[0], r[1])
+				assert.Nil(t, err)
+				b, err := io.ReadAll(rc)
+				assert.Nil(t, err)
+				assert.Nil(t, rc.Close())
+				assert.Equal(t, data[r[0]:min(r[0]+r[1], int64(len(data)))], b)
+			}
+
+			// An offset past the end fails, whether the file is on the local disk or not
+			assert.Nil(t, s.store.Delete(s.ID, "foo"))
+			_, err := s.GetRange("foo", 50001, 10)
+			assert.ErrorIs(t, err, ErrOutOfRange)
+			r, err := s.Get("foo")
+			assert.Nil(t, err)
+			assert.Nil(t, r.(io.Closer).Close())
+			_, err = s.GetRange("foo", 50001, 10)
+			assert.ErrorIs(t, err, ErrOutOfRange)
+		})
+	}
+}
+
+func TestFileServerErrors(t *testing.T) {
+	for name, opts := range serverModes {
+		t.Run(name, func(t *testing.T) {
+			opts.Quota = 1000
+			servers := newTestCluster(t, 3, opts, nil)
+			s := servers[2]
+
+			_, err := s.Get("foo")
+			assert.ErrorIs(t, err, ErrNotFound)
+
+			data := make([]byte, 5000)
+			err = s.Store("foo", bytes.NewReader(data))
+			assert.ErrorIs(t, err, ErrQuotaExceeded)
+		})
+	}
+}
+
+func TestFileServerInvalidKey(t *testing.T) {
+	servers := newTestCluster(t, 2, FileServerOpts{}, nil)
+	s := servers[1]
+
+	for _, key := range []string{"", "../foo", "foo/../../bar", "/tmp/foo"} {
+		assert.ErrorIs(t, s.Store(key, bytes.NewReader([]byte("Foo"))), ErrInvalid, key)
+		_, err := s.Get(key)
+		assert.ErrorIs(t, err, ErrInvalid, key)
+		assert.ErrorIs(t, s.Delete(key), ErrInvalid, key)
+
+		// The peers check the keys of the messages as well
+		msg := &Message{Payload: MessageDeleteFile{ID: s.ID, Key: key}}
+		assert.ErrorIs(t, servers[0].handleMessage(s.Transport.Addr(), nil, msg), ErrInvalid, key)
+	}
+}
+
+func TestFileServerInvalidHash(t *testing.T) {
+	servers := newTestCluster(t, 2, FileServerOpts{}, nil)
+	s := servers[1]
+
+	// The hashes name the partial files, so they can't hold a path
+	for _, hash := range []string{"/../../../../tmp/foo", "FOO", hashChunk([]byte("Foo"))[1:]} {
+		msgs := []any{
+			MessageStoreFile{ID: s.ID, Key: "foo", Size: 3, Hash: hash},
+			MessageGetOffset{ID: s.ID, Key: "foo", Hash: hash},
+			MessageGetFile{ID: s.ID, Key: "foo", Hash: hash},
+			MessageHasChunks{ID: s.ID, Hashes: []string{hash}},
+		}
+		for _, payload := range msgs {
+			err := servers[0].handleMessage(s.Transport.Addr(), nil, &Message{Payload: payload})
+			assert.ErrorIs(t, err, ErrInvalid, "%T %s", payload, hash)
+		}
+	}
+	usage, err := servers[0].store.Usage(s.ID)
+	assert.Nil(t, err)
+	assert.Zero(t, usage)
+}
+
+func TestFileServerDelete(t *testing.T) {
+	for name, opts := range serverModes {
+		t.Run(name, func(t *testing.T) {
+			servers := newTestCluster(t, 4, opts, nil)
+			s := servers[3]
+
+			assert.Nil(t, s.Store("foo", bytes.NewReader(make([]byte, 10000))))
+			assert.Nil(t, s.Delete("foo"))
+
+			_, err := s.Get("foo")
+			assert.ErrorIs(t, err, ErrNotFound)
+			assert.ErrorIs(t, s.Delete("foo"), ErrNotFound)
+		})
+	}
+}
+
+func TestFileServerDeleteChunks(t *testing.T) {
+	servers := newTestCluster(t, 3, FileServerOpts{ChunkSize: 4096}, nil)
+	s := servers[2]
+
+	blocks := make([][]byte, 4)
+	hashes := make([]string, len(blocks))
+	for i := range blocks {
+		blocks[i] = make([]byte, 4096)
+		rand.New(rand.NewSource(int64(i))).Read(blocks[i])
+		encrypted, err := encryptConvergent(s.EncryptionKey, blocks[i])
+		assert.Nil(t, err)
+		hashes[i] = hashChunk(encrypted)
+	}
+	// Both files share their first two chunks
+	foo := slices.Concat(blocks[0], blocks[1], blocks[2])
+	bar := slices.Concat(blocks[0], blocks[1], blocks[3])
+	assert.Nil(t, s.Store("foo", bytes.NewReader(foo)))
+	assert.Nil(t, s.Store("bar", bytes.NewReader(bar)))
+
+	held := func(i int) bool {
+		return servers[0].store.Has(s.ID, chunkKey(hashes[i]))
+	}
+
+	assert.Nil(t, s.Delete("foo"))
+	assert.True(t, held(0))
+	assert.True(t, held(1))
+	assert.False(t, held(2))
+	assert.True(t, held(3))
+
+	assert.Nil(t, s.store.Delete(s.ID, "bar"))
+	r, err := s.Get("bar")
+	assert.Nil(t, err)
+	b, err := io.ReadAll(r)
+	assert.Nil(t, err)
+	assert.Equal(t, bar, b)
+
+	assert.Nil(t, s.Delete("bar"))
+	for i := range hashes {
+		assert.False(t, held(i))
+	}
+}
+
+func TestFileServerCodecs(t *testing.T) {
+	for _, c := range codecs {
+		t.Run(c.Name(), func(t *testing.T) {
+			servers := newTestCluster(t, 2, FileServerOpts{Codecs: []string{c.Name()}}, nil)
+			s := servers[1]
+			assert.Equal(t, c, codecFor(s.sortedPeers()[0]))
+
+			data := []byte("my big data file here!")
+			assert.Nil(t, s.Store("foo", bytes.NewReader(data)))
+			assert.Nil(t, s.store.Delete(s.ID, "foo"))
+
+			r, err := s.Get("foo")
+			assert.Nil(t, err)
+			b, err := io.ReadAll(r)
+			assert.Nil(t, err)
+			assert.Equal(t, data, b)
+		})
+	}
+}
+
+func TestFileServerErasurePartition(t *testing.T) {
+	var (
+		faults  = p2p.NewFaultInjector(p2p.FaultOpts{Seed: 1, Latency: time.Millisecond})
+		servers = newTestCluster(t, 4, FileServerOpts{Erasure: &ErasureOpts{DataShards: 2, ParityShards: 1}}, faults)
+		s       = servers[3]
+		data    = bytes.Repeat([]byte("my big data file here!"), 1000)
+	)
+	assert.Nil(t, s.Store("foo", bytes.NewReader(data)))
+	assert.Nil(t, s.store.Delete(s.ID, "foo"))
+
+	// Any data shard can be rebuilt from the parity shard
+	faults.Partition(servers[0].Transport.Addr())
+
+	r, err := s.Get("foo")
+	assert.Nil(t, err)
+	b, err := io.ReadAll(r)
+	assert.Nil(t, err)
+	assert.Equal(t, data, b)
+}
+
+func TestFileServerDownloadPartial(t *testing.T) {
+	var (
+		servers   = newTestCluster(t, 2, FileServerOpts{}, nil)
+		peer, s   = servers[0], servers[1]
+		data      = bytes.Repeat([]byte("my big data file here!"), 1000)
+		hashedKey = hashKey("foo")
+	)
+	assert.Nil(t, s.Store("foo", bytes.NewReader(data)))
+	_, r, err := peer.store.Read(s.ID, hashedKey)
+	assert.Nil(t, err)
+	encrypted, err := io.ReadAll(r)
+	r.(io.Closer).Close()
+	assert.Nil(t, err)
+
+	get := func() ([]byte, error) {
+		assert.Nil(t, s.store.Delete(s.ID, "foo"))
+		r, err := s.Get("foo")
+		if err != nil {
+			return nil, err
+		}
+		return io.ReadAll(r)
+	}
+
+	// The partial download of an older content of the key is dropped
+	_, err = s.store.WritePartial(s.ID, hashedKey, hashChunk([]byte("old")), 0, bytes.NewReader([]byte("old content")))
+	assert.Nil(t, err)
+	b, err := get()
+	assert.Nil(t, err)
+	assert.Equal(t, data, b)
+	assert.Empty(t, s.store.PartialTags(s.ID, hashedKey))
+
+	// Corrupted bytes on disk are caught by the hash before the file is decrypted
+	corrupted := append([]byte("corrupted"), encrypted[9:100]...)
+	_, err = s.store.WritePartial(s.ID, hashedKey, hashChunk(encrypted), 0, bytes.NewReader(corrupted))
+	assert.Nil(t, err)
+	_, err = get()
+	assert.ErrorContains(t, err, "has hash")
+	assert.Empty(t, s.store.PartialTags(s.ID, hashedKey))
+	b, err = get()
+	assert.Nil(t, err)
+	assert.Equal(t, data, b)
+}
+
+func TestFileServerPeerLost(t *testing.T) {
+	servers := newTestCluster(t, 3, FileServerOpts{}, nil)
+
+	// A node stopped without leaving the network is forgotten by the others, but kept
+	// in their cluster state until it expires
+	lost := time.Now()
+	servers[0].Stop()
+	for _, s := range servers[1:] {
+		assert.Eventually(t, func() bool {
+			peer, _ := s.cluster.Peer(servers[0].ID)
+			return len(s.sortedPeers()) == 1 && peer.LastSeen.After(lost)
+		}, time.Second, time.Millisecond)
+		assert.True(t, s.knownPeer(servers[0].ID))
+	}
+	peer, _ := servers[1].cluster.Peer(servers[0].ID)
+	peer.LastSeen = lost.Add(-knownPeerTTL)
+	assert.Nil(t, servers[1].cluster.PutPeer(peer))
+	assert.False(t, servers[1].knownPeer(servers[0].ID))
+	_, known := servers[1].cluster.Peer(servers[0].ID)
+	assert.False(t, known)
+
+	data := []byte("my big data file here!")
+	assert.Nil(t, servers[2].Store("foo", bytes.NewReader(data)))
+	assert.True(t, servers[1].store.Has(servers[2].ID, hashKey("foo")))
+	assert.Nil(t, servers[2].Delete("foo"))
+}
+
+func TestFileServerResumeAfterCut(t *testing.T) {
+	var (
+		faults  = p2p.NewFaultInjector(p2p.FaultOpts{})
+		servers = newTestCluster(t, 2, FileServerOpts{}, faults)
+		peer, s = servers[0], servers[1]
+		data    = make([]byte, 1<<20)
+	)
+	rand.New(rand.NewSource(1)).Read(data)
+
+	// The connection is cut in the middle of the transfer. The node dialed the peer,
+	// so it dials it again
+	faults.CutAfter(300_000)
+	assert.NotNil(t, s.Store("foo", bytes.NewReader(data)))
+	assert.Eventually(t, func() bool {
+		return len(s.sortedPeers()) == 1 && len(peer.sortedPeers()) == 1
+	}, 2*time.Second, time.Millisecond)
+
+	// The retry only sends the bytes the peer is missing
+	assert.Nil(t, s.Store("foo", bytes.NewReader(data)))
+	received := peer.metrics.bytesStored.values["peer"]
+	assert.Greater(t, received, float64(0))
+	assert.Less(t, received, float64(len(data)-200_000))
+
+	assert.Nil(t, s.store.Delete(s.ID, "foo"))
+	r, err := s.Get("foo")
+	assert.Nil(t, err)
+	b, err := io.ReadAll(r)
+	assert.Nil(t, err)
+	assert.Equal(t, data, b)
+}
+
+func TestFileServerShutdown(t *testing.T) {
+	servers := newTestCluster(t, 3, FileServerOpts{}, nil)
+	data := []byte("my big data file here!")
+	assert.Nil(t, servers[0].Store("foo", bytes.NewReader(data)))
+
+	// An operation in flight holds the shutdown
+	assert.Nil(t, servers[0].begin())
+	done := make(chan error)
+	go func() {
+		done <- servers[0].Shutdown(context.Background())
+	}()
+	assert.Eventually(t, func() bool {
+		return errors.Is(servers[0].Store("bar", bytes.NewReader(data)), ErrServerClosed)
+	}, time.Second, time.Millisecond)
+	select {
+	case <-done:
+		t.Fatal("shutdown returned with an operation in flight")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	servers[0].ops.Done()
+	assert.Nil(t, <-done)
+
+	// The peers forget the node and keep working without it
+	for _, s := range servers[1:] {
+		assert.Eventually(t, func() bool {
+			_, known := s.cluster.Peer(servers[0].ID)
+			return len(s.sortedPeers()) == 1 && !known
+		}, time.Second, time.Millisecond)
+	}
+	assert.Nil(t, servers[2].Store("baz", bytes.NewReader(data)))
+	assert.Nil(t, servers[2].store.Delete(servers[2].ID, "baz"))
+	r, err := servers[2].Get("baz")
+	assert.Nil(t, err)
+	b, err := io.ReadAll(r)
+	assert.Nil(t, err)
+	assert.Equal(t, data, b)
+
+	// The context bounds the wait for the operations
+	assert.Nil(t, servers[1].begin())
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	assert.Equal(t, context.DeadlineExceeded, servers[1].Shutdown(ctx))
+	servers[1].ops.Done()
+}
+
+func TestFileServerRestart(t *testing.T) {
+	network := p2p.NewMemoryNetwork()
+	s0 := newMemoryServer(t, network, "node-0", FileServerOpts{}, nil)
+	go s0.Start()
+	defer s0.Stop()
+	assert.Eventually(t, func() bool {
+		return slices.Contains(network.Addrs(), "node-0")
+	}, time.Second, time.Millisecond)
+
+	opts := FileServerOpts{StorageRoot: t.TempDir()}
+	s1 := newMemoryServer(t, network, "node-1", opts, nil, "node-0")
+	go s1.Start()
+	assert.Eventually(t, func() bool {
+		return len(s1.sortedPeers()) == 1
+	}, time.Second, time.Millisecond)
+	id := s1.ID
+	s1.Stop()
+	assert.Eventually(t, func() bool {
+		return !slices.Contains(network.Addrs(), "node-1")
+	}, time.Second, time.Millisecond)
+
+	// Restarted without bootstrap nodes, the node keeps its ID and dials its peers again
+	s1 = newMemoryServer(t, network, "node-1", opts, nil)
+	go s1.Start()
+	defer s1.Stop()
+	assert.Eventually(t, func() bool {
+		return len(s1.sortedPeers()) == 1
+	}, time.Second, time.Millisecond)
+	assert.Equal(t, id, s1.ID)
+
+	peers := s1.cluster.Peers()
+	assert.Len(t, peers, 1)
+	assert.Equal(t, s0.ID, peers[0].ID)
+	assert.Equal(t, "node-0", peers[0].Address)
+	assert.True(t, peers[0].Outbound)
+
+	peers = s0.cluster.Peers()
+	assert.Len(t, peers, 1)
+	assert.Equal(t, "node-1", peers[0].Address)
+	assert.False(t, peers[0].Outbound)
+}
+
+func TestNewFileServerCorruptState(t *testing.T) {
+	root := t.TempDir()
+	for _, file := range []string{indexFile, clusterFile} {
+		path := filepath.Join(root, file)
+		assert.Nil(t, os.WriteFile(path, []byte("Foo not Bar"), 0o644))
+		_, err := NewFileServer(FileServerOpts{StorageRoot: root})
+		assert.NotNil(t, err, file)
+		assert.Nil(t, os.Remove(path))
+	}
+
+	s, err := NewFileServer(FileServerOpts{StorageRoot: root})
+	assert.Nil(t, err)
+	assert.NotNil(t, s)
+}
+
+// newTestCluster starts the servers in a virtual network, each one connected to all
+// the servers started before it, and waits for all the connections. The transports
+// are decorated with the faults, when given
+func newTestCluster(t *testing.T, size int, opts FileServerOpts, faults *p2p.FaultInjector) []*FileServer {
+	network := p2p.NewMemoryNetwork()
+
+	servers := make([]*FileServer, 0, size)
+	for i := 0; i < size; i++ {
+		var nodes []string
+		for _, s := range servers {
+			nodes = append(nodes, s.Transport.Addr())
+		}
+		s := newMemoryServer(t, network, fmt.Sprintf("node-%d", i), opts, faults, nodes...)
+		servers = append(servers, s)
+
+		go s.Start()
+		assert.Eventually(t, func() bool {
+			return slices.Contains(network.Addrs(), s.Transport.Addr())
+		}, time.Second, time.Millisecond)
+	}
+	t.Cleanup(func() {
+		for _, s := range servers {
+			s.Stop()
+		}
+	})
+
+	for _, s := range servers {
+		assert.Eventually(t, func() bool {
+			return len(s.sortedPeers()) == size-1
+		}, time.Second, time.Millisecond)
+	}
+
+	return servers
+}
+
+func newMemoryServer(t *testing.T, network *p2p.MemoryNetwork, addr string, opts FileServerOpts, faults *p2p.FaultInjector, nodes ...string) *FileServer {
+	transport := p2p.NewMemoryTransport(p2p.MemoryTransportOpts{
+		ListenAddress: addr,
+		Network:       network,
+		Decoder:       p2p.DefaultDecoder{},
+	})
+
+	opts.EncryptionKey = newEncryptionKey()
+	if opts.StorageRoot == "" {
+		opts.StorageRoot = t.TempDir()
+	}
+	opts.PathTransformerFunc = CASPathTransformerFunc
+	opts.Transport = transport
+	opts.BootstrapNodes = nodes
+
+	var faultTransport *p2p.FaultTransport
+	if faults != nil {
+		faultTransport = p2p.NewFaultTransport(transport, faults)
+		opts.Transport = faultTransport
+	}
+
+	s, err := NewFileServer(opts)
+	assert.Nil(t, err)
+	transport.HandshakeFunc = p2p.NewHandshakeFunc(s.NodeInfo())
+	transport.OnPeer = s.OnPeer
+	if faultTransport != nil {
+		transport.OnPeer = faultTransport.WrapOnPeer(s.OnPeer)
+	}
+
+	return s
+}
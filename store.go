@@ -6,9 +6,12 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"io/fs"
 	"log"
 	"os"
+	"path/filepath"
 	"strings"
+	"sync"
 )
 
 const defaultRootFolderName = "system-files"
@@ -48,6 +51,16 @@ func CASPathTransformerFunc(key string) (pathKey PathKey) {
 	return PathKey{PathName: strings.Join(paths, "/"), FileName: stringHash}
 }
 
+// checkKey fails for the keys that can't be used as a path, like the absolute keys or
+// the keys with .. segments, which would escape the folder of the owner when the key
+// is used as the path, as DefaultPathTransformFunc does
+func checkKey(key string) error {
+	if !filepath.IsLocal(key) {
+		return fmt.Errorf("%w: key %q is not a local path", ErrInvalid, key)
+	}
+	return nil
+}
+
 type PathKey struct {
 	PathName string
 	FileName string
@@ -75,6 +88,11 @@ type StoreOpts struct {
 
 type Store struct {
 	StoreOpts
+
+	// usage caches the bytes on disk of each node, computed once by Usage and then
+	// kept up to date by the writes and removals of the store
+	usageLock sync.Mutex
+	usage     map[string]int64
 }
 
 func NewStore(opts StoreOpts) *Store {
@@ -84,7 +102,10 @@ func NewStore(opts StoreOpts) *Store {
 	if len(opts.Root) == 0 {
 		opts.Root = defaultRootFolderName
 	}
-	return &Store{StoreOpts: opts}
+	return &Store{
+		StoreOpts: opts,
+		usage:     make(map[string]int64),
+	}
 }
 
 func (s *Store) Write(id, key string, r io.Reader) (int64, error) {
@@ -92,14 +113,10 @@ func (s *Store) Write(id, key string, r io.Reader) (int64, error) {
 }
 
 func (s *Store) WriteDecrypt(id, key string, encryptedKey []byte, r io.Reader) (int64, error) {
-	f, err := s.openFileForWriting(id, key)
-	if err != nil {
-		return 0, err
-	}
-	defer closeFile(f)
-	// Copy the data received in r to the created file
-	n, err := copyDecrypt(encryptedKey, r, f)
-	return int64(n), err
+	return s.writeFile(id, key, func(f *os.File) (int64, error) {
+		n, err := copyDecrypt(encryptedKey, r, f)
+		return int64(n), err
+	})
 }
 
 // Read returns a buffer with the data read from the received key
@@ -107,6 +124,33 @@ func (s *Store) Read(id, key string) (int64, io.Reader, error) {
 	return s.readStream(id, key)
 }
 
+// ReadRange returns the bytes of the key starting at the offset, up to length bytes,
+// along with the amount of bytes that will actually be read
+func (s *Store) ReadRange(id, key string, offset, length int64) (int64, io.ReadCloser, error) {
+	size, f, err := s.readStream(id, key)
+	if err != nil {
+		return 0, nil, err
+	}
+	if offset < 0 || offset > size {
+		f.Close()
+		return 0, nil, fmt.Errorf("%w: offset %d is out of the %d bytes of %s", ErrOutOfRange, offset, size, key)
+	}
+	if _, err := f.(io.Seeker).Seek(offset, io.SeekStart); err != nil {
+		f.Close()
+		return 0, nil, err
+	}
+	n := min(length, size-offset)
+
+	return n, readCloser{Reader: io.LimitReader(f, n), Closer: f}, nil
+}
+
+// readCloser reads from the Reader and closes the Closer, usually the file the
+// Reader wraps
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
 func (s *Store) Delete(id, key string) error {
 	pathKey := s.PathTransformerFunc(key)
 
@@ -114,6 +158,11 @@ func (s *Store) Delete(id, key string) error {
 
 	firstPathWithRoot := fmt.Sprintf("%s/%s/%s", s.Root, id, pathKey.firstPathName())
 
+	// The folder may hold any amount of files, so the usage is computed again
+	s.usageLock.Lock()
+	delete(s.usage, id)
+	s.usageLock.Unlock()
+
 	return os.RemoveAll(firstPathWithRoot)
 }
 
@@ -126,21 +175,209 @@ func (s *Store) Has(id, key string) (ok bool) {
 	return !errors.Is(err, os.ErrNotExist)
 }
 
+// Size returns the size of the file of the giving key
+func (s *Store) Size(id, key string) (int64, error) {
+	pathKey := s.PathTransformerFunc(key)
+	info, err := os.Stat(fmt.Sprintf("%s/%s/%s", s.Root, id, pathKey.fullPath()))
+	if err != nil {
+		return 0, err
+	}
+	return info.Size(), nil
+}
+
+// Remove deletes only the file of the giving key, unlike Delete which removes the
+// whole first folder of the transformed path
+func (s *Store) Remove(id, key string) error {
+	path := s.path(id, key)
+	return s.track(id, func() error { return os.Remove(path) }, path)
+}
+
+// Usage returns how many bytes the files of the node take on disk, unfinished
+// transfers included. The files are only walked the first time, the usage is then
+// updated by every change of the store
+func (s *Store) Usage(id string) (int64, error) {
+	s.usageLock.Lock()
+	defer s.usageLock.Unlock()
+
+	if usage, ok := s.usage[id]; ok {
+		return usage, nil
+	}
+	var size int64
+	err := filepath.WalkDir(fmt.Sprintf("%s/%s", s.Root, id), func(path string, d fs.DirEntry, err error) error {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		if err != nil || d.IsDir() {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		size += info.Size()
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	s.usage[id] = size
+
+	return size, nil
+}
+
+// track runs op, which changes the files at the given paths, and adds the change of
+// their sizes to the usage of the node
+func (s *Store) track(id string, op func() error, paths ...string) error {
+	s.usageLock.Lock()
+	defer s.usageLock.Unlock()
+
+	var before int64
+	for _, path := range paths {
+		before += fileSize(path)
+	}
+	if err := op(); err != nil {
+		return err
+	}
+	if usage, ok := s.usage[id]; ok {
+		for _, path := range paths {
+			usage += fileSize(path)
+		}
+		s.usage[id] = usage - before
+	}
+	return nil
+}
+
+// addUsage adds delta bytes to the usage of the node, if it was computed already
+func (s *Store) addUsage(id string, delta int64) {
+	s.usageLock.Lock()
+	defer s.usageLock.Unlock()
+
+	if usage, ok := s.usage[id]; ok {
+		s.usage[id] = usage + delta
+	}
+}
+
+// fileSize returns the size of the file, zero when it doesn't exist
+func fileSize(path string) int64 {
+	info, err := os.Stat(path)
+	if err != nil {
+		return 0
+	}
+	return info.Size()
+}
+
 func (s *Store) Clear() error {
+	s.usageLock.Lock()
+	clear(s.usage)
+	s.usageLock.Unlock()
+
 	return os.RemoveAll(s.Root)
 }
 
-// writeStream receives the key, transforms into a pathName using the received
-// path transformer function, create the folders following the transformed path
-// and save the file (r Reader)
-func (s *Store) writeStream(id, key string, r io.Reader) (int64, error) {
-	f, err := s.openFileForWriting(id, key)
+// PartialSize returns how many bytes of an unfinished transfer of the key are saved on
+// disk. The tag identifies the transfer, so the bytes of different contents for the same
+// key are never mixed
+func (s *Store) PartialSize(id, key, tag string) int64 {
+	info, err := os.Stat(s.partialPath(id, key, tag))
+	if err != nil {
+		return 0
+	}
+	return info.Size()
+}
+
+// PartialTags returns the tags of the unfinished transfers of the key saved on disk
+func (s *Store) PartialTags(id, key string) []string {
+	dir, name := filepath.Split(s.partialPath(id, key, ""))
+	prefix := strings.TrimSuffix(name, ".partial")
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil
+	}
+
+	var tags []string
+	for _, entry := range entries {
+		rest, ok := strings.CutPrefix(entry.Name(), prefix)
+		if !ok {
+			continue
+		}
+		// Tags have no dots, so the partial files of longer keys are skipped
+		if tag, ok := strings.CutSuffix(rest, ".partial"); ok && tag != "" && !strings.Contains(tag, ".") {
+			tags = append(tags, tag)
+		}
+	}
+
+	return tags
+}
+
+// WritePartial writes the data of r to the partial file of the key starting at offset,
+// discarding anything saved after the offset. It fails if there are less than offset
+// bytes saved, as the transfer would have a gap
+func (s *Store) WritePartial(id, key, tag string, offset int64, r io.Reader) (int64, error) {
+	if _, err := s.mkdirAll(id, key); err != nil {
+		return 0, err
+	}
+	f, err := os.OpenFile(s.partialPath(id, key, tag), os.O_CREATE|os.O_WRONLY, 0644)
 	if err != nil {
 		return 0, err
 	}
 	defer closeFile(f)
-	// Copy the data received in r to the created file
-	return io.Copy(f, r)
+
+	info, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+	if info.Size() < offset {
+		return 0, fmt.Errorf("can't resume (%s) from offset %d, only %d bytes on disk", key, offset, info.Size())
+	}
+	if err := f.Truncate(offset); err != nil {
+		return 0, err
+	}
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		return 0, err
+	}
+
+	n, err := io.Copy(f, r)
+	s.addUsage(id, offset+n-info.Size())
+
+	return n, err
+}
+
+// ReadPartial returns the partial file of the key
+func (s *Store) ReadPartial(id, key, tag string) (io.ReadCloser, error) {
+	return os.Open(s.partialPath(id, key, tag))
+}
+
+// CommitPartial moves the finished partial file to the transformed path of the key
+func (s *Store) CommitPartial(id, key, tag string) error {
+	partial, path := s.partialPath(id, key, tag), s.path(id, key)
+	return s.track(id, func() error { return os.Rename(partial, path) }, partial, path)
+}
+
+// RemovePartial deletes the partial file of the key
+func (s *Store) RemovePartial(id, key, tag string) error {
+	partial := s.partialPath(id, key, tag)
+	return s.track(id, func() error { return os.Remove(partial) }, partial)
+}
+
+// path returns the transformed path of the key, along with the root and the node
+func (s *Store) path(id, key string) string {
+	pathKey := s.PathTransformerFunc(key)
+	return fmt.Sprintf("%s/%s/%s", s.Root, id, pathKey.fullPath())
+}
+
+func (s *Store) partialPath(id, key, tag string) string {
+	pathKey := s.PathTransformerFunc(key)
+	return fmt.Sprintf("%s/%s/%s.%s.partial", s.Root, id, pathKey.fullPath(), tag)
+}
+
+// writeStream receives the key, transforms into a pathName using the received
+// path transformer function, create the folders following the transformed path
+// and save the file (r Reader)
+func (s *Store) writeStream(id, key string, r io.Reader) (int64, error) {
+	return s.writeFile(id, key, func(f *os.File) (int64, error) {
+		// Copy the data received in r to the created file
+		return io.Copy(f, r)
+	})
 }
 
 // readStream returns the file saved on the transformed path from the receiving key
@@ -161,17 +398,46 @@ func (s *Store) readStream(id, key string) (int64, io.ReadCloser, error) {
 	return fileInfo.Size(), f, nil
 }
 
-func (s *Store) openFileForWriting(id, key string) (*os.File, error) {
-	pathKey := s.PathTransformerFunc(key)                                     // Transform the path with the provided key and function
-	pathNameWithRoot := fmt.Sprintf("%s/%s/%s", s.Root, id, pathKey.PathName) // Adds the root path
+// writeFile calls write with a temporary file created in the transformed path, and
+// only moves it to the final name once write succeeds, so a failed or interrupted
+// write never leaves an incomplete file behind
+func (s *Store) writeFile(id, key string, write func(f *os.File) (int64, error)) (int64, error) {
+	f, err := s.openFileForWriting(id, key)
+	if err != nil {
+		return 0, err
+	}
+
+	n, err := write(f)
+	closeFile(f)
+	if err != nil {
+		os.Remove(f.Name())
+		return n, err
+	}
 
-	if err := os.MkdirAll(pathNameWithRoot, os.ModePerm); err != nil { // Creates all the folders using the giving path
+	// The temporary file isn't counted in the usage until it replaces the file
+	fullPathWithRoot := s.path(id, key)
+
+	return n, s.track(id, func() error { return os.Rename(f.Name(), fullPathWithRoot) }, fullPathWithRoot)
+}
+
+func (s *Store) openFileForWriting(id, key string) (*os.File, error) {
+	pathNameWithRoot, err := s.mkdirAll(id, key)
+	if err != nil {
 		return nil, err
 	}
-	fullPathWithRoot := fmt.Sprintf("%s/%s/%s", s.Root, id, pathKey.fullPath())
+	pathKey := s.PathTransformerFunc(key)
+
+	// Create the temporary file in the transformed path
+	return os.CreateTemp(pathNameWithRoot, pathKey.FileName+".*.tmp")
+}
+
+// mkdirAll creates all the folders of the transformed path and returns the path
+func (s *Store) mkdirAll(id, key string) (string, error) {
+	pathKey := s.PathTransformerFunc(key)                                     // Transform the path with the provided key and function
+	pathNameWithRoot := fmt.Sprintf("%s/%s/%s", s.Root, id, pathKey.PathName) // Adds the root path
 
-	// Create the file in the transformed path
-	return os.Create(fullPathWithRoot)
+	// Creates all the folders using the giving path
+	return pathNameWithRoot, os.MkdirAll(pathNameWithRoot, os.ModePerm)
 }
 
 func closeFile(f *os.File) {
@@ -21,12 +21,13 @@ func TestDelete(t *testing.T) {
 	s := newStore()
 	defer tearDown(t, s)
 
+	id, _ := generateID()
 	key := "somefile"
 	data := []byte("some jpg file")
-	_, err := s.writeStream(key, bytes.NewReader(data))
+	_, err := s.writeStream(id, key, bytes.NewReader(data))
 	assert.Nil(t, err)
 
-	err = s.Delete(key)
+	err = s.Delete(id, key)
 	assert.Nil(t, err)
 }
 
@@ -34,18 +35,19 @@ func TestStore(t *testing.T) {
 	s := newStore()
 	defer tearDown(t, s)
 
+	id, _ := generateID()
 	key := "somefile"
 	data := []byte("some jpg file")
-	_, err := s.writeStream(key, bytes.NewReader(data))
+	_, err := s.writeStream(id, key, bytes.NewReader(data))
 
 	assert.Nil(t, err)
 
-	ok := s.Has(key)
+	ok := s.Has(id, key)
 
 	assert.Nil(t, err)
 	assert.True(t, ok)
 
-	_, r, err := s.Read(key)
+	_, r, err := s.Read(id, key)
 	assert.Nil(t, err)
 
 	b, _ := io.ReadAll(r)
@@ -53,6 +55,111 @@ func TestStore(t *testing.T) {
 
 }
 
+func TestWritePartial(t *testing.T) {
+	s := newStore()
+	defer tearDown(t, s)
+
+	id, _ := generateID()
+	key := "somefile"
+	tag := "transfer"
+	data := []byte("some jpg file")
+
+	// The first transfer drops after a few bytes
+	n, err := s.WritePartial(id, key, tag, 0, bytes.NewReader(data[:4]))
+	assert.Nil(t, err)
+	assert.Equal(t, int64(4), n)
+	assert.False(t, s.Has(id, key))
+	assert.Equal(t, []string{tag}, s.PartialTags(id, key))
+
+	// The second transfer resumes from what is on disk
+	offset := s.PartialSize(id, key, tag)
+	assert.Equal(t, int64(4), offset)
+	_, err = s.WritePartial(id, key, tag, offset, bytes.NewReader(data[offset:]))
+	assert.Nil(t, err)
+
+	// A gap between the bytes on disk and the offset is not allowed
+	_, err = s.WritePartial(id, key, tag, int64(len(data)+1), bytes.NewReader(data))
+	assert.NotNil(t, err)
+
+	assert.Nil(t, s.CommitPartial(id, key, tag))
+	assert.True(t, s.Has(id, key))
+	assert.Zero(t, s.PartialSize(id, key, tag))
+	assert.Empty(t, s.PartialTags(id, key))
+
+	_, r, err := s.Read(id, key)
+	assert.Nil(t, err)
+	b, _ := io.ReadAll(r)
+	assert.Equal(t, string(data), string(b))
+}
+
+func TestReadRange(t *testing.T) {
+	s := newStore()
+	defer tearDown(t, s)
+
+	id, _ := generateID()
+	key := "somefile"
+	data := []byte("some jpg file")
+	_, err := s.writeStream(id, key, bytes.NewReader(data))
+	assert.Nil(t, err)
+
+	n, r, err := s.ReadRange(id, key, 5, 3)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(3), n)
+	b, _ := io.ReadAll(r)
+	assert.Nil(t, r.Close())
+	assert.Equal(t, "jpg", string(b))
+
+	// The range is cut at the end of the file
+	n, r, err = s.ReadRange(id, key, 9, 100)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(4), n)
+	b, _ = io.ReadAll(r)
+	assert.Nil(t, r.Close())
+	assert.Equal(t, "file", string(b))
+
+	_, _, err = s.ReadRange(id, key, 100, 1)
+	assert.NotNil(t, err)
+}
+
+func TestUsage(t *testing.T) {
+	s := newStore()
+	defer tearDown(t, s)
+
+	id, _ := generateID()
+	usage := func() int64 {
+		n, err := s.Usage(id)
+		assert.Nil(t, err)
+		return n
+	}
+	assert.Equal(t, int64(0), usage())
+
+	_, err := s.writeStream(id, "foo", bytes.NewReader([]byte("some jpg file")))
+	assert.Nil(t, err)
+	assert.Equal(t, int64(13), usage())
+
+	// Replacing a file only counts the difference
+	_, err = s.writeStream(id, "foo", bytes.NewReader([]byte("some")))
+	assert.Nil(t, err)
+	assert.Equal(t, int64(4), usage())
+
+	_, err = s.WritePartial(id, "bar", "tag", 0, bytes.NewReader([]byte("some png")))
+	assert.Nil(t, err)
+	assert.Equal(t, int64(12), usage())
+	_, err = s.WritePartial(id, "bar", "tag", 4, bytes.NewReader([]byte(" gif")))
+	assert.Nil(t, err)
+	assert.Equal(t, int64(12), usage())
+	assert.Nil(t, s.CommitPartial(id, "bar", "tag"))
+	assert.Equal(t, int64(12), usage())
+
+	assert.Nil(t, s.Remove(id, "foo"))
+	assert.Equal(t, int64(8), usage())
+
+	// A new store walks the files and gets the same usage
+	walked, err := newStore().Usage(id)
+	assert.Nil(t, err)
+	assert.Equal(t, usage(), walked)
+}
+
 func newStore() *Store {
 	opts := StoreOpts{
 		PathTransformerFunc: CASPathTransformerFunc,
@@ -0,0 +1,319 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+
+	"github.com/marcosvdn7/go-filestorage/p2p"
+)
+
+// content is the data sent to the peers, which open reads from the offset on
+type content struct {
+	size int64
+	hash string
+	open func(offset int64) (io.Reader, error)
+}
+
+// bytesContent returns the content of the data in memory
+func bytesContent(data []byte) content {
+	return content{
+		size: int64(len(data)),
+		hash: hashChunk(data),
+		open: func(offset int64) (io.Reader, error) {
+			return bytes.NewReader(data[offset:]), nil
+		},
+	}
+}
+
+// encryptedContent returns the content of the file encrypted with the IV, which is
+// only encrypted as it's read, so the file is never held in memory
+func (fs *FileServer) encryptedContent(f io.ReadSeeker, size int64, iv []byte) (content, error) {
+	c := content{
+		size: aes.BlockSize + size,
+		open: func(offset int64) (io.Reader, error) {
+			return encryptReader(fs.EncryptionKey, iv, f, offset)
+		},
+	}
+	r, err := c.open(0)
+	if err != nil {
+		return content{}, err
+	}
+	sum, err := hashContent(r)
+	if err != nil {
+		return content{}, err
+	}
+	c.hash = hex.EncodeToString(sum[:])
+
+	return c, nil
+}
+
+// transfer stores the content under the given key in a single peer. The peer is asked
+// first how many bytes of the same content it already received, so a transfer that
+// was interrupted by a connection drop continues from where it stopped
+func (fs *FileServer) transfer(peer p2p.Peer, key string, c content) error {
+	offset, err := fs.partialOffset(peer, key, c.hash)
+	if err != nil {
+		return err
+	}
+	if offset > c.size {
+		offset = 0
+	}
+	if offset > 0 {
+		fmt.Printf("[%s] resuming transfer of (%s) to peer (%s) from byte %d\n", fs.Transport.Addr(), key, peer.RemoteAddr().String(), offset)
+	}
+
+	return fs.storeOnPeer(peer, key, c, offset)
+}
+
+// partialOffset asks the peer how many bytes of the data with the given hash it holds
+func (fs *FileServer) partialOffset(peer p2p.Peer, key, hash string) (int64, error) {
+	msg := Message{
+		Payload: MessageGetOffset{
+			ID:   fs.ID,
+			Key:  key,
+			Hash: hash,
+		},
+	}
+	stream, err := fs.query(peer, &msg)
+	if err != nil {
+		return 0, err
+	}
+	defer stream.Close()
+
+	var offset int64
+	err = binary.Read(stream, binary.LittleEndian, &offset)
+
+	return offset, err
+}
+
+// download fetches the encrypted file from the peer into a partial file and decrypts
+// it once it's complete. The partial file is tagged with the hash of the content, so
+// an interrupted download only resumes when the peer holds the same content, and the
+// hash is checked before the file is decrypted
+func (fs *FileServer) download(peer p2p.Peer, key string) error {
+	var (
+		hashedKey = hashKey(key)
+		tags      = fs.store.PartialTags(fs.ID, hashedKey)
+		msg       = MessageGetFile{ID: fs.ID, Key: hashedKey}
+	)
+	if len(tags) > 0 {
+		msg.Hash = tags[0]
+		msg.Offset = fs.store.PartialSize(fs.ID, hashedKey, msg.Hash)
+	}
+
+	stream, err := fs.query(peer, &Message{Payload: msg})
+	if err != nil {
+		return err
+	}
+	defer stream.Close()
+
+	// First read the header so we can limit the amount of bytes that we read from
+	// the stream so it will not keep hanging
+	var header fileHeader
+	if err := binary.Read(stream, binary.LittleEndian, &header); err != nil {
+		return err
+	}
+	hash := hex.EncodeToString(header.Hash[:])
+	if header.Offset > 0 {
+		fmt.Printf("[%s] resuming download of (%s) from byte %d\n", fs.Transport.Addr(), key, header.Offset)
+	}
+	// The bytes of other contents of the key are never mixed with this one
+	for _, tag := range tags {
+		if tag != hash {
+			fs.store.RemovePartial(fs.ID, hashedKey, tag)
+		}
+	}
+
+	n, err := fs.store.WritePartial(fs.ID, hashedKey, hash, header.Offset, io.LimitReader(stream, header.Remaining))
+	if err != nil {
+		return err
+	}
+	if n < header.Remaining {
+		return fmt.Errorf("received %d of %d bytes: %w", n, header.Remaining, io.ErrUnexpectedEOF)
+	}
+	fmt.Printf("[%s] received %d bytes from peer (%s)\n", fs.Transport.Addr(), n, peer.RemoteAddr().String())
+
+	if err := fs.checkPartial(hashedKey, hash); err != nil {
+		fs.store.RemovePartial(fs.ID, hashedKey, hash)
+		return err
+	}
+
+	r, err := fs.store.ReadPartial(fs.ID, hashedKey, hash)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	if _, err := fs.store.WriteDecrypt(fs.ID, key, fs.EncryptionKey, r); err != nil {
+		return err
+	}
+
+	return fs.store.RemovePartial(fs.ID, hashedKey, hash)
+}
+
+// checkPartial checks that the downloaded partial file has the hash it's tagged with
+func (fs *FileServer) checkPartial(key, hash string) error {
+	r, err := fs.store.ReadPartial(fs.ID, key, hash)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	sum, err := hashContent(r)
+	if err != nil {
+		return err
+	}
+	if got := hex.EncodeToString(sum[:]); got != hash {
+		return fmt.Errorf("[%s] downloaded (%s) has hash %s instead of %s", fs.Transport.Addr(), key, got, hash)
+	}
+
+	return nil
+}
+
+// hashContent returns the SHA-256 of the content read from r, the same hash as
+// hashChunk returns for the data in memory
+func hashContent(r io.Reader) ([sha256.Size]byte, error) {
+	var sum [sha256.Size]byte
+	h := sha256.New()
+	if _, err := io.Copy(h, r); err != nil {
+		return sum, err
+	}
+	copy(sum[:], h.Sum(nil))
+
+	return sum, nil
+}
+
+// getRange fetches the range of the file from the first peer holding it. The file is
+// encrypted with AES-CTR, so the range is decrypted with the key stream at its offset,
+// which only needs the IV stored in the first block
+func (fs *FileServer) getRange(key string, offset, length int64) (io.ReadCloser, error) {
+	err := ErrNotFound
+	for _, peer := range fs.sortedPeers() {
+		var r io.ReadCloser
+		if r, err = fs.getRangeFromPeer(peer, key, offset, length); err == nil {
+			return r, nil
+		}
+		log.Printf("[%s] range of (%s) from peer (%s) failed: %s", fs.Transport.Addr(), key, peer.RemoteAddr().String(), err)
+	}
+
+	return nil, fmt.Errorf("[%s] could not fetch the range of (%s) from the network: %w", fs.Transport.Addr(), key, err)
+}
+
+func (fs *FileServer) getRangeFromPeer(peer p2p.Peer, key string, offset, length int64) (io.ReadCloser, error) {
+	iv := make([]byte, aes.BlockSize)
+	_, stream, err := fs.fetchRange(peer, hashKey(key), 0, aes.BlockSize)
+	if err != nil {
+		return nil, err
+	}
+	_, err = io.ReadFull(stream, iv)
+	stream.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	ctr, err := newCTRAt(fs.EncryptionKey, iv, offset)
+	if err != nil {
+		return nil, err
+	}
+	header, stream, err := fs.fetchRange(peer, hashKey(key), aes.BlockSize+offset, length)
+	if err != nil {
+		return nil, err
+	}
+
+	return readCloser{
+		Reader: cipher.StreamReader{S: ctr, R: io.LimitReader(stream, header.Length)},
+		Closer: stream,
+	}, nil
+}
+
+// remoteSize asks the peers for the size of the file, without fetching its content
+func (fs *FileServer) remoteSize(key string) (int64, error) {
+	if fs.chunked() {
+		manifest, err := fs.fetchManifest(fs.sortedPeers(), key)
+		if err != nil {
+			return 0, err
+		}
+		return manifest.Size, nil
+	}
+
+	err := ErrNotFound
+	for _, peer := range fs.sortedPeers() {
+		var (
+			header rangeHeader
+			stream p2p.Stream
+		)
+		if header, stream, err = fs.fetchRange(peer, hashKey(key), 0, 0); err == nil {
+			stream.Close()
+			// The encrypted file starts with the IV
+			return header.Size - aes.BlockSize, nil
+		}
+	}
+
+	return 0, fmt.Errorf("[%s] could not find (%s) in the network: %w", fs.Transport.Addr(), key, err)
+}
+
+// fetchRange requests the range of the data stored under the key to the peer. The
+// peer answers with the rangeHeader, followed by the bytes of the range
+func (fs *FileServer) fetchRange(peer p2p.Peer, key string, offset, length int64) (rangeHeader, p2p.Stream, error) {
+	msg := Message{
+		Payload: MessageGetRange{
+			ID:     fs.ID,
+			Key:    key,
+			Offset: offset,
+			Length: length,
+		},
+	}
+	stream, err := fs.query(peer, &msg)
+	if err != nil {
+		return rangeHeader{}, nil, err
+	}
+
+	var header rangeHeader
+	if err := binary.Read(stream, binary.LittleEndian, &header); err != nil {
+		stream.Close()
+		return rangeHeader{}, nil, err
+	}
+
+	return header, stream, nil
+}
+
+func (fs *FileServer) handleMessageGetRange(from string, stream p2p.Stream, msg MessageGetRange) error {
+	if !fs.store.Has(msg.ID, msg.Key) {
+		return fmt.Errorf("[%s] need to serve a range of file %s but it does not exist on disk: %w", fs.Transport.Addr(), msg.Key, ErrNotFound)
+	}
+
+	size, err := fs.store.Size(msg.ID, msg.Key)
+	if err != nil {
+		return err
+	}
+	n, r, err := fs.store.ReadRange(msg.ID, msg.Key, msg.Offset, msg.Length)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	if err := binary.Write(stream, binary.LittleEndian, rangeHeader{Size: size, Length: n}); err != nil {
+		return err
+	}
+	written, err := io.Copy(stream, r)
+	fs.metrics.bytesServed.add(float64(written), "peer")
+	if err != nil {
+		return err
+	}
+	fmt.Printf("[%s] written %d bytes of (%s) from byte %d over the network to %s\n", fs.Transport.Addr(), n, msg.Key, msg.Offset, from)
+
+	return nil
+}
+
+func (fs *FileServer) handleMessageGetOffset(stream p2p.Stream, msg MessageGetOffset) error {
+	offset := fs.store.PartialSize(msg.ID, msg.Key, msg.Hash)
+
+	return binary.Write(stream, binary.LittleEndian, offset)
+}